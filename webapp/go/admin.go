@@ -3,11 +3,16 @@ package main
 import (
 	"bytes"
 	"database/sql"
+	"encoding/base64"
 	"encoding/csv"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -15,6 +20,11 @@ import (
 // //////////////////////////////////////
 // admin
 
+const (
+	AdminUserSearchDefaultLimit int   = 50
+	AdminUserSearchMaxLimit     int64 = 200
+)
+
 // adminSessionCheckMiddleware 管理者ツール向けのセッション確認middleware
 func (h *Handler) adminSessionCheckMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -41,6 +51,7 @@ func (h *Handler) adminSessionCheckMiddleware(next echo.HandlerFunc) echo.Handle
 			}
 			return errorResponse(c, http.StatusUnauthorized, ErrExpiredSession)
 		}
+		c.Set("adminUserID", adminSession.UserID)
 
 		if err := next(c); err != nil {
 			c.Error(err)
@@ -49,6 +60,15 @@ func (h *Handler) adminSessionCheckMiddleware(next echo.HandlerFunc) echo.Handle
 	}
 }
 
+// getAdminUserID セッションを確認した管理者のIDをコンテキストから取得する
+func getAdminUserID(c echo.Context) (int64, error) {
+	v := c.Get("adminUserID")
+	if adminUserID, ok := v.(int64); ok {
+		return adminUserID, nil
+	}
+	return 0, ErrUnauthorized
+}
+
 // adminLogin 管理者権限ログイン
 // POST /admin/login
 func (h *Handler) adminLogin(c echo.Context) error {
@@ -57,52 +77,117 @@ func (h *Handler) adminLogin(c echo.Context) error {
 	if err := parseRequestBody(c, req); err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
+	setAuditAdminID(c, req.UserID)
 
 	requestAt, err := getRequestTime(c)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
+	// 失敗が続いている管理者ID、リクエスト元IPからの試行は待ち時間が過ぎるまで拒否する
+	retryAfter, err := h.adminLoginRetryAfter(req.UserID, c.RealIP(), requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if retryAfter > 0 {
+		return adminLoginTooManyFailures(c, retryAfter)
+	}
+
 	tx, err := h.DB.Beginx()
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 	defer tx.Rollback() //nolint:errcheck
 
-	query := "SELECT * FROM admin_users WHERE id=?"
+	query := "SELECT * FROM admin_users WHERE id=? AND deleted_at IS NULL"
 	user := new(AdminUser)
 	if err = tx.Get(user, query, req.UserID); err != nil {
 		if err == sql.ErrNoRows {
+			if err = h.recordAdminLoginFailure(c, req.UserID, false, requestAt); err != nil {
+				return errorResponse(c, http.StatusInternalServerError, err)
+			}
 			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
+	// ロック中はパスワードを検証しない
+	if user.LockedAt != nil {
+		return errorResponse(c, http.StatusLocked, ErrAdminUserLocked)
+	}
+
 	if err = verifyPassword(user.Password, req.Password); err != nil {
+		if err := h.recordAdminLoginFailure(c, user.ID, true, requestAt); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
 		return errorResponse(c, http.StatusUnauthorized, err)
 	}
 
-	query = "UPDATE admin_users SET last_activated_at=?, updated_at=? WHERE id=?"
-	if _, err = tx.Exec(query, requestAt, requestAt, req.UserID); err != nil {
+	if user.DisabledAt != nil {
+		return errorResponse(c, http.StatusForbidden, ErrAdminUserDisabled)
+	}
+
+	// 2要素認証が有効な場合はセッションを発行せず、コードの検証を求める
+	// 失敗回数はコードの検証が済むまで消さない
+	if user.TOTPEnabledAt != nil {
+		challenge, err := h.createAdminLoginChallenge(tx, user.ID, requestAt)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+
+		return successResponse(c, &AdminLoginResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge,
+		})
+	}
+
+	if err = resetAdminLoginFailures(tx, user.ID); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	query = "UPDATE admin_sessions SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
-	if _, err = tx.Exec(query, requestAt, req.UserID); err != nil {
+	sess, err := h.createAdminSession(tx, user.ID, requestAt)
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	sID, err := h.generateID()
+	err = tx.Commit()
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+
+	return successResponse(c, &AdminLoginResponse{
+		AdminSession: sess,
+	})
+}
+
+// createAdminSession 管理者の既存のセッションを無効にして新しいセッションを発行する
+func (h *Handler) createAdminSession(tx *sqlx.Tx, adminUserID, requestAt int64) (*Session, error) {
+	query := "UPDATE admin_users SET last_activated_at=?, updated_at=? WHERE id=?"
+	if _, err := tx.Exec(query, requestAt, requestAt, adminUserID); err != nil {
+		return nil, err
+	}
+
+	query = "UPDATE admin_sessions SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
+	if _, err := tx.Exec(query, requestAt, adminUserID); err != nil {
+		return nil, err
+	}
+
+	sID, err := h.generateID()
+	if err != nil {
+		return nil, err
+	}
 	sessID, err := generateUUID()
 	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+		return nil, err
 	}
 	sess := &Session{
 		ID:        sID,
-		UserID:    req.UserID,
+		UserID:    adminUserID,
 		SessionID: sessID,
 		CreatedAt: requestAt,
 		UpdatedAt: requestAt,
@@ -111,17 +196,9 @@ func (h *Handler) adminLogin(c echo.Context) error {
 
 	query = "INSERT INTO admin_sessions(id, user_id, session_id, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?)"
 	if _, err = tx.Exec(query, sess.ID, sess.UserID, sess.SessionID, sess.CreatedAt, sess.UpdatedAt, sess.ExpiredAt); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+		return nil, err
 	}
-
-	return successResponse(c, &AdminLoginResponse{
-		AdminSession: sess,
-	})
+	return sess, nil
 }
 
 type AdminLoginRequest struct {
@@ -130,7 +207,9 @@ type AdminLoginRequest struct {
 }
 
 type AdminLoginResponse struct {
-	AdminSession *Session `json:"session"`
+	AdminSession      *Session `json:"session"`
+	TwoFactorRequired bool     `json:"twoFactorRequired,omitempty"`
+	ChallengeToken    string   `json:"challengeToken,omitempty"` // POST /admin/login/2faで利用する
 }
 
 // adminLogout 管理者権限ログアウト
@@ -191,6 +270,11 @@ func (h *Handler) adminListMaster(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
+	rewardBoosts := make([]*RewardBoostMaster, 0)
+	if err := h.DB.Select(&rewardBoosts, "SELECT * FROM reward_boost_masters"); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
 	return successResponse(c, &AdminListMasterResponse{
 		VersionMaster:     masterVersions,
 		Items:             items,
@@ -199,6 +283,7 @@ func (h *Handler) adminListMaster(c echo.Context) error {
 		PresentAlls:       presentAlls,
 		LoginBonuses:      loginBonuses,
 		LoginBonusRewards: loginBonusRewards,
+		RewardBoosts:      rewardBoosts,
 	})
 }
 
@@ -210,269 +295,85 @@ type AdminListMasterResponse struct {
 	PresentAlls       []*PresentAllMaster       `json:"presentAlls"`
 	LoginBonusRewards []*LoginBonusRewardMaster `json:"loginBonusRewards"`
 	LoginBonuses      []*LoginBonusMaster       `json:"loginBonuses"`
+	RewardBoosts      []*RewardBoostMaster      `json:"rewardBoosts"`
 }
 
 // adminUpdateMaster マスタデータ更新
 // PUT /admin/master
+// dryRun=trueの場合はトランザクションをロールバックして差分のみを返す
 func (h *Handler) adminUpdateMaster(c echo.Context) error {
-	tx, err := h.DB.Beginx()
+	adminUserID, err := getAdminUserID(c)
 	if err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+		return errorResponse(c, http.StatusUnauthorized, err)
 	}
-	defer tx.Rollback() //nolint:errcheck
 
-	// version master
-	versionMasterRecs, err := readFormFileToCSV(c, "versionMaster")
+	requestAt, err := getRequestTime(c)
 	if err != nil {
-		if err != ErrNoFormFile {
-			return errorResponse(c, http.StatusBadRequest, err)
-		}
-	}
-	if versionMasterRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range versionMasterRecs {
-			if i == 0 {
-				continue
-			}
-			data = append(data, map[string]interface{}{
-				"id":             v[0],
-				"status":         v[1],
-				"master_version": v[2],
-			})
-		}
-
-		query := "INSERT INTO version_masters(id, status, master_version) VALUES (:id, :status, :master_version) ON DUPLICATE KEY UPDATE status=VALUES(status), master_version=VALUES(master_version)"
-		if _, err = tx.NamedExec(query, data); err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-	} else {
-		c.Logger().Debug("Skip Update Master: versionMaster")
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	// item
-	itemMasterRecs, err := readFormFileToCSV(c, "itemMaster")
+	uploads, verrs, err := readMasterUploads(c)
 	if err != nil {
-		if err != ErrNoFormFile {
-			return errorResponse(c, http.StatusBadRequest, err)
-		}
+		return errorResponse(c, http.StatusBadRequest, err)
 	}
-	if itemMasterRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range itemMasterRecs {
-			if i == 0 {
-				continue
-			}
-			data = append(data, map[string]interface{}{
-				"id":                 v[0],
-				"item_type":          v[1],
-				"name":               v[2],
-				"description":        v[3],
-				"amount_per_sec":     v[4],
-				"max_level":          v[5],
-				"max_amount_per_sec": v[6],
-				"base_exp_per_level": v[7],
-				"gained_exp":         v[8],
-				"shortening_min":     v[9],
-			})
-		}
-
-		query := strings.Join([]string{
-			"INSERT INTO item_masters(id, item_type, name, description, amount_per_sec, max_level, max_amount_per_sec, base_exp_per_level, gained_exp, shortening_min)",
-			"VALUES (:id, :item_type, :name, :description, :amount_per_sec, :max_level, :max_amount_per_sec, :base_exp_per_level, :gained_exp, :shortening_min)",
-			"ON DUPLICATE KEY UPDATE item_type=VALUES(item_type), name=VALUES(name), description=VALUES(description), amount_per_sec=VALUES(amount_per_sec), max_level=VALUES(max_level), max_amount_per_sec=VALUES(max_amount_per_sec), base_exp_per_level=VALUES(base_exp_per_level), gained_exp=VALUES(gained_exp), shortening_min=VALUES(shortening_min)",
-		}, " ")
-		if _, err = tx.NamedExec(query, data); err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-	} else {
-		c.Logger().Debug("Skip Update Master: itemMaster")
+	if len(verrs) > 0 {
+		return masterValidationErrorResponse(c, verrs)
 	}
 
-	// gacha
-	gachaRecs, err := readFormFileToCSV(c, "gachaMaster")
+	tx, err := h.DB.Beginx()
 	if err != nil {
-		if err != ErrNoFormFile {
-			return errorResponse(c, http.StatusBadRequest, err)
-		}
-	}
-	if gachaRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range gachaRecs {
-			if i == 0 {
-				continue
-			}
-			data = append(data, map[string]interface{}{
-				"id":            v[0],
-				"name":          v[1],
-				"start_at":      v[2],
-				"end_at":        v[3],
-				"display_order": v[4],
-				"created_at":    v[5],
-			})
-		}
-
-		query := strings.Join([]string{
-			"INSERT INTO gacha_masters(id, name, start_at, end_at, display_order, created_at)",
-			"VALUES (:id, :name, :start_at, :end_at, :display_order, :created_at)",
-			"ON DUPLICATE KEY UPDATE name=VALUES(name), start_at=VALUES(start_at), end_at=VALUES(end_at), display_order=VALUES(display_order), created_at=VALUES(created_at)",
-		}, " ")
-		if _, err = tx.NamedExec(query, data); err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-	} else {
-		c.Logger().Debug("Skip Update Master: gachaMaster")
+		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	defer tx.Rollback() //nolint:errcheck
 
-	// gacha item
-	gachaItemRecs, err := readFormFileToCSV(c, "gachaItemMaster")
+	verrs, err = validateMasterReferences(tx, uploads)
 	if err != nil {
-		if err != ErrNoFormFile {
-			return errorResponse(c, http.StatusBadRequest, err)
-		}
+		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	if gachaItemRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range gachaItemRecs {
-			if i == 0 {
-				continue
-			}
-			data = append(data, map[string]interface{}{
-				"id":         v[0],
-				"gacha_id":   v[1],
-				"item_type":  v[2],
-				"item_id":    v[3],
-				"amount":     v[4],
-				"weight":     v[5],
-				"created_at": v[6],
-			})
-		}
-
-		query := strings.Join([]string{
-			"INSERT INTO gacha_item_masters(id, gacha_id, item_type, item_id, amount, weight, created_at)",
-			"VALUES (:id, :gacha_id, :item_type, :item_id, :amount, :weight, :created_at)",
-			"ON DUPLICATE KEY UPDATE gacha_id=VALUES(gacha_id), item_type=VALUES(item_type), item_id=VALUES(item_id), amount=VALUES(amount), weight=VALUES(weight), created_at=VALUES(created_at)",
-		}, " ")
-		if _, err = tx.NamedExec(query, data); err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-	} else {
-		c.Logger().Debug("Skip Update Master: gachaItemMaster")
+	if len(verrs) > 0 {
+		return masterValidationErrorResponse(c, verrs)
 	}
 
-	// present all
-	presentAllRecs, err := readFormFileToCSV(c, "presentAllMaster")
-	if err != nil {
-		if err != ErrNoFormFile {
-			return errorResponse(c, http.StatusBadRequest, err)
-		}
-	}
-	if presentAllRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range presentAllRecs {
-			if i == 0 {
-				continue
-			}
-			data = append(data, map[string]interface{}{
-				"id":                  v[0],
-				"registered_start_at": v[1],
-				"registered_end_at":   v[2],
-				"item_type":           v[3],
-				"item_id":             v[4],
-				"amount":              v[5],
-				"present_message":     v[6],
-				"created_at":          v[7],
-			})
-		}
-
-		query := strings.Join([]string{
-			"INSERT INTO present_all_masters(id, registered_start_at, registered_end_at, item_type, item_id, amount, present_message, created_at)",
-			"VALUES (:id, :registered_start_at, :registered_end_at, :item_type, :item_id, :amount, :present_message, :created_at)",
-			"ON DUPLICATE KEY UPDATE registered_start_at=VALUES(registered_start_at), registered_end_at=VALUES(registered_end_at), item_type=VALUES(item_type), item_id=VALUES(item_id), amount=VALUES(amount), present_message=VALUES(present_message), created_at=VALUES(created_at)",
-		}, " ")
-		if _, err = tx.NamedExec(query, data); err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-	} else {
-		c.Logger().Debug("Skip Update Master: presentAllMaster")
+	// 最初の更新の場合は、取り消せるように更新前のマスタを保存しておく
+	if err = h.takeInitialMasterSnapshot(tx, adminUserID, requestAt); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	// login bonuses
-	loginBonusRecs, err := readFormFileToCSV(c, "loginBonusMaster")
-	if err != nil {
-		if err != ErrNoFormFile {
-			return errorResponse(c, http.StatusBadRequest, err)
+	dryRun := c.QueryParam("dryRun") == "true"
+	diffs := make([]*MasterTableDiff, 0)
+	for _, t := range masterTables {
+		upload, ok := uploads[t.Name]
+		if !ok {
+			c.Logger().Debug("Skip Update Master: " + t.Name)
+			continue
 		}
-	}
-	if loginBonusRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range loginBonusRecs {
-			if i == 0 {
-				continue
-			}
-			looped := 0
-			if v[4] == "TRUE" {
-				looped = 1
+		if dryRun {
+			diff, err := diffMaster(tx, upload)
+			if err != nil {
+				return errorResponse(c, http.StatusInternalServerError, err)
 			}
-			data = append(data, map[string]interface{}{
-				"id":           v[0],
-				"start_at":     v[1],
-				"end_at":       v[2],
-				"column_count": v[3],
-				"looped":       looped,
-				"created_at":   v[5],
-			})
+			diffs = append(diffs, diff)
 		}
-
-		query := strings.Join([]string{
-			"INSERT INTO login_bonus_masters(id, start_at, end_at, column_count, looped, created_at)",
-			"VALUES (:id, :start_at, :end_at, :column_count, :looped, :created_at)",
-			"ON DUPLICATE KEY UPDATE start_at=VALUES(start_at), end_at=VALUES(end_at), column_count=VALUES(column_count), looped=VALUES(looped), created_at=VALUES(created_at)",
-		}, " ")
-		if _, err = tx.NamedExec(query, data); err != nil {
+		if err = upsertMaster(tx, upload); err != nil {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
-	} else {
-		c.Logger().Debug("Skip Update Master: loginBonusMaster")
 	}
 
-	// login bonus rewards
-	loginBonusRewardRecs, err := readFormFileToCSV(c, "loginBonusRewardMaster")
-	if err != nil {
-		if err != ErrNoFormFile {
-			return errorResponse(c, http.StatusBadRequest, err)
-		}
+	activeMaster := new(VersionMaster)
+	if err = tx.Get(activeMaster, "SELECT * FROM version_masters WHERE status=1"); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	if loginBonusRewardRecs != nil {
-		data := []map[string]interface{}{}
-		for i, v := range loginBonusRewardRecs {
-			if i == 0 {
-				continue
-			}
-			data = append(data, map[string]interface{}{
-				"id":              v[0],
-				"login_bonus_id":  v[1],
-				"reward_sequence": v[2],
-				"item_type":       v[3],
-				"item_id":         v[4],
-				"amount":          v[5],
-				"created_at":      v[6],
-			})
-		}
 
-		query := strings.Join([]string{
-			"INSERT INTO login_bonus_reward_masters(id, login_bonus_id, reward_sequence, item_type, item_id, amount, created_at)",
-			"VALUES (:id, :login_bonus_id, :reward_sequence, :item_type, :item_id, :amount, :created_at)",
-			"ON DUPLICATE KEY UPDATE login_bonus_id=VALUES(login_bonus_id), reward_sequence=VALUES(reward_sequence), item_type=VALUES(item_type), item_id=VALUES(item_id), amount=VALUES(amount), created_at=VALUES(created_at)",
-		}, " ")
-		if _, err = tx.NamedExec(query, data); err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-	} else {
-		c.Logger().Debug("Skip Update Master: loginBonusRewardMaster")
+	// dry runの場合は反映せずに差分だけを返す
+	if dryRun {
+		return successResponse(c, &AdminUpdateMasterDryRunResponse{
+			VersionMaster: activeMaster,
+			Tables:        diffs,
+		})
 	}
 
-	activeMaster := new(VersionMaster)
-	if err = tx.Get(activeMaster, "SELECT * FROM version_masters WHERE status=1"); err != nil {
+	// ロールバックできるように更新後のマスタを保存する
+	if _, err = h.takeMasterSnapshot(tx, adminUserID, MasterSnapshotActionUpdate, requestAt); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -480,6 +381,7 @@ func (h *Handler) adminUpdateMaster(c echo.Context) error {
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	h.reloadMasterCache(c.Logger())
 
 	return successResponse(c, &AdminUpdateMasterResponse{
 		VersionMaster: activeMaster,
@@ -490,6 +392,11 @@ type AdminUpdateMasterResponse struct {
 	VersionMaster *VersionMaster `json:"versionMaster"`
 }
 
+type AdminUpdateMasterDryRunResponse struct {
+	VersionMaster *VersionMaster     `json:"versionMaster"`
+	Tables        []*MasterTableDiff `json:"tables"`
+}
+
 // readFromFileToCSV ファイルからcsvレコードを取得する
 func readFormFileToCSV(c echo.Context, name string) ([][]string, error) {
 	file, err := c.FormFile(name)
@@ -509,6 +416,8 @@ func readFormFileToCSV(c echo.Context, name string) ([][]string, error) {
 	}
 
 	csvReader := csv.NewReader(bytes.NewReader(buf.Bytes()))
+	// 列数の不一致は行ごとの検証エラーとして報告する
+	csvReader.FieldsPerRecord = -1
 	records, err := csvReader.ReadAll()
 	if err != nil {
 		return nil, err
@@ -525,58 +434,80 @@ func (h *Handler) adminUser(c echo.Context) error {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
 
-	query := "SELECT * FROM users WHERE id=?"
-	user := new(User)
-	if err = h.DB.Get(user, query, userID); err != nil {
+	res, err := h.getAdminUserData(userID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
+	return successResponse(c, res)
+}
+
+// getAdminUserData ユーザに紐づくデータをまとめて取得する。ユーザが存在しない場合はsql.ErrNoRowsを返す
+func (h *Handler) getAdminUserData(userID int64) (*AdminUserResponse, error) {
+	query := "SELECT * FROM users WHERE id=?"
+	user := new(User)
+	if err := h.DB.Get(user, query, userID); err != nil {
+		return nil, err
+	}
+
 	query = "SELECT * FROM user_devices WHERE user_id=?"
 	devices := make([]*UserDevice, 0)
-	if err = h.DB.Select(&devices, query, userID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	if err := h.DB.Select(&devices, query, userID); err != nil {
+		return nil, err
 	}
 
 	query = "SELECT * FROM user_cards WHERE user_id=?"
 	cards := make([]*UserCard, 0)
-	if err = h.DB.Select(&cards, query, userID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	if err := h.DB.Select(&cards, query, userID); err != nil {
+		return nil, err
 	}
 
 	query = "SELECT * FROM user_decks WHERE user_id=?"
 	decks := make([]*UserDeck, 0)
-	if err = h.DB.Select(&decks, query, userID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	if err := h.DB.Select(&decks, query, userID); err != nil {
+		return nil, err
 	}
 
 	query = "SELECT * FROM user_items WHERE user_id=?"
 	items := make([]*UserItem, 0)
-	if err = h.DB.Select(&items, query, userID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	if err := h.DB.Select(&items, query, userID); err != nil {
+		return nil, err
 	}
 
 	query = "SELECT * FROM user_login_bonuses WHERE user_id=?"
 	loginBonuses := make([]*UserLoginBonus, 0)
-	if err = h.DB.Select(&loginBonuses, query, userID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	if err := h.DB.Select(&loginBonuses, query, userID); err != nil {
+		return nil, err
 	}
 
 	query = "SELECT * FROM user_presents WHERE user_id=?"
 	presents := make([]*UserPresent, 0)
-	if err = h.DB.Select(&presents, query, userID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	if err := h.DB.Select(&presents, query, userID); err != nil {
+		return nil, err
 	}
 
 	query = "SELECT * FROM user_present_all_received_history WHERE user_id=?"
 	presentHistory := make([]*UserPresentAllReceivedHistory, 0)
-	if err = h.DB.Select(&presentHistory, query, userID); err != nil {
-		return errorResponse(c, http.StatusInternalServerError, err)
+	if err := h.DB.Select(&presentHistory, query, userID); err != nil {
+		return nil, err
 	}
 
-	return successResponse(c, &AdminUserResponse{
+	query = "SELECT * FROM user_bans WHERE user_id=? ORDER BY created_at DESC, id DESC"
+	bans := make([]*UserBan, 0)
+	if err := h.DB.Select(&bans, query, userID); err != nil {
+		return nil, err
+	}
+
+	query = "SELECT * FROM admin_action_logs WHERE user_id=? ORDER BY created_at DESC, id DESC"
+	actionLogs := make([]*AdminActionLog, 0)
+	if err := h.DB.Select(&actionLogs, query, userID); err != nil {
+		return nil, err
+	}
+
+	return &AdminUserResponse{
 		User:                          user,
 		UserDevices:                   devices,
 		UserCards:                     cards,
@@ -585,7 +516,9 @@ func (h *Handler) adminUser(c echo.Context) error {
 		UserLoginBonuses:              loginBonuses,
 		UserPresents:                  presents,
 		UserPresentAllReceivedHistory: presentHistory,
-	})
+		UserBans:                      bans,
+		AdminActionLogs:               actionLogs,
+	}, nil
 }
 
 type AdminUserResponse struct {
@@ -598,6 +531,201 @@ type AdminUserResponse struct {
 	UserLoginBonuses              []*UserLoginBonus                `json:"userLoginBonuses"`
 	UserPresents                  []*UserPresent                   `json:"userPresents"`
 	UserPresentAllReceivedHistory []*UserPresentAllReceivedHistory `json:"userPresentAllReceivedHistory"`
+	UserBans                      []*UserBan                       `json:"userBans"`
+	AdminActionLogs               []*AdminActionLog                `json:"adminActionLogs"`
+}
+
+// adminSearchUsers ユーザの検索
+// GET /admin/users
+func (h *Handler) adminSearchUsers(c echo.Context) error {
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	// 有効なBANが存在するか
+	banExists := "EXISTS(SELECT 1 FROM user_bans AS ub WHERE ub.user_id = u.id AND ub.deleted_at IS NULL AND (ub.expired_at IS NULL OR ub.expired_at > ?))"
+
+	conditions := make([]string, 0)
+	params := make([]interface{}, 0)
+
+	if viewerID := c.QueryParam("viewerId"); viewerID != "" {
+		conditions = append(conditions, "EXISTS(SELECT 1 FROM user_devices AS ud WHERE ud.user_id = u.id AND ud.platform_id = ?)")
+		params = append(params, viewerID)
+	}
+	platformType, err := parseQueryInt(c, "platformType")
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if platformType != nil {
+		conditions = append(conditions, "EXISTS(SELECT 1 FROM user_devices AS ud WHERE ud.user_id = u.id AND ud.platform_type = ?)")
+		params = append(params, *platformType)
+	}
+
+	ranges := []struct {
+		param  string
+		column string
+		op     string
+	}{
+		{"registeredFrom", "u.registered_at", ">="},
+		{"registeredTo", "u.registered_at", "<="},
+		{"activatedFrom", "u.last_activated_at", ">="},
+		{"activatedTo", "u.last_activated_at", "<="},
+		{"coinMin", "u.isu_coin", ">="},
+		{"coinMax", "u.isu_coin", "<="},
+	}
+	for _, r := range ranges {
+		v, err := parseQueryInt(c, r.param)
+		if err != nil {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		if v != nil {
+			conditions = append(conditions, fmt.Sprintf("%s %s ?", r.column, r.op))
+			params = append(params, *v)
+		}
+	}
+
+	switch c.QueryParam("banned") {
+	case "":
+	case "true":
+		conditions = append(conditions, banExists)
+		params = append(params, requestAt)
+	case "false":
+		conditions = append(conditions, "NOT "+banExists)
+		params = append(params, requestAt)
+	default:
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid banned parameter"))
+	}
+
+	// 並び順
+	sortColumns := map[string]string{
+		"id":              "u.id",
+		"registeredAt":    "u.registered_at",
+		"lastActivatedAt": "u.last_activated_at",
+		"isuCoin":         "u.isu_coin",
+	}
+	sortKey := c.QueryParam("sort")
+	if sortKey == "" {
+		sortKey = "id"
+	}
+	sortColumn, ok := sortColumns[sortKey]
+	if !ok {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid sort parameter"))
+	}
+	order, cmp := "ASC", ">"
+	switch c.QueryParam("order") {
+	case "", "asc":
+	case "desc":
+		order, cmp = "DESC", "<"
+	default:
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid order parameter"))
+	}
+
+	limit := AdminUserSearchDefaultLimit
+	if v, err := parseQueryInt(c, "limit"); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	} else if v != nil {
+		if *v < 1 || *v > AdminUserSearchMaxLimit {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("limit should be between 1 and %d", AdminUserSearchMaxLimit))
+		}
+		limit = int(*v)
+	}
+
+	// 前のページの最後の行より後ろから取得する
+	if v := c.QueryParam("cursor"); v != "" {
+		cursor, err := decodeAdminUserCursor(v)
+		if err != nil {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s %s ? OR (%s = ? AND u.id %s ?))", sortColumn, cmp, sortColumn, cmp))
+		params = append(params, cursor.Value, cursor.Value, cursor.ID)
+	}
+
+	query := "SELECT u.id, u.isu_coin, u.registered_at, u.last_activated_at, " + banExists + " AS banned FROM users AS u"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, u.id %s LIMIT ?", sortColumn, order, order)
+	params = append([]interface{}{requestAt}, params...)
+	params = append(params, limit+1)
+
+	users := make([]*AdminUserSummary, 0, limit+1)
+	if err = h.DB.Select(&users, query, params...); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	nextCursor := ""
+	if len(users) > limit {
+		users = users[:limit]
+		nextCursor = encodeAdminUserCursor(users[limit-1], sortKey)
+	}
+
+	return successResponse(c, &AdminSearchUsersResponse{
+		Users:      users,
+		NextCursor: nextCursor,
+	})
+}
+
+type AdminSearchUsersResponse struct {
+	Users      []*AdminUserSummary `json:"users"`
+	NextCursor string              `json:"nextCursor"` // 次のページがない場合は空文字
+}
+
+type AdminUserSummary struct {
+	ID              int64 `json:"id" db:"id"`
+	IsuCoin         int64 `json:"isuCoin" db:"isu_coin"`
+	RegisteredAt    int64 `json:"registeredAt" db:"registered_at"`
+	LastActivatedAt int64 `json:"lastActivatedAt" db:"last_activated_at"`
+	Banned          bool  `json:"banned" db:"banned"`
+}
+
+// adminUserCursor ユーザ検索のページング位置
+type adminUserCursor struct {
+	Value int64 `json:"v"`
+	ID    int64 `json:"id"`
+}
+
+// encodeAdminUserCursor 並び順のキーとIDからカーソルを作成する
+func encodeAdminUserCursor(u *AdminUserSummary, sortKey string) string {
+	cursor := adminUserCursor{ID: u.ID}
+	switch sortKey {
+	case "registeredAt":
+		cursor.Value = u.RegisteredAt
+	case "lastActivatedAt":
+		cursor.Value = u.LastActivatedAt
+	case "isuCoin":
+		cursor.Value = u.IsuCoin
+	default:
+		cursor.Value = u.ID
+	}
+	buf, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// decodeAdminUserCursor カーソルを復元する
+func decodeAdminUserCursor(v string) (*adminUserCursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	cursor := new(adminUserCursor)
+	if err = json.Unmarshal(buf, cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// parseQueryInt クエリパラメータを整数として取得する。指定がない場合はnilを返す
+func parseQueryInt(c echo.Context, name string) (*int64, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return nil, nil
+	}
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s parameter", name)
+	}
+	return &i, nil
 }
 
 // adminBanUser ユーザBAN処理
@@ -613,6 +741,23 @@ func (h *Handler) adminBanUser(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
+	adminUserID, err := getAdminUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	// 理由、期限の指定は任意
+	defer c.Request().Body.Close()
+	req := new(AdminBanUserRequest)
+	if c.Request().ContentLength != 0 {
+		if err = parseRequestBody(c, req); err != nil {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+	}
+	if req.ExpiredAt != nil && *req.ExpiredAt <= requestAt {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("expiredAt must be in the future"))
+	}
+
 	query := "SELECT * FROM users WHERE id=?"
 	user := new(User)
 	if err = h.DB.Get(user, query, userID); err != nil {
@@ -622,26 +767,102 @@ func (h *Handler) adminBanUser(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 有効なBANは新しいBANで置き換える
+	query = "UPDATE user_bans SET deleted_at=?, updated_at=? WHERE user_id=? AND deleted_at IS NULL"
+	if _, err = tx.Exec(query, requestAt, requestAt, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
 	banID, err := h.generateID()
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	query = "INSERT user_bans(id, user_id, created_at, updated_at) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE updated_at = ?"
-	if _, err = h.DB.Exec(query, banID, userID, requestAt, requestAt, requestAt); err != nil {
+	ban := &UserBan{
+		ID:        banID,
+		UserID:    userID,
+		Reason:    req.Reason,
+		AdminID:   &adminUserID,
+		ExpiredAt: req.ExpiredAt,
+		CreatedAt: requestAt,
+		UpdatedAt: requestAt,
+	}
+	query = "INSERT INTO user_bans(id, user_id, reason, admin_id, expired_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	if _, err = tx.Exec(query, ban.ID, ban.UserID, ban.Reason, ban.AdminID, ban.ExpiredAt, ban.CreatedAt, ban.UpdatedAt); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	return successResponse(c, &AdminBanUserResponse{
 		User: user,
+		Ban:  ban,
 	})
 }
 
+type AdminBanUserRequest struct {
+	Reason    string `json:"reason"`
+	ExpiredAt *int64 `json:"expiredAt"` // 省略した場合は無期限
+}
+
 type AdminBanUserResponse struct {
+	User *User    `json:"user"`
+	Ban  *UserBan `json:"ban"`
+}
+
+// adminUnbanUser ユーザBAN解除処理
+// POST /admin/user/{userId}/unban
+func (h *Handler) adminUnbanUser(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	query := "SELECT * FROM users WHERE id=?"
+	user := new(User)
+	if err = h.DB.Get(user, query, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusBadRequest, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	query = "UPDATE user_bans SET deleted_at=?, updated_at=? WHERE user_id=? AND deleted_at IS NULL"
+	res, err := h.DB.Exec(query, requestAt, requestAt, userID)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if affected == 0 {
+		return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found active ban"))
+	}
+
+	return successResponse(c, &AdminUnbanUserResponse{
+		User: user,
+	})
+}
+
+type AdminUnbanUserResponse struct {
 	User *User `json:"user"`
 }
 
 // hashPassword パスワードをハッシュ化する
-//nolint:deadcode,unused
 func hashPassword(pw string) (string, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(pw), bcrypt.DefaultCost)
 	if err != nil {
@@ -659,10 +880,16 @@ func verifyPassword(hash, pw string) error {
 }
 
 type AdminUser struct {
-	ID              int64  `db:"id"`
-	Password        string `db:"password"`
-	LastActivatedAt int64  `db:"last_activated_at"`
-	CreatedAt       int64  `db:"created_at"`
-	UpdatedAt       int64  `db:"updated_at"`
-	DeletedAt       *int64 `db:"deleted_at"`
+	ID              int64     `json:"id" db:"id"`
+	Password        string    `json:"-" db:"password"`
+	Role            AdminRole `json:"role" db:"role"`
+	LastActivatedAt int64     `json:"lastActivatedAt" db:"last_activated_at"`
+	DisabledAt      *int64    `json:"disabledAt" db:"disabled_at"`
+	LockedAt        *int64    `json:"lockedAt" db:"locked_at"`
+	TOTPSecret      *string   `json:"-" db:"totp_secret"`
+	TOTPEnabledAt   *int64    `json:"totpEnabledAt" db:"totp_enabled_at"`
+	TOTPLastStep    int64     `json:"-" db:"totp_last_step"`
+	CreatedAt       int64     `json:"createdAt" db:"created_at"`
+	UpdatedAt       int64     `json:"updatedAt" db:"updated_at"`
+	DeletedAt       *int64    `json:"deletedAt" db:"deleted_at"`
 }
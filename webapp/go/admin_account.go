@@ -0,0 +1,347 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	ErrAdminUserDisabled    error = fmt.Errorf("admin user is disabled")
+	ErrAdminUserNotFound    error = fmt.Errorf("not found admin user")
+	ErrInvalidAdminRole     error = fmt.Errorf("invalid admin role")
+	ErrCannotModifySelf     error = fmt.Errorf("cannot disable or delete own account")
+	ErrPasswordTooShort     error = fmt.Errorf("password must be at least %d characters", AdminPasswordMinLength)
+	ErrPasswordTooLong      error = fmt.Errorf("password must be at most %d bytes", AdminPasswordMaxLength)
+	ErrPasswordTooWeak      error = fmt.Errorf("password must contain both letters and digits")
+	ErrPasswordNotChanged   error = fmt.Errorf("new password must be different from the current one")
+	ErrInvalidAdminPassword error = fmt.Errorf("invalid password")
+)
+
+const (
+	AdminPasswordMinLength int = 12
+	AdminPasswordMaxLength int = 72 // bcryptで扱える最大長
+)
+
+// parseAdminRole 設定値からロールを取得する
+func parseAdminRole(v string) (AdminRole, error) {
+	switch r := AdminRole(v); r {
+	case AdminRoleViewer, AdminRoleSupport, AdminRolePlanner, AdminRoleSuperadmin:
+		return r, nil
+	}
+	return "", ErrInvalidAdminRole
+}
+
+// validateAdminPassword パスワードポリシーを満たしているかを確認する
+func validateAdminPassword(pw string) error {
+	if len([]rune(pw)) < AdminPasswordMinLength {
+		return ErrPasswordTooShort
+	}
+	if len(pw) > AdminPasswordMaxLength {
+		return ErrPasswordTooLong
+	}
+	var hasLetter, hasDigit bool
+	for _, r := range pw {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return ErrPasswordTooWeak
+	}
+	return nil
+}
+
+// adminListAdminUsers 管理者の一覧
+// GET /admin/admins
+func (h *Handler) adminListAdminUsers(c echo.Context) error {
+	admins := make([]*AdminUser, 0)
+	query := "SELECT * FROM admin_users WHERE deleted_at IS NULL ORDER BY id"
+	if err := h.DB.Select(&admins, query); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminListAdminUsersResponse{
+		AdminUsers: admins,
+	})
+}
+
+type AdminListAdminUsersResponse struct {
+	AdminUsers []*AdminUser `json:"adminUsers"`
+}
+
+// adminCreateAdminUser 管理者の作成
+// POST /admin/admins
+func (h *Handler) adminCreateAdminUser(c echo.Context) error {
+	defer c.Request().Body.Close()
+	req := new(AdminCreateAdminUserRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	role, err := parseAdminRole(req.Role)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if err = validateAdminPassword(req.Password); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	adminID, err := h.generateID()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	admin := &AdminUser{
+		ID:              adminID,
+		Password:        hash,
+		Role:            role,
+		LastActivatedAt: 0, // 一度もログインしていない
+		CreatedAt:       requestAt,
+		UpdatedAt:       requestAt,
+	}
+	query := "INSERT INTO admin_users(id, password, role, last_activated_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)"
+	if _, err = h.DB.Exec(query, admin.ID, admin.Password, admin.Role, admin.LastActivatedAt, admin.CreatedAt, admin.UpdatedAt); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminUserAccountResponse{
+		AdminUser: admin,
+	})
+}
+
+type AdminCreateAdminUserRequest struct {
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+type AdminUserAccountResponse struct {
+	AdminUser *AdminUser `json:"adminUser"`
+}
+
+// adminDisableAdminUser 管理者の無効化
+// POST /admin/admins/{adminID}/disable
+func (h *Handler) adminDisableAdminUser(c echo.Context) error {
+	return h.updateAdminUserAccount(c, true, func(tx *sqlx.Tx, admin *AdminUser, requestAt int64) error {
+		if admin.DisabledAt == nil {
+			admin.DisabledAt = &requestAt
+		}
+		admin.UpdatedAt = requestAt
+		query := "UPDATE admin_users SET disabled_at=?, updated_at=? WHERE id=?"
+		if _, err := tx.Exec(query, admin.DisabledAt, admin.UpdatedAt, admin.ID); err != nil {
+			return err
+		}
+		return revokeAdminSessions(tx, admin.ID, requestAt)
+	})
+}
+
+// adminEnableAdminUser 無効化した管理者の再有効化
+// POST /admin/admins/{adminID}/enable
+func (h *Handler) adminEnableAdminUser(c echo.Context) error {
+	return h.updateAdminUserAccount(c, false, func(tx *sqlx.Tx, admin *AdminUser, requestAt int64) error {
+		admin.DisabledAt = nil
+		admin.UpdatedAt = requestAt
+		query := "UPDATE admin_users SET disabled_at=NULL, updated_at=? WHERE id=?"
+		_, err := tx.Exec(query, admin.UpdatedAt, admin.ID)
+		return err
+	})
+}
+
+// adminDeleteAdminUser 管理者の削除
+// DELETE /admin/admins/{adminID}
+func (h *Handler) adminDeleteAdminUser(c echo.Context) error {
+	return h.updateAdminUserAccount(c, true, func(tx *sqlx.Tx, admin *AdminUser, requestAt int64) error {
+		admin.UpdatedAt = requestAt
+		admin.DeletedAt = &requestAt
+		query := "UPDATE admin_users SET updated_at=?, deleted_at=? WHERE id=?"
+		if _, err := tx.Exec(query, admin.UpdatedAt, admin.DeletedAt, admin.ID); err != nil {
+			return err
+		}
+		return revokeAdminSessions(tx, admin.ID, requestAt)
+	})
+}
+
+// adminResetAdminUserPassword 管理者のパスワードの再設定。ログイン失敗によるロックも解除する
+// POST /admin/admins/{adminID}/password
+func (h *Handler) adminResetAdminUserPassword(c echo.Context) error {
+	defer c.Request().Body.Close()
+	req := new(AdminResetPasswordRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if err := validateAdminPassword(req.Password); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return h.updateAdminUserAccount(c, false, func(tx *sqlx.Tx, admin *AdminUser, requestAt int64) error {
+		admin.Password = hash
+		admin.LockedAt = nil
+		admin.UpdatedAt = requestAt
+		query := "UPDATE admin_users SET password=?, locked_at=NULL, updated_at=? WHERE id=?"
+		if _, err := tx.Exec(query, admin.Password, admin.UpdatedAt, admin.ID); err != nil {
+			return err
+		}
+		if err := clearAdminLoginFailures(tx, admin.ID); err != nil {
+			return err
+		}
+		return revokeAdminSessions(tx, admin.ID, requestAt)
+	})
+}
+
+type AdminResetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// updateAdminUserAccount パスパラメータで指定した管理者を更新する
+// forbidSelfがtrueの場合は自分自身を対象にできない
+func (h *Handler) updateAdminUserAccount(c echo.Context, forbidSelf bool, update func(tx *sqlx.Tx, admin *AdminUser, requestAt int64) error) error {
+	targetID, err := strconv.ParseInt(c.Param("adminID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid adminID parameter"))
+	}
+
+	adminUserID, err := getAdminUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusUnauthorized, err)
+	}
+	if forbidSelf && targetID == adminUserID {
+		return errorResponse(c, http.StatusBadRequest, ErrCannotModifySelf)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	admin := new(AdminUser)
+	query := "SELECT * FROM admin_users WHERE id=? AND deleted_at IS NULL FOR UPDATE"
+	if err = tx.Get(admin, query, targetID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrAdminUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = update(tx, admin, requestAt); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminUserAccountResponse{
+		AdminUser: admin,
+	})
+}
+
+// adminChangePassword ログイン中の管理者自身のパスワード変更
+// PUT /admin/password
+func (h *Handler) adminChangePassword(c echo.Context) error {
+	defer c.Request().Body.Close()
+	req := new(AdminChangePasswordRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	adminUserID, err := getAdminUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	if err = validateAdminPassword(req.NewPassword); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.NewPassword == req.OldPassword {
+		return errorResponse(c, http.StatusBadRequest, ErrPasswordNotChanged)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	admin := new(AdminUser)
+	query := "SELECT * FROM admin_users WHERE id=? AND deleted_at IS NULL FOR UPDATE"
+	if err = tx.Get(admin, query, adminUserID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusUnauthorized, ErrUnauthorized)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = verifyPassword(admin.Password, req.OldPassword); err != nil {
+		return errorResponse(c, http.StatusUnauthorized, ErrInvalidAdminPassword)
+	}
+
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	admin.Password = hash
+	admin.UpdatedAt = requestAt
+	query = "UPDATE admin_users SET password=?, updated_at=? WHERE id=?"
+	if _, err = tx.Exec(query, admin.Password, admin.UpdatedAt, admin.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// 現在のセッション以外は無効にする
+	query = "UPDATE admin_sessions SET deleted_at=? WHERE user_id=? AND session_id<>? AND deleted_at IS NULL"
+	if _, err = tx.Exec(query, requestAt, admin.ID, c.Request().Header.Get("x-session")); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminUserAccountResponse{
+		AdminUser: admin,
+	})
+}
+
+type AdminChangePasswordRequest struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+// revokeAdminSessions 管理者のセッションをすべて無効にする
+func revokeAdminSessions(tx *sqlx.Tx, adminUserID, requestAt int64) error {
+	query := "UPDATE admin_sessions SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
+	_, err := tx.Exec(query, requestAt, adminUserID)
+	return err
+}
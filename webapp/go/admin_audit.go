@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	AdminAuditDefaultLimit int   = 100
+	AdminAuditMaxLimit     int64 = 1000
+
+	AdminAuditMaxBodySize int = 64 * 1024 // これより大きいボディはハッシュのみ記録する
+)
+
+// adminAuditRedactedKeys パラメータのうち値を記録しないキー(部分一致)
+var adminAuditRedactedKeys = []string{"password", "secret", "token", "code", "otp"}
+
+// adminAuditMiddleware 管理者APIの呼び出しを監査ログに記録するmiddleware
+func (h *Handler) adminAuditMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body, err := peekRequestBody(c)
+		if err != nil {
+			return errorResponse(c, http.StatusBadRequest, ErrInvalidRequestBody)
+		}
+
+		// next
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		if err := h.insertAdminAuditLog(c, body); err != nil {
+			c.Logger().Errorf("failed to insert admin audit log: %v", err)
+		}
+		return nil
+	}
+}
+
+// setAuditAdminID セッションを持たないリクエスト(ログインなど)で監査ログに記録する管理者IDを設定する
+func setAuditAdminID(c echo.Context, adminUserID int64) {
+	c.Set("auditAdminID", adminUserID)
+}
+
+// peekRequestBody リクエストボディを読み取り、後続のハンドラで読めるように戻しておく
+func peekRequestBody(c echo.Context) ([]byte, error) {
+	req := c.Request()
+	if req.Body == nil || req.Method == http.MethodGet {
+		return nil, nil
+	}
+	// マルチパートはハンドラがパースしたフォームから記録する
+	if strings.HasPrefix(req.Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		return nil, nil
+	}
+	buf, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(buf))
+	return buf, nil
+}
+
+// insertAdminAuditLog 監査ログを追記する
+func (h *Handler) insertAdminAuditLog(c echo.Context, body []byte) error {
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return err
+	}
+
+	var adminUserID *int64
+	if v, err := getAdminUserID(c); err == nil {
+		adminUserID = &v
+	} else if v, ok := c.Get("auditAdminID").(int64); ok {
+		adminUserID = &v
+	}
+
+	action := c.Request().Method + " " + c.Path()
+	return h.insertAdminAuditEvent(adminUserID, action, collectAdminAuditParams(c, body), c.Response().Status, c.RealIP(), requestAt)
+}
+
+// insertAdminAuditEvent 監査ログを1件追記する。API呼び出し以外の出来事(ロックアウトなど)の記録にも使う
+func (h *Handler) insertAdminAuditEvent(adminUserID *int64, action string, params interface{}, statusCode int, ip string, requestAt int64) error {
+	b, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	logID, err := h.generateID()
+	if err != nil {
+		return err
+	}
+	auditLog := &AdminAuditLog{
+		ID:         logID,
+		AdminID:    adminUserID,
+		Action:     action,
+		Params:     string(b),
+		StatusCode: statusCode,
+		IP:         ip,
+		CreatedAt:  requestAt,
+	}
+	query := "INSERT INTO admin_audit_logs(id, admin_id, action, params, status_code, ip, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err = h.DB.Exec(query, auditLog.ID, auditLog.AdminID, auditLog.Action, auditLog.Params, auditLog.StatusCode, auditLog.IP, auditLog.CreatedAt)
+	return err
+}
+
+// collectAdminAuditParams パスパラメータ、クエリ、ボディ、アップロードされたファイルのハッシュを集める
+func collectAdminAuditParams(c echo.Context, body []byte) *AdminAuditParams {
+	params := new(AdminAuditParams)
+
+	if names := c.ParamNames(); len(names) > 0 {
+		params.Path = make(map[string]string, len(names))
+		for i, name := range names {
+			params.Path[name] = c.ParamValues()[i]
+		}
+	}
+
+	if query := c.QueryParams(); len(query) > 0 {
+		params.Query = make(map[string]string, len(query))
+		for key := range query {
+			params.Query[key] = redactAdminAuditValue(key, query.Get(key))
+		}
+	}
+
+	if len(body) > 0 {
+		mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+		var v interface{}
+		if mediaType == echo.MIMEApplicationJSON && len(body) <= AdminAuditMaxBodySize && json.Unmarshal(body, &v) == nil {
+			params.Body = redactAdminAuditBody(v)
+		} else {
+			params.BodySHA256 = sha256Hex(body)
+		}
+	}
+
+	if form := c.Request().MultipartForm; form != nil {
+		params.Form = make(map[string]string, len(form.Value))
+		for key, values := range form.Value {
+			if len(values) > 0 {
+				params.Form[key] = redactAdminAuditValue(key, values[0])
+			}
+		}
+		for field, files := range form.File {
+			for _, file := range files {
+				f := &AdminAuditFile{Field: field, Filename: file.Filename, Size: file.Size}
+				if src, err := file.Open(); err == nil {
+					hash := sha256.New()
+					if _, err = io.Copy(hash, src); err == nil {
+						f.SHA256 = hex.EncodeToString(hash.Sum(nil))
+					}
+					src.Close()
+				}
+				params.Files = append(params.Files, f)
+			}
+		}
+	}
+
+	return params
+}
+
+// redactAdminAuditBody JSONのボディからパスワードなどの値を取り除く
+func redactAdminAuditBody(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if isAdminAuditRedactedKey(key) {
+				v[key] = "***"
+				continue
+			}
+			v[key] = redactAdminAuditBody(value)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactAdminAuditBody(v[i])
+		}
+	}
+	return v
+}
+
+func redactAdminAuditValue(key, value string) string {
+	if isAdminAuditRedactedKey(key) {
+		return "***"
+	}
+	return value
+}
+
+func isAdminAuditRedactedKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, v := range adminAuditRedactedKeys {
+		if strings.Contains(key, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// adminListAuditLogs 監査ログの検索
+// GET /admin/audit
+func (h *Handler) adminListAuditLogs(c echo.Context) error {
+	conds := make([]string, 0)
+	args := make([]interface{}, 0)
+
+	adminID, err := parseQueryInt(c, "adminId")
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if adminID != nil {
+		conds = append(conds, "admin_id=?")
+		args = append(args, *adminID)
+	}
+	if action := c.QueryParam("action"); action != "" {
+		conds = append(conds, "action=?")
+		args = append(args, action)
+	}
+	from, err := parseQueryInt(c, "from")
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if from != nil {
+		conds = append(conds, "created_at>=?")
+		args = append(args, *from)
+	}
+	to, err := parseQueryInt(c, "to")
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if to != nil {
+		conds = append(conds, "created_at<?")
+		args = append(args, *to)
+	}
+	// IDは単調増加するため、前のページの最後のIDより小さいものを返す
+	beforeID, err := parseQueryInt(c, "beforeId")
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if beforeID != nil {
+		conds = append(conds, "id<?")
+		args = append(args, *beforeID)
+	}
+
+	limit := AdminAuditDefaultLimit
+	if v := c.QueryParam("limit"); v != "" {
+		l, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || l < 1 || l > AdminAuditMaxLimit {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid limit: %s", v))
+		}
+		limit = int(l)
+	}
+
+	query := "SELECT * FROM admin_audit_logs"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	logs := make([]*AdminAuditLog, 0)
+	if err = h.DB.Select(&logs, query, args...); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminListAuditLogsResponse{
+		AuditLogs: logs,
+	})
+}
+
+type AdminListAuditLogsResponse struct {
+	AuditLogs []*AdminAuditLog `json:"auditLogs"`
+}
+
+type AdminAuditLog struct {
+	ID         int64  `json:"id" db:"id"`
+	AdminID    *int64 `json:"adminId" db:"admin_id"`
+	Action     string `json:"action" db:"action"` // メソッドとルートのパス、またはLOCKOUTなどの出来事
+	Params     string `json:"params" db:"params"` // AdminAuditParamsのJSON
+	StatusCode int    `json:"statusCode" db:"status_code"`
+	IP         string `json:"ip" db:"ip"`
+	CreatedAt  int64  `json:"createdAt" db:"created_at"`
+}
+
+type AdminAuditParams struct {
+	Path       map[string]string `json:"path,omitempty"`
+	Query      map[string]string `json:"query,omitempty"`
+	Body       interface{}       `json:"body,omitempty"`
+	BodySHA256 string            `json:"bodySha256,omitempty"`
+	Form       map[string]string `json:"form,omitempty"`
+	Files      []*AdminAuditFile `json:"files,omitempty"`
+}
+
+type AdminAuditFile struct {
+	Field    string `json:"field"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	AdminBulkBanMaxUsers  int    = 10000
+	AdminBulkBanBatchSize int    = 100     // 1トランザクションで処理するユーザ数
+	AdminBulkBanFormName  string = "users" // ユーザIDのCSVをアップロードする場合のフォーム名
+
+	BulkBanStatusBanned     string = "banned"
+	BulkBanStatusUnbanned   string = "unbanned"
+	BulkBanStatusNotFound   string = "not_found"
+	BulkBanStatusNotBanned  string = "not_banned"
+	BulkBanStatusDuplicated string = "duplicated"
+	BulkBanStatusInvalid    string = "invalid"
+	BulkBanStatusFailed     string = "failed"
+)
+
+var (
+	ErrBulkBanNoUsers      error = fmt.Errorf("no user ids")
+	ErrBulkBanTooManyUsers error = fmt.Errorf("user ids must be at most %d", AdminBulkBanMaxUsers)
+	ErrBulkBanNoReason     error = fmt.Errorf("reason is required")
+)
+
+// adminBulkBanUsers 複数ユーザの一括BAN
+// POST /admin/users/ban
+func (h *Handler) adminBulkBanUsers(c echo.Context) error {
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	adminUserID, err := getAdminUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	req, results, err := readBulkBanRequest(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		return errorResponse(c, http.StatusBadRequest, ErrBulkBanNoReason)
+	}
+	if req.ExpiredAt != nil && *req.ExpiredAt <= requestAt {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("expiredAt must be in the future"))
+	}
+
+	h.applyBulkBan(c, results, func(tx *sqlx.Tx, batch map[int64]*AdminBulkBanResult) error {
+		userIDs := make([]int64, 0, len(batch))
+		for userID := range batch {
+			userIDs = append(userIDs, userID)
+		}
+
+		// 有効なBANは新しいBANで置き換える
+		query, args, err := sqlx.In("UPDATE user_bans SET deleted_at=?, updated_at=? WHERE user_id IN (?) AND deleted_at IS NULL", requestAt, requestAt, userIDs)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(query, args...); err != nil {
+			return err
+		}
+
+		for _, userID := range userIDs {
+			banID, err := h.generateID()
+			if err != nil {
+				return err
+			}
+			ban := &UserBan{
+				ID:        banID,
+				UserID:    userID,
+				Reason:    req.Reason,
+				AdminID:   &adminUserID,
+				ExpiredAt: req.ExpiredAt,
+				CreatedAt: requestAt,
+				UpdatedAt: requestAt,
+			}
+			query = "INSERT INTO user_bans(id, user_id, reason, admin_id, expired_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+			if _, err = tx.Exec(query, ban.ID, ban.UserID, ban.Reason, ban.AdminID, ban.ExpiredAt, ban.CreatedAt, ban.UpdatedAt); err != nil {
+				return err
+			}
+			batch[userID].Status = BulkBanStatusBanned
+			batch[userID].Ban = ban
+		}
+
+		// BANしたユーザのセッションは即時に無効にする
+		query, args, err = sqlx.In("UPDATE user_sessions SET deleted_at=? WHERE user_id IN (?) AND deleted_at IS NULL", requestAt, userIDs)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(query, args...)
+		return err
+	})
+
+	return successResponse(c, newAdminBulkBanResponse(results))
+}
+
+// adminBulkUnbanUsers 複数ユーザの一括BAN解除
+// POST /admin/users/unban
+func (h *Handler) adminBulkUnbanUsers(c echo.Context) error {
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	_, results, err := readBulkBanRequest(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	h.applyBulkBan(c, results, func(tx *sqlx.Tx, batch map[int64]*AdminBulkBanResult) error {
+		userIDs := make([]int64, 0, len(batch))
+		for userID := range batch {
+			userIDs = append(userIDs, userID)
+		}
+
+		banned := make([]int64, 0, len(userIDs))
+		query, args, err := sqlx.In("SELECT DISTINCT user_id FROM user_bans WHERE user_id IN (?) AND deleted_at IS NULL FOR UPDATE", userIDs)
+		if err != nil {
+			return err
+		}
+		if err = tx.Select(&banned, query, args...); err != nil {
+			return err
+		}
+		for _, userID := range userIDs {
+			batch[userID].Status = BulkBanStatusNotBanned
+		}
+		if len(banned) == 0 {
+			return nil
+		}
+
+		query, args, err = sqlx.In("UPDATE user_bans SET deleted_at=?, updated_at=? WHERE user_id IN (?) AND deleted_at IS NULL", requestAt, requestAt, banned)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(query, args...); err != nil {
+			return err
+		}
+		for _, userID := range banned {
+			batch[userID].Status = BulkBanStatusUnbanned
+		}
+		return nil
+	})
+
+	return successResponse(c, newAdminBulkBanResponse(results))
+}
+
+// applyBulkBan 検証済みのユーザをAdminBulkBanBatchSize件ずつトランザクションで処理する
+// 存在しないユーザ、削除済みのユーザはnot_foundとし、applyには存在するユーザのみを渡す
+// 失敗したバッチはロールバックしてfailedとし、残りのバッチの処理を続ける
+func (h *Handler) applyBulkBan(c echo.Context, results []*AdminBulkBanResult, apply func(tx *sqlx.Tx, batch map[int64]*AdminBulkBanResult) error) {
+	pending := make([]*AdminBulkBanResult, 0, len(results))
+	for _, r := range results {
+		if r.Status == "" {
+			pending = append(pending, r)
+		}
+	}
+
+	for start := 0; start < len(pending); start += AdminBulkBanBatchSize {
+		end := start + AdminBulkBanBatchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		batch := pending[start:end]
+
+		if err := h.applyBulkBanBatch(batch, apply); err != nil {
+			c.Logger().Errorf("failed to apply bulk ban batch: %v", err)
+			for _, r := range batch {
+				if r.Status == BulkBanStatusNotFound {
+					continue
+				}
+				r.Status = BulkBanStatusFailed
+				r.Ban = nil
+				r.Error = err.Error()
+			}
+		}
+	}
+}
+
+func (h *Handler) applyBulkBanBatch(batch []*AdminBulkBanResult, apply func(tx *sqlx.Tx, batch map[int64]*AdminBulkBanResult) error) error {
+	userIDs := make([]int64, 0, len(batch))
+	for _, r := range batch {
+		userIDs = append(userIDs, *r.UserID)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	existing := make([]int64, 0, len(userIDs))
+	query, args, err := sqlx.In("SELECT id FROM users WHERE id IN (?) AND deleted_at IS NULL", userIDs)
+	if err != nil {
+		return err
+	}
+	if err = tx.Select(&existing, query, args...); err != nil {
+		return err
+	}
+	found := make(map[int64]struct{}, len(existing))
+	for _, id := range existing {
+		found[id] = struct{}{}
+	}
+
+	targets := make(map[int64]*AdminBulkBanResult, len(existing))
+	for _, r := range batch {
+		if _, ok := found[*r.UserID]; !ok {
+			r.Status = BulkBanStatusNotFound
+			continue
+		}
+		targets[*r.UserID] = r
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	if err = apply(tx, targets); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// readBulkBanRequest JSONのボディ、またはユーザIDのCSVをアップロードしたフォームから対象のユーザを読み込む
+// 不正な行と重複したユーザIDはこの時点で結果を確定する
+func readBulkBanRequest(c echo.Context) (*AdminBulkBanRequest, []*AdminBulkBanResult, error) {
+	defer c.Request().Body.Close()
+	req := new(AdminBulkBanRequest)
+	results := make([]*AdminBulkBanResult, 0)
+
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if mediaType == echo.MIMEMultipartForm {
+		req.Reason = c.FormValue("reason")
+		if v := c.FormValue("expiredAt"); v != "" {
+			expiredAt, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid expiredAt: %s", v)
+			}
+			req.ExpiredAt = &expiredAt
+		}
+		records, err := readFormFileToCSV(c, AdminBulkBanFormName)
+		if err != nil {
+			return nil, nil, err
+		}
+		results = parseBulkBanCSV(records)
+	} else {
+		if err := parseRequestBody(c, req); err != nil {
+			return nil, nil, err
+		}
+		for i, userID := range req.UserIDs {
+			userID := userID
+			results = append(results, &AdminBulkBanResult{Row: i + 1, UserID: &userID})
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, nil, ErrBulkBanNoUsers
+	}
+	if len(results) > AdminBulkBanMaxUsers {
+		return nil, nil, ErrBulkBanTooManyUsers
+	}
+
+	seen := make(map[int64]struct{}, len(results))
+	for _, r := range results {
+		if r.Status != "" {
+			continue
+		}
+		if _, ok := seen[*r.UserID]; ok {
+			r.Status = BulkBanStatusDuplicated
+			continue
+		}
+		seen[*r.UserID] = struct{}{}
+	}
+
+	return req, results, nil
+}
+
+// parseBulkBanCSV ユーザIDのCSVを読み込み、不正な行はinvalidとする
+func parseBulkBanCSV(records [][]string) []*AdminBulkBanResult {
+	rows := parseUserIDCSV(records)
+	results := make([]*AdminBulkBanResult, 0, len(rows))
+	for _, row := range rows {
+		r := &AdminBulkBanResult{Row: row.Row, UserID: row.UserID, Error: row.Error}
+		if row.UserID == nil {
+			r.Status = BulkBanStatusInvalid
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// parseUserIDCSV ユーザIDのCSVを読み込む
+// 1行目がuser_id、userIdのヘッダの場合はその列を、ヘッダがない場合は1列目をユーザIDとする
+// 不正な行はUserIDをnilとしてErrorに理由を設定する
+func parseUserIDCSV(records [][]string) []*userIDRecord {
+	column := 0
+	start := 0
+	if len(records) > 0 {
+		for i, name := range records[0] {
+			name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+			if name == "user_id" || name == "userId" {
+				column = i
+				start = 1
+				break
+			}
+		}
+	}
+
+	rows := make([]*userIDRecord, 0, len(records))
+	for i := start; i < len(records); i++ {
+		// 行番号はヘッダを含めたCSVの行番号とする
+		r := &userIDRecord{Row: i + 1}
+		if len(records[i]) == 1 && strings.TrimSpace(records[i][0]) == "" {
+			continue
+		}
+		if column >= len(records[i]) {
+			r.Error = "missing user_id"
+			rows = append(rows, r)
+			continue
+		}
+		v := strings.TrimSpace(strings.TrimPrefix(records[i][column], "\ufeff"))
+		userID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			r.Error = fmt.Sprintf("invalid user_id: %s", v)
+			rows = append(rows, r)
+			continue
+		}
+		r.UserID = &userID
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+// userIDRecord ユーザIDのCSVの1行
+type userIDRecord struct {
+	Row    int    `json:"row"`
+	UserID *int64 `json:"userId"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newAdminBulkBanResponse(results []*AdminBulkBanResult) *AdminBulkBanResponse {
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.Status]++
+	}
+	return &AdminBulkBanResponse{
+		Counts:  counts,
+		Results: results,
+	}
+}
+
+type AdminBulkBanRequest struct {
+	UserIDs   []int64 `json:"userIds"`
+	Reason    string  `json:"reason"`    // 一括BANの場合は必須
+	ExpiredAt *int64  `json:"expiredAt"` // 省略した場合は無期限
+}
+
+type AdminBulkBanResponse struct {
+	Counts  map[string]int        `json:"counts"` // statusごとの件数
+	Results []*AdminBulkBanResult `json:"results"`
+}
+
+type AdminBulkBanResult struct {
+	Row    int      `json:"row"` // JSONの場合は要素番号、CSVの場合は行番号(1始まり)
+	UserID *int64   `json:"userId"`
+	Status string   `json:"status"`
+	Ban    *UserBan `json:"ban,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	ErrReasonRequired   error = fmt.Errorf("reason is required")
+	ErrNotEnoughBalance error = fmt.Errorf("not enough balance to revoke")
+	ErrCardInDeck       error = fmt.Errorf("card is equipped in the deck")
+)
+
+const (
+	AdminActionGrant  string = "grant"
+	AdminActionRevoke string = "revoke"
+
+	AdminGrantCardMaxAmount int64 = 100
+)
+
+// adminGrantUserItem ユーザへのアイテム付与
+// POST /admin/user/{userID}/grant
+func (h *Handler) adminGrantUserItem(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	adminUserID, err := getAdminUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	defer c.Request().Body.Close()
+	req, err := parseAdminInventoryRequest(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.ItemType == 2 && req.Amount > AdminGrantCardMaxAmount {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("amount of cards should be less than or equal to %d", AdminGrantCardMaxAmount))
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 削除済みのユーザには付与しない。コインの加算が同時のガチャや報酬で上書きされないようロックする
+	user := new(User)
+	query := "SELECT * FROM users WHERE id=? AND deleted_at IS NULL FOR UPDATE"
+	if err = tx.Get(user, query, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// カードは1回の付与で1枚なので個数分付与する
+	times, amount := int64(1), req.Amount
+	if req.ItemType == 2 {
+		times, amount = req.Amount, 1
+	}
+	cards := make([]*UserCard, 0)
+	items := make([]*UserItem, 0)
+	repo := &mysqlRepositories{q: tx} // 操作ログと同じトランザクションで付与する
+	for i := int64(0); i < times; i++ {
+		_, obtainCards, obtainItems, err := h.obtainItem(repo, userID, req.ItemID, req.ItemType, amount, requestAt)
+		if err != nil {
+			if err == ErrUserNotFound || err == ErrItemNotFound {
+				return errorResponse(c, http.StatusNotFound, err)
+			}
+			if err == ErrInvalidItemType {
+				return errorResponse(c, http.StatusBadRequest, err)
+			}
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		cards = append(cards, obtainCards...)
+		items = append(items, obtainItems...)
+	}
+
+	actionLog, err := h.insertAdminActionLog(tx, adminUserID, userID, AdminActionGrant, req, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// 付与後の所持コインを返す
+	if err = tx.Get(user, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminUserInventoryResponse{
+		User:      user,
+		UserCards: cards,
+		UserItems: items,
+		ActionLog: actionLog,
+	})
+}
+
+// adminRevokeUserItem ユーザからのアイテム没収
+// POST /admin/user/{userID}/revoke
+func (h *Handler) adminRevokeUserItem(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	adminUserID, err := getAdminUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	defer c.Request().Body.Close()
+	req, err := parseAdminInventoryRequest(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	user := new(User)
+	query := "SELECT * FROM users WHERE id=? AND deleted_at IS NULL FOR UPDATE"
+	if err = tx.Get(user, query, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	cards := make([]*UserCard, 0)
+	items := make([]*UserItem, 0)
+	switch req.ItemType {
+	case 1: // coin
+		if user.IsuCoin < req.Amount {
+			return errorResponse(c, http.StatusConflict, ErrNotEnoughBalance)
+		}
+		user.IsuCoin -= req.Amount
+		query = "UPDATE users SET isu_coin=?, updated_at=? WHERE id=?"
+		if _, err = tx.Exec(query, user.IsuCoin, requestAt, user.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+
+	case 2: // card(ハンマー)
+		card := new(UserCard)
+		query = "SELECT * FROM user_cards WHERE id=? AND user_id=? AND deleted_at IS NULL FOR UPDATE"
+		if err = tx.Get(card, query, req.UserCardID, userID); err != nil {
+			if err == sql.ErrNoRows {
+				return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found card"))
+			}
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+
+		// 装備中のカードは没収できない
+		var equipped int
+		query = "SELECT COUNT(*) FROM user_decks WHERE user_id=? AND deleted_at IS NULL AND ? IN (user_card_id_1, user_card_id_2, user_card_id_3)"
+		if err = tx.Get(&equipped, query, userID, card.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if equipped > 0 {
+			return errorResponse(c, http.StatusConflict, ErrCardInDeck)
+		}
+
+		card.UpdatedAt = requestAt
+		card.DeletedAt = &requestAt
+		query = "UPDATE user_cards SET updated_at=?, deleted_at=? WHERE id=?"
+		if _, err = tx.Exec(query, requestAt, requestAt, card.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		req.ItemID = card.CardID
+		cards = append(cards, card)
+
+	case 3, 4: // 強化素材
+		item := new(UserItem)
+		query = "SELECT * FROM user_items WHERE user_id=? AND item_id=? AND item_type=? AND deleted_at IS NULL FOR UPDATE"
+		if err = tx.Get(item, query, userID, req.ItemID, req.ItemType); err != nil {
+			if err == sql.ErrNoRows {
+				return errorResponse(c, http.StatusConflict, ErrNotEnoughBalance)
+			}
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if int64(item.Amount) < req.Amount {
+			return errorResponse(c, http.StatusConflict, ErrNotEnoughBalance)
+		}
+		item.Amount -= int(req.Amount)
+		item.UpdatedAt = requestAt
+		query = "UPDATE user_items SET amount=?, updated_at=? WHERE id=?"
+		if _, err = tx.Exec(query, item.Amount, item.UpdatedAt, item.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		items = append(items, item)
+
+	default:
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidItemType)
+	}
+
+	actionLog, err := h.insertAdminActionLog(tx, adminUserID, userID, AdminActionRevoke, req, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminUserInventoryResponse{
+		User:      user,
+		UserCards: cards,
+		UserItems: items,
+		ActionLog: actionLog,
+	})
+}
+
+// parseAdminInventoryRequest 付与、没収のリクエストをパースして検証する
+func parseAdminInventoryRequest(c echo.Context) (*AdminUserInventoryRequest, error) {
+	req := new(AdminUserInventoryRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return nil, err
+	}
+	if req.Reason == "" {
+		return nil, ErrReasonRequired
+	}
+	// カードは個数の指定がなければ1枚とする
+	if req.ItemType == 2 && req.Amount == 0 {
+		req.Amount = 1
+	}
+	if req.Amount < 1 {
+		return nil, fmt.Errorf("amount should be more than or equal to 1")
+	}
+	return req, nil
+}
+
+// insertAdminActionLog 管理者による付与、没収の記録
+func (h *Handler) insertAdminActionLog(tx *sqlx.Tx, adminUserID, userID int64, action string, req *AdminUserInventoryRequest, requestAt int64) (*AdminActionLog, error) {
+	logID, err := h.generateID()
+	if err != nil {
+		return nil, err
+	}
+	actionLog := &AdminActionLog{
+		ID:        logID,
+		AdminID:   adminUserID,
+		UserID:    userID,
+		Action:    action,
+		ItemType:  req.ItemType,
+		ItemID:    req.ItemID,
+		Amount:    req.Amount,
+		Reason:    req.Reason,
+		CreatedAt: requestAt,
+	}
+	if req.UserCardID != 0 {
+		actionLog.UserCardID = &req.UserCardID
+	}
+	query := "INSERT INTO admin_action_logs(id, admin_id, user_id, action, item_type, item_id, user_card_id, amount, reason, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	if _, err = tx.Exec(query, actionLog.ID, actionLog.AdminID, actionLog.UserID, actionLog.Action, actionLog.ItemType, actionLog.ItemID, actionLog.UserCardID, actionLog.Amount, actionLog.Reason, actionLog.CreatedAt); err != nil {
+		return nil, err
+	}
+	return actionLog, nil
+}
+
+type AdminUserInventoryRequest struct {
+	ItemType   int    `json:"itemType"`
+	ItemID     int64  `json:"itemId"`
+	Amount     int64  `json:"amount"`
+	UserCardID int64  `json:"userCardId"` // カード没収時に対象のuser_cards.idを指定する
+	Reason     string `json:"reason"`
+}
+
+type AdminUserInventoryResponse struct {
+	User      *User           `json:"user"`
+	UserCards []*UserCard     `json:"userCards"`
+	UserItems []*UserItem     `json:"userItems"`
+	ActionLog *AdminActionLog `json:"actionLog"`
+}
+
+type AdminActionLog struct {
+	ID         int64  `json:"id" db:"id"`
+	AdminID    int64  `json:"adminId" db:"admin_id"`
+	UserID     int64  `json:"userId" db:"user_id"`
+	Action     string `json:"action" db:"action"`
+	ItemType   int    `json:"itemType" db:"item_type"`
+	ItemID     int64  `json:"itemId" db:"item_id"`
+	UserCardID *int64 `json:"userCardId" db:"user_card_id"`
+	Amount     int64  `json:"amount" db:"amount"`
+	Reason     string `json:"reason" db:"reason"`
+	CreatedAt  int64  `json:"createdAt" db:"created_at"`
+}
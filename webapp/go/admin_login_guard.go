@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	AdminLoginFailureWindow    int64 = 3600 // 最後の失敗からこの時間(秒)が経過すると失敗回数を数え直す
+	AdminLoginBackoffThreshold int64 = 3    // この回数を超えて失敗すると次の試行まで待たせる
+	AdminLoginMaxBackoff       int64 = 900  // 待ち時間(秒)の上限
+
+	AdminAuditActionLockout string = "LOCKOUT" // ログイン失敗によるアカウントのロック
+)
+
+var (
+	ErrAdminUserLocked      error = fmt.Errorf("admin user is locked")
+	ErrTooManyLoginFailures error = fmt.Errorf("too many login failures")
+)
+
+// adminLoginFailureKey ログイン失敗回数を数えるキー
+func adminLoginFailureKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+// adminLoginFailureKeys ログイン失敗回数を数えるキー。管理者IDごとと、リクエスト元IPと管理者IDの組ごとに数える
+// IPだけで数えると、プロキシの背後で同じIPに見えるクライアントや他の管理者のログインまで止めてしまうため、管理者IDと組にする
+func adminLoginFailureKeys(adminUserID int64, ip string) []string {
+	id := strconv.FormatInt(adminUserID, 10)
+	return []string{
+		adminLoginFailureKey("admin", id),
+		adminLoginFailureKey("ip", ip+":admin:"+id),
+	}
+}
+
+// adminLoginRetryAfter 管理者ID、またはリクエスト元IPと管理者IDの組が待ち時間中であれば、残りの秒数を返す
+func (h *Handler) adminLoginRetryAfter(adminUserID int64, ip string, requestAt int64) (int64, error) {
+	query, args, err := sqlx.In("SELECT COALESCE(MAX(blocked_until), 0) FROM admin_login_failures WHERE login_key IN (?)", adminLoginFailureKeys(adminUserID, ip))
+	if err != nil {
+		return 0, err
+	}
+	var blockedUntil int64
+	if err = h.DB.Get(&blockedUntil, query, args...); err != nil {
+		return 0, err
+	}
+	if blockedUntil <= requestAt {
+		return 0, nil
+	}
+	return blockedUntil - requestAt, nil
+}
+
+// recordAdminLoginFailure ログインの失敗を記録し、失敗が続いた管理者アカウントをロックする
+// 失敗したログインのトランザクションはロールバックされるため、トランザクションの外で記録する
+// adminExistsがfalseの場合は存在しない管理者IDへの試行として、リクエスト元IPと管理者IDの組のみ数える
+func (h *Handler) recordAdminLoginFailure(c echo.Context, adminUserID int64, adminExists bool, requestAt int64) error {
+	ip := c.RealIP()
+	keys := adminLoginFailureKeys(adminUserID, ip)
+	if !adminExists {
+		keys = keys[1:]
+	}
+
+	var adminFailures int64
+	for i, key := range keys {
+		failures, err := h.incrementAdminLoginFailure(key, requestAt)
+		if err != nil {
+			return err
+		}
+		if adminExists && i == 0 {
+			adminFailures = failures
+		}
+	}
+
+	if !adminExists || h.AdminLockoutThreshold <= 0 || adminFailures < h.AdminLockoutThreshold {
+		return nil
+	}
+
+	query := "UPDATE admin_users SET locked_at=?, updated_at=? WHERE id=? AND locked_at IS NULL AND deleted_at IS NULL"
+	res, err := h.DB.Exec(query, requestAt, requestAt, adminUserID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	c.Logger().Warnf("admin user locked: adminId=%d, failures=%d, ip=%s", adminUserID, adminFailures, ip)
+	params := &AdminLockoutParams{
+		Failures: adminFailures,
+	}
+	return h.insertAdminAuditEvent(&adminUserID, AdminAuditActionLockout, params, http.StatusLocked, ip, requestAt)
+}
+
+// incrementAdminLoginFailure 失敗回数を1つ増やして待ち時間を更新し、増やした後の失敗回数を返す
+// 同時に失敗しても数え漏れがないよう、失敗回数と待ち時間は1つのクエリで更新する
+// 待ち時間は閾値を超えるごとに倍になり、AdminLoginMaxBackoff(秒)を上限とする
+func (h *Handler) incrementAdminLoginFailure(key string, requestAt int64) (int64, error) {
+	// 代入は左から順に評価されるため、failuresは更新前のlast_failed_atを、blocked_untilは更新後のfailuresを参照する
+	query := "INSERT INTO admin_login_failures(login_key, failures, last_failed_at, blocked_until) VALUES (?, 1, ?, 0)" +
+		" ON DUPLICATE KEY UPDATE failures=IF(last_failed_at < ?, 1, failures+1), last_failed_at=VALUES(last_failed_at)," +
+		" blocked_until=IF(failures > ?, VALUES(last_failed_at) + LEAST(?, POW(2, LEAST(failures - ? - 1, 16))), 0)"
+	args := []interface{}{key, requestAt, requestAt - AdminLoginFailureWindow, AdminLoginBackoffThreshold, AdminLoginMaxBackoff, AdminLoginBackoffThreshold}
+	if _, err := h.DB.Exec(query, args...); err != nil {
+		return 0, err
+	}
+
+	// 同時に失敗した分を含む回数になるが、ロックの判定には十分
+	var failures int64
+	query = "SELECT failures FROM admin_login_failures WHERE login_key=?"
+	if err := h.DB.Get(&failures, query, key); err != nil {
+		return 0, err
+	}
+	return failures, nil
+}
+
+// resetAdminLoginFailures ログインに成功した管理者の失敗回数を消す。リクエスト元IPの失敗回数は残す
+func resetAdminLoginFailures(tx *sqlx.Tx, adminUserID int64) error {
+	query := "DELETE FROM admin_login_failures WHERE login_key=?"
+	_, err := tx.Exec(query, adminLoginFailureKey("admin", strconv.FormatInt(adminUserID, 10)))
+	return err
+}
+
+// clearAdminLoginFailures 管理者の失敗回数を、リクエスト元IPと組にしたものも含めてすべて消す
+func clearAdminLoginFailures(tx *sqlx.Tx, adminUserID int64) error {
+	keys := adminLoginFailureKeys(adminUserID, "%")
+	_, err := tx.Exec("DELETE FROM admin_login_failures WHERE login_key=? OR login_key LIKE ?", keys[0], keys[1])
+	return err
+}
+
+// adminLoginTooManyFailures 待ち時間中のログインを拒否する
+func adminLoginTooManyFailures(c echo.Context, retryAfter int64) error {
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	return errorResponse(c, http.StatusTooManyRequests, ErrTooManyLoginFailures)
+}
+
+// adminUnlockAdminUser ログイン失敗でロックされた管理者のロック解除
+// POST /admin/admins/{adminID}/unlock
+func (h *Handler) adminUnlockAdminUser(c echo.Context) error {
+	return h.updateAdminUserAccount(c, false, func(tx *sqlx.Tx, admin *AdminUser, requestAt int64) error {
+		admin.LockedAt = nil
+		admin.UpdatedAt = requestAt
+		query := "UPDATE admin_users SET locked_at=NULL, updated_at=? WHERE id=?"
+		if _, err := tx.Exec(query, admin.UpdatedAt, admin.ID); err != nil {
+			return err
+		}
+		return clearAdminLoginFailures(tx, admin.ID)
+	})
+}
+
+type AdminLockoutParams struct {
+	Failures int64 `json:"failures"`
+}
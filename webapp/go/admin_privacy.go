@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+var ErrUserAlreadyErased error = fmt.Errorf("user is already erased")
+
+// userErasureTables 削除時にdeleted_atを設定するuser_*テーブル
+// user_devices、user_bans、user_idempotency_keysは匿名化が必要なため個別に処理する
+var userErasureTables = []string{
+	"user_cards",
+	"user_decks",
+	"user_items",
+	"user_login_bonuses",
+	"user_presents",
+	"user_present_all_received_history",
+	"user_sessions",
+	"user_one_time_tokens",
+}
+
+// adminExportUser ユーザに紐づくデータのエクスポート
+// GET /admin/user/{userID}/export
+func (h *Handler) adminExportUser(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	data, err := h.getAdminUserData(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// セッションIDは認証に使えるため出力しない
+	sessions := make([]*UserExportSession, 0)
+	query := "SELECT id, user_id, expired_at, created_at, updated_at, deleted_at FROM user_sessions WHERE user_id=? ORDER BY created_at, id"
+	if err = h.DB.Select(&sessions, query, userID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	b, err := json.MarshalIndent(&UserExport{
+		ExportedAt:        requestAt,
+		AdminUserResponse: data,
+		UserSessions:      sessions,
+	}, "", "  ")
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return attachmentResponse(c, fmt.Sprintf("user_%d.json", userID), echo.MIMEApplicationJSONCharsetUTF8, b)
+}
+
+// adminEraseUser ユーザの削除要求に応じてユーザを論理削除し、個人を特定できる値を匿名化する
+// 削除したユーザはユーザ向けのAPIから存在しないものとして扱われる
+// POST /admin/user/{userID}/erase
+func (h *Handler) adminEraseUser(c echo.Context) error {
+	userID, err := getUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	user := new(User)
+	query := "SELECT * FROM users WHERE id=? FOR UPDATE"
+	if err = tx.Get(user, query, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if user.DeletedAt != nil {
+		return errorResponse(c, http.StatusConflict, ErrUserAlreadyErased)
+	}
+
+	affected := make(map[string]int64)
+	exec := func(table, query string, args ...interface{}) error {
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("%s: %w", table, err)
+		}
+		affected[table] += n
+		return nil
+	}
+
+	user.UpdatedAt = requestAt
+	user.DeletedAt = &requestAt
+	if err = exec("users", "UPDATE users SET updated_at=?, deleted_at=? WHERE id=?", user.UpdatedAt, user.DeletedAt, user.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	for _, table := range userErasureTables {
+		query = fmt.Sprintf("UPDATE %s SET updated_at=?, deleted_at=? WHERE user_id=? AND deleted_at IS NULL", table)
+		if err = exec(table, query, requestAt, requestAt, user.ID); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	// viewer_idはプラットフォームのアカウントを特定できるため、削除済みの端末も含めて置き換える
+	query = "UPDATE user_devices SET platform_id=CONCAT('erased:', id), updated_at=?, deleted_at=COALESCE(deleted_at, ?) WHERE user_id=?"
+	if err = exec("user_devices", query, requestAt, requestAt, user.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// BANの理由には個人に関する記述が含まれうるため消す
+	query = "UPDATE user_bans SET reason='', updated_at=?, deleted_at=COALESCE(deleted_at, ?) WHERE user_id=?"
+	if err = exec("user_bans", query, requestAt, requestAt, user.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	// 保存したレスポンスにはユーザのデータが含まれるため物理削除する
+	if err = exec("user_idempotency_keys", "DELETE FROM user_idempotency_keys WHERE user_id=?", user.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminEraseUserResponse{
+		User:     user,
+		Affected: affected,
+	})
+}
+
+type UserExport struct {
+	ExportedAt int64 `json:"exportedAt"`
+	*AdminUserResponse
+	UserSessions []*UserExportSession `json:"userSessions"`
+}
+
+type UserExportSession struct {
+	ID        int64  `json:"id" db:"id"`
+	UserID    int64  `json:"userId" db:"user_id"`
+	ExpiredAt int64  `json:"expiredAt" db:"expired_at"`
+	CreatedAt int64  `json:"createdAt" db:"created_at"`
+	UpdatedAt int64  `json:"updatedAt" db:"updated_at"`
+	DeletedAt *int64 `json:"deletedAt,omitempty" db:"deleted_at"`
+}
+
+type AdminEraseUserResponse struct {
+	User     *User            `json:"user"`
+	Affected map[string]int64 `json:"affected"` // テーブルごとの更新、削除した行数
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+type AdminRole string
+
+const (
+	AdminRoleViewer     AdminRole = "viewer"     // 閲覧のみ
+	AdminRoleSupport    AdminRole = "support"    // ユーザ対応(BAN、アイテムの付与、没収、データのエクスポート、削除)
+	AdminRolePlanner    AdminRole = "planner"    // マスタデータの更新
+	AdminRoleSuperadmin AdminRole = "superadmin" // すべての操作
+)
+
+type AdminPermission string
+
+const (
+	AdminPermissionMasterRead    AdminPermission = "master:read"
+	AdminPermissionMasterWrite   AdminPermission = "master:write"
+	AdminPermissionUserRead      AdminPermission = "user:read"
+	AdminPermissionUserBan       AdminPermission = "user:ban"
+	AdminPermissionUserInventory AdminPermission = "user:inventory"
+	AdminPermissionUserPrivacy   AdminPermission = "user:privacy"
+	AdminPermissionAdminManage   AdminPermission = "admin:manage"
+	AdminPermissionAuditRead     AdminPermission = "audit:read"
+	AdminPermissionStatsRead     AdminPermission = "stats:read"
+	AdminPermissionSystem        AdminPermission = "system"
+)
+
+// adminRolePermissions ロールごとに許可する操作。superadminはすべての操作を許可する
+var adminRolePermissions = map[AdminRole][]AdminPermission{
+	AdminRoleViewer: {
+		AdminPermissionMasterRead,
+		AdminPermissionUserRead,
+		AdminPermissionStatsRead,
+	},
+	AdminRoleSupport: {
+		AdminPermissionMasterRead,
+		AdminPermissionUserRead,
+		AdminPermissionUserBan,
+		AdminPermissionUserInventory,
+		AdminPermissionUserPrivacy,
+		AdminPermissionStatsRead,
+	},
+	AdminRolePlanner: {
+		AdminPermissionMasterRead,
+		AdminPermissionMasterWrite,
+		AdminPermissionUserRead,
+		AdminPermissionStatsRead,
+	},
+}
+
+// hasPermission ロールが操作を許可されているか
+func (r AdminRole) hasPermission(perm AdminPermission) bool {
+	if r == AdminRoleSuperadmin {
+		return true
+	}
+	for _, v := range adminRolePermissions[r] {
+		if v == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// requireAdminPermission 管理者のロールが操作を許可されているかを確認するmiddleware
+// adminSessionCheckMiddlewareの後に適用する
+func (h *Handler) requireAdminPermission(perm AdminPermission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			adminUserID, err := getAdminUserID(c)
+			if err != nil {
+				return errorResponse(c, http.StatusUnauthorized, err)
+			}
+
+			role, err := h.getAdminRole(c, adminUserID)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					return errorResponse(c, http.StatusUnauthorized, ErrUnauthorized)
+				}
+				return errorResponse(c, http.StatusInternalServerError, err)
+			}
+
+			if !role.hasPermission(perm) {
+				c.Logger().Warnf("admin permission denied: adminId=%d, role=%s, permission=%s, method=%s, path=%s", adminUserID, role, perm, c.Request().Method, c.Path())
+				return errorResponse(c, http.StatusForbidden, ErrForbidden)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// getAdminRole 管理者のロールを取得する。同一リクエスト内ではコンテキストに保持したものを使う
+func (h *Handler) getAdminRole(c echo.Context, adminUserID int64) (AdminRole, error) {
+	if role, ok := c.Get("adminRole").(AdminRole); ok {
+		return role, nil
+	}
+
+	var role AdminRole
+	query := "SELECT role FROM admin_users WHERE id=? AND deleted_at IS NULL"
+	if err := h.DB.Get(&role, query, adminUserID); err != nil {
+		return "", err
+	}
+	c.Set("adminRole", role)
+	return role, nil
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	ErrTOTPAlreadyEnabled     error = fmt.Errorf("two-factor authentication is already enabled")
+	ErrTOTPNotEnrolled        error = fmt.Errorf("two-factor authentication is not enrolled")
+	ErrTOTPNotEnabled         error = fmt.Errorf("two-factor authentication is not enabled")
+	ErrInvalidTOTPCode        error = fmt.Errorf("invalid two-factor authentication code")
+	ErrInvalidLoginChallenge  error = fmt.Errorf("invalid or expired login challenge")
+	ErrLoginChallengeExceeded error = fmt.Errorf("too many attempts for login challenge")
+)
+
+const (
+	TOTPIssuer    string = "ISUCON"
+	TOTPPeriod    int64  = 30
+	TOTPDigits    int    = 6
+	TOTPSkewSteps int64  = 1 // 前後に許容するステップ数
+
+	AdminBackupCodeCount           int   = 10
+	AdminLoginChallengeTTL         int64 = 300
+	AdminLoginChallengeMaxAttempts int   = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret TOTPの共有鍵を生成する
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpURI 認証アプリに登録するためのotpauth URI
+func totpURI(adminUserID int64, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(TOTPDigits))
+	v.Set("period", fmt.Sprint(TOTPPeriod))
+	label := url.PathEscape(fmt.Sprintf("%s:admin-%d", TOTPIssuer, adminUserID))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, v.Encode())
+}
+
+// totpCode RFC 6238に従ってステップに対応するコードを計算する
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod), nil
+}
+
+// verifyTOTP コードを検証し、一致したステップを返す。lastStep以前のステップは再利用とみなして拒否する
+func verifyTOTP(secret, code string, requestAt, lastStep int64) (int64, bool) {
+	current := requestAt / TOTPPeriod
+	for step := current - TOTPSkewSteps; step <= current+TOTPSkewSteps; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// generateBackupCodes 認証アプリを使えない場合のバックアップコードを生成する
+func generateBackupCodes() ([]string, error) {
+	codes := make([]string, 0, AdminBackupCodeCount)
+	for i := 0; i < AdminBackupCodeCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		v := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes = append(codes, v[:5]+"-"+v[5:])
+	}
+	return codes, nil
+}
+
+// hashBackupCode バックアップコードを保存用にハッシュ化する
+func hashBackupCode(code string) string {
+	return sha256Hex([]byte(strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))))
+}
+
+// adminEnrollTOTP 2要素認証の登録開始。共有鍵を発行し、検証が済むまでは有効にしない
+// 乗っ取られたセッションで別の認証アプリを登録されないよう、パスワードの再入力を求める
+// POST /admin/2fa/enroll
+func (h *Handler) adminEnrollTOTP(c echo.Context) error {
+	defer c.Request().Body.Close()
+	req := new(AdminEnrollTOTPRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	adminUserID, err := getAdminUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	admin, err := getAdminUserForUpdate(tx, adminUserID)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if admin.TOTPEnabledAt != nil {
+		return errorResponse(c, http.StatusConflict, ErrTOTPAlreadyEnabled)
+	}
+	if err = verifyPassword(admin.Password, req.Password); err != nil {
+		return errorResponse(c, http.StatusUnauthorized, ErrInvalidAdminPassword)
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	query := "UPDATE admin_users SET totp_secret=?, totp_last_step=0, updated_at=? WHERE id=?"
+	if _, err = tx.Exec(query, secret, requestAt, admin.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminEnrollTOTPResponse{
+		Secret:     secret,
+		OtpauthURI: totpURI(admin.ID, secret),
+	})
+}
+
+type AdminEnrollTOTPRequest struct {
+	Password string `json:"password"`
+}
+
+type AdminEnrollTOTPResponse struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauthUri"`
+}
+
+// adminVerifyTOTP 登録した共有鍵でコードを検証して2要素認証を有効にし、バックアップコードを発行する
+// POST /admin/2fa/verify
+func (h *Handler) adminVerifyTOTP(c echo.Context) error {
+	defer c.Request().Body.Close()
+	req := new(AdminVerifyTOTPRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	adminUserID, err := getAdminUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	admin, err := getAdminUserForUpdate(tx, adminUserID)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if admin.TOTPEnabledAt != nil {
+		return errorResponse(c, http.StatusConflict, ErrTOTPAlreadyEnabled)
+	}
+	if admin.TOTPSecret == nil {
+		return errorResponse(c, http.StatusBadRequest, ErrTOTPNotEnrolled)
+	}
+
+	step, ok := verifyTOTP(*admin.TOTPSecret, req.Code, requestAt, admin.TOTPLastStep)
+	if !ok {
+		return errorResponse(c, http.StatusUnauthorized, ErrInvalidTOTPCode)
+	}
+
+	query := "UPDATE admin_users SET totp_enabled_at=?, totp_last_step=?, updated_at=? WHERE id=?"
+	if _, err = tx.Exec(query, requestAt, step, requestAt, admin.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	codes, err := replaceBackupCodes(tx, admin.ID, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminVerifyTOTPResponse{
+		BackupCodes: codes,
+	})
+}
+
+type AdminVerifyTOTPRequest struct {
+	Code string `json:"code"`
+}
+
+type AdminVerifyTOTPResponse struct {
+	BackupCodes []string `json:"backupCodes"` // 表示はこの1回のみ
+}
+
+// adminDisableTOTP 2要素認証の解除。パスワードの再入力を求める
+// POST /admin/2fa/disable
+func (h *Handler) adminDisableTOTP(c echo.Context) error {
+	defer c.Request().Body.Close()
+	req := new(AdminDisableTOTPRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	adminUserID, err := getAdminUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	admin, err := getAdminUserForUpdate(tx, adminUserID)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if admin.TOTPEnabledAt == nil {
+		return errorResponse(c, http.StatusBadRequest, ErrTOTPNotEnabled)
+	}
+	if err = verifyPassword(admin.Password, req.Password); err != nil {
+		return errorResponse(c, http.StatusUnauthorized, ErrInvalidAdminPassword)
+	}
+
+	query := "UPDATE admin_users SET totp_secret=NULL, totp_enabled_at=NULL, totp_last_step=0, updated_at=? WHERE id=?"
+	if _, err = tx.Exec(query, requestAt, admin.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if _, err = tx.Exec("DELETE FROM admin_backup_codes WHERE admin_id=?", admin.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return noContentResponse(c, http.StatusNoContent)
+}
+
+type AdminDisableTOTPRequest struct {
+	Password string `json:"password"`
+}
+
+// adminLoginTOTP 2要素認証のコードを検証してセッションを発行する
+// POST /admin/login/2fa
+func (h *Handler) adminLoginTOTP(c echo.Context) error {
+	defer c.Request().Body.Close()
+	req := new(AdminLoginTOTPRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	challenge := new(AdminLoginChallenge)
+	query := "SELECT * FROM admin_login_challenges WHERE token=? FOR UPDATE"
+	if err = tx.Get(challenge, query, req.ChallengeToken); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusUnauthorized, ErrInvalidLoginChallenge)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	setAuditAdminID(c, challenge.AdminID)
+	if challenge.UsedAt != nil || challenge.ExpiredAt < requestAt {
+		return errorResponse(c, http.StatusUnauthorized, ErrInvalidLoginChallenge)
+	}
+	if challenge.Attempts >= AdminLoginChallengeMaxAttempts {
+		return errorResponse(c, http.StatusTooManyRequests, ErrLoginChallengeExceeded)
+	}
+
+	// パスワードでのログインと同じく、失敗が続いている場合は待ち時間が過ぎるまで拒否する
+	retryAfter, err := h.adminLoginRetryAfter(challenge.AdminID, c.RealIP(), requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if retryAfter > 0 {
+		return adminLoginTooManyFailures(c, retryAfter)
+	}
+
+	admin, err := getAdminUserForUpdate(tx, challenge.AdminID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusUnauthorized, ErrInvalidLoginChallenge)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if admin.LockedAt != nil {
+		return errorResponse(c, http.StatusLocked, ErrAdminUserLocked)
+	}
+	if admin.DisabledAt != nil {
+		return errorResponse(c, http.StatusForbidden, ErrAdminUserDisabled)
+	}
+	if admin.TOTPEnabledAt == nil || admin.TOTPSecret == nil {
+		return errorResponse(c, http.StatusUnauthorized, ErrInvalidLoginChallenge)
+	}
+
+	verified, err := verifyAdminSecondFactor(tx, admin, req.Code, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if !verified {
+		// 失敗回数は記録してからエラーを返す
+		query = "UPDATE admin_login_challenges SET attempts=attempts+1 WHERE token=?"
+		if _, err = tx.Exec(query, challenge.Token); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if err = tx.Commit(); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if err = h.recordAdminLoginFailure(c, admin.ID, true, requestAt); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		return errorResponse(c, http.StatusUnauthorized, ErrInvalidTOTPCode)
+	}
+
+	query = "UPDATE admin_login_challenges SET used_at=? WHERE token=?"
+	if _, err = tx.Exec(query, requestAt, challenge.Token); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if err = resetAdminLoginFailures(tx, admin.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	sess, err := h.createAdminSession(tx, admin.ID, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminLoginResponse{
+		AdminSession: sess,
+	})
+}
+
+type AdminLoginTOTPRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"` // 認証アプリのコードまたはバックアップコード
+}
+
+// verifyAdminSecondFactor 認証アプリのコードまたは未使用のバックアップコードを検証する
+func verifyAdminSecondFactor(tx *sqlx.Tx, admin *AdminUser, code string, requestAt int64) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == TOTPDigits {
+		step, ok := verifyTOTP(*admin.TOTPSecret, code, requestAt, admin.TOTPLastStep)
+		if !ok {
+			return false, nil
+		}
+		query := "UPDATE admin_users SET totp_last_step=? WHERE id=?"
+		if _, err := tx.Exec(query, step, admin.ID); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	query := "UPDATE admin_backup_codes SET used_at=? WHERE admin_id=? AND code_hash=? AND used_at IS NULL"
+	res, err := tx.Exec(query, requestAt, admin.ID, hashBackupCode(code))
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// replaceBackupCodes バックアップコードを作り直す
+func replaceBackupCodes(tx *sqlx.Tx, adminUserID, requestAt int64) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM admin_backup_codes WHERE admin_id=?", adminUserID); err != nil {
+		return nil, err
+	}
+	codes, err := generateBackupCodes()
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		query := "INSERT INTO admin_backup_codes(admin_id, code_hash, created_at) VALUES (?, ?, ?)"
+		if _, err = tx.Exec(query, adminUserID, hashBackupCode(code), requestAt); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// createAdminLoginChallenge パスワード認証に成功した管理者に2要素認証用のトークンを発行する
+func (h *Handler) createAdminLoginChallenge(tx *sqlx.Tx, adminUserID, requestAt int64) (string, error) {
+	token, err := generateUUID()
+	if err != nil {
+		return "", err
+	}
+	query := "INSERT INTO admin_login_challenges(token, admin_id, attempts, created_at, expired_at) VALUES (?, ?, 0, ?, ?)"
+	if _, err = tx.Exec(query, token, adminUserID, requestAt, requestAt+AdminLoginChallengeTTL); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// getAdminUserForUpdate 有効な管理者を行ロックを取って取得する
+func getAdminUserForUpdate(tx *sqlx.Tx, adminUserID int64) (*AdminUser, error) {
+	admin := new(AdminUser)
+	query := "SELECT * FROM admin_users WHERE id=? AND deleted_at IS NULL FOR UPDATE"
+	if err := tx.Get(admin, query, adminUserID); err != nil {
+		return nil, err
+	}
+	return admin, nil
+}
+
+type AdminLoginChallenge struct {
+	Token     string `db:"token"`
+	AdminID   int64  `db:"admin_id"`
+	Attempts  int    `db:"attempts"`
+	CreatedAt int64  `db:"created_at"`
+	ExpiredAt int64  `db:"expired_at"`
+	UsedAt    *int64 `db:"used_at"`
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+// testTOTPSecret RFC 6238のテストベクタのSHA-1用の鍵("12345678901234567890")
+const testTOTPSecret string = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix Bの8桁のコードの下6桁
+	tests := []struct {
+		unixTime int64
+		want     string
+	}{
+		{unixTime: 59, want: "287082"},
+		{unixTime: 1111111109, want: "081804"},
+		{unixTime: 1111111111, want: "050471"},
+		{unixTime: 1234567890, want: "005924"},
+		{unixTime: 2000000000, want: "279037"},
+		{unixTime: 20000000000, want: "353130"},
+	}
+	for _, tt := range tests {
+		got, err := totpCode(testTOTPSecret, tt.unixTime/TOTPPeriod)
+		if err != nil {
+			t.Fatalf("totpCode(%d): %v", tt.unixTime, err)
+		}
+		if got != tt.want {
+			t.Errorf("totpCode(%d): want %s, got %s", tt.unixTime, tt.want, got)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	current := testRequestAt / TOTPPeriod
+	tests := []struct {
+		name     string
+		codeStep int64
+		lastStep int64
+		wantOK   bool
+	}{
+		{name: "現在のステップ", codeStep: current, lastStep: 0, wantOK: true},
+		{name: "1つ前のステップ", codeStep: current - 1, lastStep: 0, wantOK: true},
+		{name: "1つ後のステップ", codeStep: current + 1, lastStep: 0, wantOK: true},
+		{name: "2つ前のステップ", codeStep: current - 2, lastStep: 0, wantOK: false},
+		{name: "2つ後のステップ", codeStep: current + 2, lastStep: 0, wantOK: false},
+		{name: "使用済みのステップ", codeStep: current, lastStep: current, wantOK: false},
+		{name: "使用済みより前のステップ", codeStep: current - 1, lastStep: current, wantOK: false},
+		{name: "使用済みより後のステップ", codeStep: current + 1, lastStep: current, wantOK: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := totpCode(testTOTPSecret, tt.codeStep)
+			if err != nil {
+				t.Fatalf("totpCode: %v", err)
+			}
+			step, ok := verifyTOTP(testTOTPSecret, code, testRequestAt, tt.lastStep)
+			if ok != tt.wantOK {
+				t.Fatalf("verifyTOTP: want ok=%v, got %v", tt.wantOK, ok)
+			}
+			if ok && step != tt.codeStep {
+				t.Errorf("verifyTOTP: want step %d, got %d", tt.codeStep, step)
+			}
+		})
+	}
+}
+
+func TestVerifyTOTPInvalidCode(t *testing.T) {
+	code, err := totpCode(testTOTPSecret, testRequestAt/TOTPPeriod)
+	if err != nil {
+		t.Fatalf("totpCode: %v", err)
+	}
+	invalid := []byte(code)
+	invalid[0] = '0' + (invalid[0]-'0'+1)%10
+	if _, ok := verifyTOTP(testTOTPSecret, string(invalid), testRequestAt, 0); ok {
+		t.Errorf("verifyTOTP: accepted invalid code %s", invalid)
+	}
+}
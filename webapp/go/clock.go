@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ClockPolicy string
+
+const (
+	ClockPolicyTrust   ClockPolicy = "trust"   // x-isu-dateをそのまま信用する(ベンチマーク用)
+	ClockPolicyServer  ClockPolicy = "server"  // x-isu-dateを無視してサーバ時刻を使う
+	ClockPolicyBounded ClockPolicy = "bounded" // サーバ時刻との差が許容範囲内の場合のみx-isu-dateを使う
+)
+
+// parseClockPolicy 設定値から時刻ポリシーを取得する
+func parseClockPolicy(v string) (ClockPolicy, error) {
+	switch p := ClockPolicy(v); p {
+	case ClockPolicyTrust, ClockPolicyServer, ClockPolicyBounded:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid clock policy: %s", v)
+}
+
+// Clock サーバ時刻の取得元
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock OSの時刻をそのまま返すClock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// VirtualClock テスト用に進めることのできるClock
+type VirtualClock struct {
+	mu     sync.RWMutex
+	offset time.Duration
+}
+
+func (vc *VirtualClock) Now() time.Time {
+	vc.mu.RLock()
+	defer vc.mu.RUnlock()
+	return time.Now().Add(vc.offset)
+}
+
+// Advance 時刻を進める。巻き戻しはできない
+func (vc *VirtualClock) Advance(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("virtual clock cannot go backward")
+	}
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	vc.offset += d
+	return nil
+}
+
+// Offset 実時刻からの進み
+func (vc *VirtualClock) Offset() time.Duration {
+	vc.mu.RLock()
+	defer vc.mu.RUnlock()
+	return vc.offset
+}
+
+// resolveRequestTime 時刻ポリシーに従ってリクエスト時刻を決定する
+func (h *Handler) resolveRequestTime(c echo.Context) time.Time {
+	now := h.Clock.Now()
+	if h.ClockPolicy == ClockPolicyServer {
+		return now
+	}
+
+	header := c.Request().Header.Get("x-isu-date")
+	requestAt, err := time.Parse(time.RFC1123, header)
+	if err != nil {
+		return now
+	}
+
+	if h.ClockPolicy == ClockPolicyBounded {
+		diff := requestAt.Sub(now)
+		skew := time.Duration(h.ClockSkewSec) * time.Second
+		if diff > skew || diff < -skew {
+			c.Logger().Warnf("reject x-isu-date: header=%s, server=%s, skew=%s", header, now.Format(time.RFC1123), diff)
+			return now
+		}
+	}
+
+	return requestAt
+}
+
+// adminGetClock 仮想時計の確認
+// GET /admin/clock
+func (h *Handler) adminGetClock(c echo.Context) error {
+	vc, ok := h.Clock.(*VirtualClock)
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, fmt.Errorf("virtual clock is disabled"))
+	}
+
+	return successResponse(c, &AdminClockResponse{
+		Now:    vc.Now().Unix(),
+		Offset: int64(vc.Offset() / time.Second),
+	})
+}
+
+// adminAdvanceClock 仮想時計を進める
+// POST /admin/clock/advance
+func (h *Handler) adminAdvanceClock(c echo.Context) error {
+	vc, ok := h.Clock.(*VirtualClock)
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, fmt.Errorf("virtual clock is disabled"))
+	}
+
+	defer c.Request().Body.Close()
+	req := new(AdminAdvanceClockRequest)
+	if err := parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	if err := vc.Advance(time.Duration(req.Seconds) * time.Second); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+
+	return successResponse(c, &AdminClockResponse{
+		Now:    vc.Now().Unix(),
+		Offset: int64(vc.Offset() / time.Second),
+	})
+}
+
+type AdminAdvanceClockRequest struct {
+	Seconds int64 `json:"seconds"`
+}
+
+type AdminClockResponse struct {
+	Now    int64 `json:"now"`
+	Offset int64 `json:"offset"` // 実時刻からの進み(秒)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	GachaWeightTotal int64 = 10000 // 提供割合(weight)は万分率で設定する
+
+	GachaSimulationDefaultDraws   int64 = 10
+	GachaSimulationDefaultPlayers int64 = 1000
+	GachaSimulationMaxTotalDraws  int64 = 1000000 // 1回のシミュレーションで引く回数の上限
+
+	GachaSimulationSourceMaster string = "master"
+	GachaSimulationSourceDraft  string = "draft"
+
+	GachaSimulationDraftFormName string = "gachaItemMaster" // マスタ更新と同じフォーム名
+)
+
+// adminSimulateGacha ガチャの排出結果のシミュレーション
+// drawGachaと同じ抽選を行い、アイテムごとの排出数と1つ得るまでに必要なコインの期待値を返す
+// gachaItemMasterのCSVをアップロードした場合は、マスタの代わりにその中の対象ガチャの行を使う
+// POST /admin/gacha/{gachaID}/simulate
+func (h *Handler) adminSimulateGacha(c echo.Context) error {
+	gachaID, err := strconv.ParseInt(c.Param("gachaID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid gachaID"))
+	}
+
+	req, err := readSimulateGachaRequest(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.Draws < 1 || req.Players < 1 || req.Draws > GachaSimulationMaxTotalDraws/req.Players {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("draws and players must be positive and draws*players must be at most %d", GachaSimulationMaxTotalDraws))
+	}
+
+	source := GachaSimulationSourceMaster
+	gachaItemList := make([]*GachaItemMaster, 0)
+	if _, err = c.FormFile(GachaSimulationDraftFormName); err == nil {
+		source = GachaSimulationSourceDraft
+		table := findMasterTable(GachaSimulationDraftFormName)
+		records, err := readFormFileToCSV(c, GachaSimulationDraftFormName)
+		if err != nil {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+		upload, verrs := parseMasterCSV(table, records)
+		if len(verrs) > 0 {
+			return masterValidationErrorResponse(c, verrs)
+		}
+		for _, row := range upload.Rows {
+			if row.int("gacha_id") != gachaID {
+				continue
+			}
+			gachaItemList = append(gachaItemList, &GachaItemMaster{
+				ID:        row.int("id"),
+				GachaID:   row.int("gacha_id"),
+				ItemType:  int(row.int("item_type")),
+				ItemID:    row.int("item_id"),
+				Amount:    int(row.int("amount")),
+				Weight:    int(row.int("weight")),
+				CreatedAt: row.int("created_at"),
+			})
+		}
+		// drawGachaと同じくID順に抽選する
+		sort.Slice(gachaItemList, func(i, j int) bool { return gachaItemList[i].ID < gachaItemList[j].ID })
+	} else {
+		masters, err := h.masterData()
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if _, ok := masters.Gacha(gachaID); !ok {
+			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha"))
+		}
+		gachaItemList = masters.GachaItems(gachaID)
+	}
+	if len(gachaItemList) == 0 {
+		return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha item"))
+	}
+
+	var sum int64
+	for _, v := range gachaItemList {
+		sum += int64(v.Weight)
+	}
+	if sum <= 0 {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("total weight must be positive"))
+	}
+
+	seed := time.Now().UnixNano()
+	if req.Seed != nil {
+		seed = *req.Seed
+	}
+	res := simulateGacha(gachaItemList, sum, req.Draws, req.Players, rand.New(rand.NewSource(seed)))
+	res.GachaID = gachaID
+	res.Source = source
+	res.Seed = seed
+
+	return successResponse(c, res)
+}
+
+// simulateGacha プレイヤーごとにdraws回ずつガチャを引き、排出結果を集計する
+func simulateGacha(gachaItemList []*GachaItemMaster, sum, draws, players int64, rnd *rand.Rand) *AdminSimulateGachaResponse {
+	items := make([]*GachaSimulationItem, 0, len(gachaItemList))
+	index := make(map[*GachaItemMaster]int, len(gachaItemList))
+	for i, v := range gachaItemList {
+		index[v] = i
+		item := &GachaSimulationItem{
+			GachaItemMaster: v,
+			Probability:     float64(v.Weight) / float64(sum),
+		}
+		// 1つ得るまでに引く回数の期待値は確率の逆数
+		if v.Weight > 0 {
+			expected := float64(GachaDrawCoin) * float64(sum) / float64(v.Weight)
+			item.ExpectedCoins = &expected
+		}
+		items = append(items, item)
+	}
+
+	obtained := make([]bool, len(items))
+	for p := int64(0); p < players; p++ {
+		for i := range obtained {
+			obtained[i] = false
+		}
+		for d := int64(0); d < draws; d++ {
+			v := pickGachaItem(gachaItemList, rnd.Int63n(sum))
+			if v == nil {
+				continue
+			}
+			i := index[v]
+			items[i].Count++
+			obtained[i] = true
+		}
+		for i, ok := range obtained {
+			if ok {
+				items[i].PlayersObtained++
+			}
+		}
+	}
+
+	total := draws * players
+	for _, item := range items {
+		item.Rate = float64(item.Count) / float64(total)
+		if item.Count > 0 {
+			observed := float64(total*GachaDrawCoin) / float64(item.Count)
+			item.ObservedCoins = &observed
+		}
+	}
+
+	warnings := make([]string, 0)
+	if sum != GachaWeightTotal {
+		warnings = append(warnings, fmt.Sprintf("total weight is %d, expected %d", sum, GachaWeightTotal))
+	}
+	for _, v := range gachaItemList {
+		if v.Weight == 0 {
+			warnings = append(warnings, fmt.Sprintf("gacha item %d has weight 0 and is never drawn", v.ID))
+		}
+	}
+
+	return &AdminSimulateGachaResponse{
+		DrawsPerPlayer: draws,
+		Players:        players,
+		TotalDraws:     total,
+		TotalCoins:     total * GachaDrawCoin,
+		WeightSum:      sum,
+		Items:          items,
+		Warnings:       warnings,
+	}
+}
+
+// readSimulateGachaRequest JSONのボディ、またはドラフトのCSVをアップロードしたフォームからシミュレーションの条件を読み込む
+func readSimulateGachaRequest(c echo.Context) (*AdminSimulateGachaRequest, error) {
+	req := &AdminSimulateGachaRequest{
+		Draws:   GachaSimulationDefaultDraws,
+		Players: GachaSimulationDefaultPlayers,
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if mediaType != echo.MIMEMultipartForm {
+		defer c.Request().Body.Close()
+		if c.Request().ContentLength != 0 {
+			if err := parseRequestBody(c, req); err != nil {
+				return nil, err
+			}
+		}
+		return req, nil
+	}
+
+	for _, f := range []struct {
+		name string
+		dist *int64
+	}{
+		{"draws", &req.Draws},
+		{"players", &req.Players},
+	} {
+		if v := c.FormValue(f.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", f.name, v)
+			}
+			*f.dist = n
+		}
+	}
+	if v := c.FormValue("seed"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid seed: %s", v)
+		}
+		req.Seed = &n
+	}
+	return req, nil
+}
+
+type AdminSimulateGachaRequest struct {
+	Draws   int64  `json:"draws"`   // プレイヤーあたりの回数
+	Players int64  `json:"players"` // シミュレーションするプレイヤー数
+	Seed    *int64 `json:"seed"`    // 省略した場合は現在時刻
+}
+
+type AdminSimulateGachaResponse struct {
+	GachaID        int64                  `json:"gachaId"`
+	Source         string                 `json:"source"` // master: 現在のマスタ、draft: アップロードしたCSV
+	Seed           int64                  `json:"seed"`
+	DrawsPerPlayer int64                  `json:"drawsPerPlayer"`
+	Players        int64                  `json:"players"`
+	TotalDraws     int64                  `json:"totalDraws"`
+	TotalCoins     int64                  `json:"totalCoins"`
+	WeightSum      int64                  `json:"weightSum"`
+	Items          []*GachaSimulationItem `json:"items"`
+	Warnings       []string               `json:"warnings"`
+}
+
+type GachaSimulationItem struct {
+	*GachaItemMaster
+	Probability     float64  `json:"probability"`     // weightから求めた排出確率
+	Count           int64    `json:"count"`           // 排出数
+	Rate            float64  `json:"rate"`            // 排出数から求めた排出率
+	PlayersObtained int64    `json:"playersObtained"` // 1つ以上得たプレイヤー数
+	ExpectedCoins   *float64 `json:"expectedCoins"`   // 1つ得るまでに消費するコインの期待値。weightが0の場合はnull
+	ObservedCoins   *float64 `json:"observedCoins"`   // シミュレーションで1つあたりに消費したコイン。排出されなかった場合はnull
+}
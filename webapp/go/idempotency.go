@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	ErrIdempotencyKeyInProgress error = fmt.Errorf("request with the same idempotency key is in progress")
+	ErrIdempotencyKeyMismatch   error = fmt.Errorf("idempotency key is already used for another request")
+	ErrIdempotencyKeyFailed     error = fmt.Errorf("response for the idempotency key could not be stored")
+)
+
+const (
+	IdempotencyKeyHeader      string        = "Idempotency-Key"
+	IdempotencyReplayedHeader string        = "Idempotent-Replayed"
+	IdempotencyKeyMaxLength   int           = 255
+	IdempotencyLockTimeout    int64         = 30
+	IdempotencyPollInterval   time.Duration = 50 * time.Millisecond
+	IdempotencySweepBatchSize int           = 1000
+
+	IdempotencyStatusInProgress int = 0  // 処理中
+	IdempotencyStatusFailed     int = -1 // 処理は完了したがレスポンスを保存できなかった
+)
+
+// idempotencyMiddleware Idempotency-Keyヘッダ付きの更新リクエストのレスポンスを保存し、再送時に再生するmiddleware
+func (h *Handler) idempotencyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(IdempotencyKeyHeader)
+		if key == "" || c.Request().Method != http.MethodPost {
+			return next(c)
+		}
+		if len(key) > IdempotencyKeyMaxLength {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("idempotency key is too long"))
+		}
+
+		userID, err := getUserID(c)
+		if err != nil {
+			return errorResponse(c, http.StatusBadRequest, err)
+		}
+
+		// ボディは後続のハンドラでも読むため読み直せるようにしておく
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return errorResponse(c, http.StatusBadRequest, ErrInvalidRequestBody)
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+		requestHash := hashIdempotentRequest(c.Request().Method, c.Request().URL.Path, body)
+
+		stored, err := h.acquireIdempotencyKey(userID, key, requestHash)
+		if err != nil {
+			if err == ErrIdempotencyKeyInProgress || err == ErrIdempotencyKeyFailed {
+				return errorResponse(c, http.StatusConflict, err)
+			}
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+
+		// 保存済みのレスポンスを再生する
+		if stored != nil {
+			if stored.RequestHash != requestHash {
+				return errorResponse(c, http.StatusUnprocessableEntity, ErrIdempotencyKeyMismatch)
+			}
+			c.Response().Header().Set(IdempotencyReplayedHeader, "true")
+			return c.Blob(stored.StatusCode, echo.MIMEApplicationJSONCharsetUTF8, stored.ResponseBody)
+		}
+
+		recorder := &idempotencyResponseRecorder{ResponseWriter: c.Response().Writer, body: new(bytes.Buffer)}
+		c.Response().Writer = recorder
+
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		// サーバエラーは再送で回復しうるため保存せず、キーを解放する
+		status := c.Response().Status
+		if status >= http.StatusInternalServerError {
+			h.releaseIdempotencyKey(c, userID, key)
+			return nil
+		}
+
+		query := "UPDATE user_idempotency_keys SET status_code=?, response_body=?, updated_at=? WHERE user_id=? AND idempotency_key=?"
+		if _, err := h.DB.Exec(query, status, recorder.body.Bytes(), h.Clock.Now().Unix(), userID, key); err != nil {
+			// 処理は完了しているため、キーを解放すると再送で二重に実行される。失敗として残し、再送を拒否する
+			c.Logger().Errorf("failed to store idempotent response: %v", err)
+			query = "UPDATE user_idempotency_keys SET status_code=?, updated_at=? WHERE user_id=? AND idempotency_key=?"
+			if _, err := h.DB.Exec(query, IdempotencyStatusFailed, h.Clock.Now().Unix(), userID, key); err != nil {
+				c.Logger().Errorf("failed to mark idempotency key as failed: %v", err)
+			}
+		}
+		return nil
+	}
+}
+
+// releaseIdempotencyKey 処理中の冪等キーを解放し、同じキーで再送できるようにする
+func (h *Handler) releaseIdempotencyKey(c echo.Context, userID int64, key string) {
+	query := "DELETE FROM user_idempotency_keys WHERE user_id=? AND idempotency_key=?"
+	if _, err := h.DB.Exec(query, userID, key); err != nil {
+		c.Logger().Errorf("failed to release idempotency key: %v", err)
+	}
+}
+
+// acquireIdempotencyKey 冪等キーを確保する。処理済みのキーであれば保存済みのレスポンスを返す
+// 同じキーのリクエストが処理中の場合は完了するまで待つ
+// ロックと有効期限はクライアントが指定するx-isu-dateではなくサーバ時刻で判定する
+func (h *Handler) acquireIdempotencyKey(userID int64, key, requestHash string) (*UserIdempotencyKey, error) {
+	deadline := h.Clock.Now().Add(time.Duration(IdempotencyLockTimeout) * time.Second)
+	for {
+		now := h.Clock.Now().Unix()
+		query := "INSERT INTO user_idempotency_keys(user_id, idempotency_key, request_hash, status_code, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+		_, err := h.DB.Exec(query, userID, key, requestHash, IdempotencyStatusInProgress, now, now, now+h.IdempotencyKeyTTL)
+		if err == nil {
+			return nil, nil
+		}
+		if merr, ok := err.(*mysql.MySQLError); !ok || merr.Number != 1062 {
+			return nil, err
+		}
+
+		stored := new(UserIdempotencyKey)
+		query = "SELECT * FROM user_idempotency_keys WHERE user_id=? AND idempotency_key=?"
+		if err := h.DB.Get(stored, query, userID, key); err != nil {
+			if err == sql.ErrNoRows {
+				// 確認までの間に解放された
+				continue
+			}
+			return nil, err
+		}
+
+		// 期限切れのキー、または処理が途中で放棄されたキーは作り直す
+		if stored.ExpiredAt < now || (stored.StatusCode == IdempotencyStatusInProgress && stored.UpdatedAt+IdempotencyLockTimeout < now) {
+			query = "DELETE FROM user_idempotency_keys WHERE user_id=? AND idempotency_key=? AND updated_at=?"
+			if _, err := h.DB.Exec(query, userID, key, stored.UpdatedAt); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if stored.StatusCode == IdempotencyStatusFailed {
+			return nil, ErrIdempotencyKeyFailed
+		}
+		if stored.StatusCode != IdempotencyStatusInProgress {
+			return stored, nil
+		}
+
+		if h.Clock.Now().After(deadline) {
+			return nil, ErrIdempotencyKeyInProgress
+		}
+		time.Sleep(IdempotencyPollInterval)
+	}
+}
+
+// runIdempotencyKeySweeper 有効期限を過ぎた冪等キーを一定間隔で削除する
+func (h *Handler) runIdempotencyKeySweeper(logger echo.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			query := "DELETE FROM user_idempotency_keys WHERE expired_at<? LIMIT ?"
+			res, err := h.DB.Exec(query, h.Clock.Now().Unix(), IdempotencySweepBatchSize)
+			if err != nil {
+				logger.Errorf("failed to sweep idempotency keys: %v", err)
+				break
+			}
+			if n, err := res.RowsAffected(); err != nil || n < int64(IdempotencySweepBatchSize) {
+				break
+			}
+		}
+	}
+}
+
+// hashIdempotentRequest 冪等キーの使い回しを検出するためのリクエストのハッシュを作成する
+func hashIdempotentRequest(method, path string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// idempotencyResponseRecorder レスポンスボディを記録するためのWriter
+type idempotencyResponseRecorder struct {
+	http.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *idempotencyResponseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+type UserIdempotencyKey struct {
+	UserID         int64  `db:"user_id"`
+	IdempotencyKey string `db:"idempotency_key"`
+	RequestHash    string `db:"request_hash"`
+	StatusCode     int    `db:"status_code"`
+	ResponseBody   []byte `db:"response_body"`
+	CreatedAt      int64  `db:"created_at"`
+	UpdatedAt      int64  `db:"updated_at"`
+	ExpiredAt      int64  `db:"expired_at"`
+}
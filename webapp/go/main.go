@@ -13,7 +13,6 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
@@ -39,14 +38,30 @@ var (
 )
 
 const (
-	DeckCardNumber      int = 3
-	PresentCountPerPage int = 100
+	DeckCardNumber      int   = 3
+	PresentCountPerPage int   = 100
+	GachaDrawCoin       int64 = 1000 // ガチャ1回あたりの消費コイン
 
 	SQLDirectory string = "../sql/"
 )
 
 type Handler struct {
-	DB *sqlx.DB
+	DB   *sqlx.DB
+	Repo Repository // ユーザ向けAPIのデータの保存先
+
+	IdempotencyKeyTTL        int64 // 冪等キーの保存期間(秒)
+	RewardMaxAccumulationSec int64 // 放置報酬を蓄積できる最大時間(秒)。0の場合は上限なし
+
+	Clock        Clock       // サーバ時刻の取得元
+	ClockPolicy  ClockPolicy // x-isu-dateの扱い
+	ClockSkewSec int64       // boundedの場合に許容するサーバ時刻との差(秒)
+
+	RateLimits     map[string]*RateLimitConfig // ルートグループごとのレート制限設定
+	RateLimitStore RateLimitStore              // nilの場合はレート制限を行わない
+
+	AdminLockoutThreshold int64 // 管理者アカウントをロックするログインの連続失敗回数。0の場合はロックしない
+
+	Masters *MasterCache // マスタデータのキャッシュ
 }
 
 func main() {
@@ -59,7 +74,7 @@ func main() {
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins: []string{"*"},
 		AllowMethods: []string{http.MethodGet, http.MethodPost},
-		AllowHeaders: []string{"Content-Type", "x-master-version", "x-session"},
+		AllowHeaders: []string{"Content-Type", "x-master-version", "x-session", IdempotencyKeyHeader},
 	}))
 
 	dbx, err := connectDB(false)
@@ -68,22 +83,59 @@ func main() {
 	}
 	defer dbx.Close()
 
+	clockPolicy, err := parseClockPolicy(getEnv("ISUCON_CLOCK_POLICY", string(ClockPolicyTrust)))
+	if err != nil {
+		e.Logger.Fatalf("failed to load config: %v", err)
+	}
+	rateLimits, err := loadRateLimitConfigs()
+	if err != nil {
+		e.Logger.Fatalf("failed to load config: %v", err)
+	}
+	rateLimitStore, err := newRateLimitStore(getEnv("ISUCON_RATE_LIMIT_BACKEND", ""), dbx)
+	if err != nil {
+		e.Logger.Fatalf("failed to load config: %v", err)
+	}
+	// nginxなど前段のプロキシからのX-Forwarded-Forだけを信頼する
+	if e.IPExtractor, err = newIPExtractor(getEnv("ISUCON_TRUSTED_PROXIES", "127.0.0.1/32,::1/128")); err != nil {
+		e.Logger.Fatalf("failed to load config: %v", err)
+	}
+	var clock Clock = systemClock{}
+	if getEnv("ISUCON_VIRTUAL_CLOCK", "") == "1" {
+		clock = new(VirtualClock)
+	}
+
+	repo := NewMySQLRepository(dbx)
+
 	e.Server.Addr = fmt.Sprintf(":%v", "8080")
 	h := &Handler{
-		DB: dbx,
+		DB:                       dbx,
+		Repo:                     repo,
+		IdempotencyKeyTTL:        getEnvInt("ISUCON_IDEMPOTENCY_KEY_TTL", 86400),
+		RewardMaxAccumulationSec: getEnvInt("ISUCON_REWARD_MAX_ACCUMULATION_SEC", 0),
+		Clock:                    clock,
+		ClockPolicy:              clockPolicy,
+		ClockSkewSec:             getEnvInt("ISUCON_CLOCK_SKEW_SEC", 300),
+		RateLimits:               rateLimits,
+		RateLimitStore:           rateLimitStore,
+		AdminLockoutThreshold:    getEnvInt("ISUCON_ADMIN_LOCKOUT_THRESHOLD", 10),
+		Masters:                  NewMasterCache(repo),
+	}
+	// 初期データの投入前に起動した場合は、最初にマスタを参照した時点で読み込む
+	if _, err = h.Masters.Reload(); err != nil {
+		e.Logger.Errorf("failed to load master cache: %v", err)
 	}
 
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{}))
 
 	// utility
-	e.POST("/initialize", initialize)
+	e.POST("/initialize", h.initialize)
 	e.GET("/health", h.health)
 
 	// feature
 	API := e.Group("", h.apiMiddleware)
-	API.POST("/user", h.createUser)
-	API.POST("/login", h.login)
-	sessCheckAPI := API.Group("", h.checkSessionMiddleware)
+	API.POST("/user", h.createUser, h.rateLimitMiddleware(RateLimitGroupAuth))
+	API.POST("/login", h.login, h.rateLimitMiddleware(RateLimitGroupAuth))
+	sessCheckAPI := API.Group("", h.checkSessionMiddleware, h.rateLimitMiddleware(RateLimitGroupUser), h.idempotencyMiddleware)
 	sessCheckAPI.GET("/user/:userID/gacha/index", h.listGacha)
 	sessCheckAPI.POST("/user/:userID/gacha/draw/:gachaID/:n", h.drawGacha)
 	sessCheckAPI.GET("/user/:userID/present/index/:n", h.listPresent)
@@ -95,14 +147,55 @@ func main() {
 	sessCheckAPI.GET("/user/:userID/home", h.home)
 
 	// admin
-	adminAPI := e.Group("", h.adminMiddleware)
+	adminAPI := e.Group("", h.adminMiddleware, h.adminAuditMiddleware, h.rateLimitMiddleware(RateLimitGroupAdmin))
 	adminAPI.POST("/admin/login", h.adminLogin)
+	adminAPI.POST("/admin/login/2fa", h.adminLoginTOTP)
 	adminAuthAPI := adminAPI.Group("", h.adminSessionCheckMiddleware)
 	adminAuthAPI.DELETE("/admin/logout", h.adminLogout)
-	adminAuthAPI.GET("/admin/master", h.adminListMaster)
-	adminAuthAPI.PUT("/admin/master", h.adminUpdateMaster)
-	adminAuthAPI.GET("/admin/user/:userID", h.adminUser)
-	adminAuthAPI.POST("/admin/user/:userID/ban", h.adminBanUser)
+	adminAuthAPI.PUT("/admin/password", h.adminChangePassword)
+	adminAuthAPI.POST("/admin/2fa/enroll", h.adminEnrollTOTP)
+	adminAuthAPI.POST("/admin/2fa/verify", h.adminVerifyTOTP)
+	adminAuthAPI.POST("/admin/2fa/disable", h.adminDisableTOTP)
+	adminAuthAPI.GET("/admin/audit", h.adminListAuditLogs, h.requireAdminPermission(AdminPermissionAuditRead))
+	adminAuthAPI.GET("/admin/admins", h.adminListAdminUsers, h.requireAdminPermission(AdminPermissionAdminManage))
+	adminAuthAPI.POST("/admin/admins", h.adminCreateAdminUser, h.requireAdminPermission(AdminPermissionAdminManage))
+	adminAuthAPI.DELETE("/admin/admins/:adminID", h.adminDeleteAdminUser, h.requireAdminPermission(AdminPermissionAdminManage))
+	adminAuthAPI.POST("/admin/admins/:adminID/disable", h.adminDisableAdminUser, h.requireAdminPermission(AdminPermissionAdminManage))
+	adminAuthAPI.POST("/admin/admins/:adminID/enable", h.adminEnableAdminUser, h.requireAdminPermission(AdminPermissionAdminManage))
+	adminAuthAPI.POST("/admin/admins/:adminID/password", h.adminResetAdminUserPassword, h.requireAdminPermission(AdminPermissionAdminManage))
+	adminAuthAPI.POST("/admin/admins/:adminID/unlock", h.adminUnlockAdminUser, h.requireAdminPermission(AdminPermissionAdminManage))
+	adminAuthAPI.GET("/admin/master", h.adminListMaster, h.requireAdminPermission(AdminPermissionMasterRead))
+	adminAuthAPI.PUT("/admin/master", h.adminUpdateMaster, h.requireAdminPermission(AdminPermissionMasterWrite))
+	adminAuthAPI.POST("/admin/gacha/:gachaID/simulate", h.adminSimulateGacha, h.requireAdminPermission(AdminPermissionMasterRead))
+	adminAuthAPI.GET("/admin/master/export", h.adminExportMaster, h.requireAdminPermission(AdminPermissionMasterRead))
+	adminAuthAPI.GET("/admin/master/versions", h.adminListMasterVersions, h.requireAdminPermission(AdminPermissionMasterRead))
+	adminAuthAPI.POST("/admin/master/rollback/:versionID", h.adminRollbackMaster, h.requireAdminPermission(AdminPermissionMasterWrite))
+	adminAuthAPI.GET("/admin/master/releases", h.adminListMasterReleases, h.requireAdminPermission(AdminPermissionMasterRead))
+	adminAuthAPI.POST("/admin/master/releases", h.adminScheduleMasterRelease, h.requireAdminPermission(AdminPermissionMasterWrite))
+	adminAuthAPI.PUT("/admin/master/releases/:releaseID", h.adminRescheduleMasterRelease, h.requireAdminPermission(AdminPermissionMasterWrite))
+	adminAuthAPI.DELETE("/admin/master/releases/:releaseID", h.adminCancelMasterRelease, h.requireAdminPermission(AdminPermissionMasterWrite))
+	adminAuthAPI.GET("/admin/present/segments", h.adminListPresentSegments, h.requireAdminPermission(AdminPermissionMasterRead))
+	adminAuthAPI.POST("/admin/present/segments", h.adminCreatePresentSegment, h.requireAdminPermission(AdminPermissionMasterWrite))
+	adminAuthAPI.GET("/admin/stats", h.adminGetStats, h.requireAdminPermission(AdminPermissionStatsRead))
+	adminAuthAPI.GET("/admin/users", h.adminSearchUsers, h.requireAdminPermission(AdminPermissionUserRead))
+	adminAuthAPI.POST("/admin/users/ban", h.adminBulkBanUsers, h.requireAdminPermission(AdminPermissionUserBan))
+	adminAuthAPI.POST("/admin/users/unban", h.adminBulkUnbanUsers, h.requireAdminPermission(AdminPermissionUserBan))
+	adminAuthAPI.GET("/admin/user/:userID", h.adminUser, h.requireAdminPermission(AdminPermissionUserRead))
+	adminAuthAPI.GET("/admin/user/:userID/export", h.adminExportUser, h.requireAdminPermission(AdminPermissionUserPrivacy))
+	adminAuthAPI.POST("/admin/user/:userID/erase", h.adminEraseUser, h.requireAdminPermission(AdminPermissionUserPrivacy))
+	adminAuthAPI.POST("/admin/user/:userID/ban", h.adminBanUser, h.requireAdminPermission(AdminPermissionUserBan))
+	adminAuthAPI.POST("/admin/user/:userID/unban", h.adminUnbanUser, h.requireAdminPermission(AdminPermissionUserBan))
+	adminAuthAPI.POST("/admin/user/:userID/grant", h.adminGrantUserItem, h.requireAdminPermission(AdminPermissionUserInventory))
+	adminAuthAPI.POST("/admin/user/:userID/revoke", h.adminRevokeUserItem, h.requireAdminPermission(AdminPermissionUserInventory))
+	if _, ok := h.Clock.(*VirtualClock); ok {
+		adminAuthAPI.GET("/admin/clock", h.adminGetClock, h.requireAdminPermission(AdminPermissionSystem))
+		adminAuthAPI.POST("/admin/clock/advance", h.adminAdvanceClock, h.requireAdminPermission(AdminPermissionSystem))
+	}
+
+	go h.runMasterReleaseScheduler(e.Logger, time.Duration(getEnvInt("ISUCON_MASTER_RELEASE_INTERVAL_SEC", 10))*time.Second)
+	go h.runMasterCachePoller(e.Logger, time.Duration(getEnvInt("ISUCON_MASTER_CACHE_POLL_INTERVAL_SEC", 5))*time.Second)
+	go h.runIdempotencyKeySweeper(e.Logger, time.Duration(getEnvInt("ISUCON_IDEMPOTENCY_SWEEP_INTERVAL_SEC", 300))*time.Second)
+	go h.runStatsRollup(e.Logger, time.Duration(getEnvInt("ISUCON_STATS_ROLLUP_INTERVAL_SEC", 60))*time.Second)
 
 	e.Logger.Infof("Start server: address=%s", e.Server.Addr)
 	e.Logger.Error(e.StartServer(e.Server))
@@ -130,7 +223,7 @@ func connectDB(batch bool) (*sqlx.DB, error) {
 // adminMiddleware 管理者ツール向けのmiddleware
 func (h *Handler) adminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		requestAt := time.Now()
+		requestAt := h.Clock.Now()
 		c.Set("requestTime", requestAt.Unix())
 
 		// next
@@ -144,35 +237,31 @@ func (h *Handler) adminMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 // apiMiddleware　ユーザ向けAPI向けのmiddleware
 func (h *Handler) apiMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		requestAt, err := time.Parse(time.RFC1123, c.Request().Header.Get("x-isu-date"))
-		if err != nil {
-			requestAt = time.Now()
-		}
+		requestAt := h.resolveRequestTime(c)
 		c.Set("requestTime", requestAt.Unix())
 
 		// 有効なマスタデータか確認
-		query := "SELECT * FROM version_masters WHERE status=1"
-		masterVersion := new(VersionMaster)
-		if err := h.DB.Get(masterVersion, query); err != nil {
-			if err == sql.ErrNoRows {
-				return errorResponse(c, http.StatusNotFound, fmt.Errorf("active master version is not found"))
+		masters, err := h.masterData()
+		if err != nil {
+			if err == ErrActiveMasterVersionNotFound {
+				return errorResponse(c, http.StatusNotFound, err)
 			}
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
 
-		if masterVersion.MasterVersion != c.Request().Header.Get("x-master-version") {
+		if masters.Version.MasterVersion != c.Request().Header.Get("x-master-version") {
 			return errorResponse(c, http.StatusUnprocessableEntity, ErrInvalidMasterVersion)
 		}
 
 		// BANユーザ確認
 		userID, err := getUserID(c)
 		if err == nil && userID != 0 {
-			isBan, err := h.checkBan(userID)
+			ban, err := h.checkBan(userID, requestAt.Unix())
 			if err != nil {
 				return errorResponse(c, http.StatusInternalServerError, err)
 			}
-			if isBan {
-				return errorResponse(c, http.StatusForbidden, ErrForbidden)
+			if ban != nil {
+				return banErrorResponse(c, ban)
 			}
 		}
 
@@ -201,9 +290,8 @@ func (h *Handler) checkSessionMiddleware(next echo.HandlerFunc) echo.HandlerFunc
 			return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 		}
 
-		userSession := new(Session)
-		query := "SELECT * FROM user_sessions WHERE session_id=? AND deleted_at IS NULL"
-		if err := h.DB.Get(userSession, query, sessID); err != nil {
+		userSession, err := h.Repo.GetSession(sessID)
+		if err != nil {
 			if err == sql.ErrNoRows {
 				return errorResponse(c, http.StatusUnauthorized, ErrUnauthorized)
 			}
@@ -216,8 +304,7 @@ func (h *Handler) checkSessionMiddleware(next echo.HandlerFunc) echo.HandlerFunc
 
 		// 期限切れチェック
 		if userSession.ExpiredAt < requestAt {
-			query = "UPDATE user_sessions SET deleted_at=? WHERE session_id=?"
-			if _, err = h.DB.Exec(query, requestAt, sessID); err != nil {
+			if err = h.Repo.DeleteSession(sessID, requestAt); err != nil {
 				return errorResponse(c, http.StatusInternalServerError, err)
 			}
 			return errorResponse(c, http.StatusUnauthorized, ErrExpiredSession)
@@ -232,9 +319,8 @@ func (h *Handler) checkSessionMiddleware(next echo.HandlerFunc) echo.HandlerFunc
 
 // checkOneTimeToken ワンタイムトークンの確認用middleware
 func (h *Handler) checkOneTimeToken(token string, tokenType int, requestAt int64) error {
-	tk := new(UserOneTimeToken)
-	query := "SELECT * FROM user_one_time_tokens WHERE token=? AND token_type=? AND deleted_at IS NULL"
-	if err := h.DB.Get(tk, query, token, tokenType); err != nil {
+	tk, err := h.Repo.GetOneTimeToken(token, tokenType)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return ErrInvalidToken
 		}
@@ -242,16 +328,14 @@ func (h *Handler) checkOneTimeToken(token string, tokenType int, requestAt int64
 	}
 
 	if tk.ExpiredAt < requestAt {
-		query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE token=?"
-		if _, err := h.DB.Exec(query, requestAt, token); err != nil {
+		if err = h.Repo.DeleteOneTimeToken(token, requestAt); err != nil {
 			return err
 		}
 		return ErrInvalidToken
 	}
 
 	// 使ったトークンは失効する
-	query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE token=?"
-	if _, err := h.DB.Exec(query, requestAt, token); err != nil {
+	if err = h.Repo.DeleteOneTimeToken(token, requestAt); err != nil {
 		return err
 	}
 
@@ -260,9 +344,7 @@ func (h *Handler) checkOneTimeToken(token string, tokenType int, requestAt int64
 
 // checkViewerID viewerIDとplatformの確認を行う
 func (h *Handler) checkViewerID(userID int64, viewerID string) error {
-	query := "SELECT * FROM user_devices WHERE user_id=? AND platform_id=?"
-	device := new(UserDevice)
-	if err := h.DB.Get(device, query, userID, viewerID); err != nil {
+	if _, err := h.Repo.GetUserDevice(userID, viewerID); err != nil {
 		if err == sql.ErrNoRows {
 			return ErrUserDeviceNotFound
 		}
@@ -272,17 +354,17 @@ func (h *Handler) checkViewerID(userID int64, viewerID string) error {
 	return nil
 }
 
-// checkBan BANされているユーザでかを確認する
-func (h *Handler) checkBan(userID int64) (bool, error) {
-	banUser := new(UserBan)
-	query := "SELECT * FROM user_bans WHERE user_id=?"
-	if err := h.DB.Get(banUser, query, userID); err != nil {
+// checkBan BANされているユーザでかを確認する。有効なBANがあればそれを返す
+// 解除済み、期限切れのBANは無視する
+func (h *Handler) checkBan(userID int64, requestAt int64) (*UserBan, error) {
+	banUser, err := h.Repo.GetActiveUserBan(userID, requestAt)
+	if err != nil {
 		if err == sql.ErrNoRows {
-			return false, nil
+			return nil, nil
 		}
-		return false, err
+		return nil, err
 	}
-	return true, nil
+	return banUser, nil
 }
 
 // getRequestTime リクエストを受けた時間をコンテキストからunix timeで取得する
@@ -295,10 +377,9 @@ func getRequestTime(c echo.Context) (int64, error) {
 }
 
 // loginProcess ログイン処理
-func (h *Handler) loginProcess(tx *sqlx.Tx, userID int64, requestAt int64) (*User, []*UserLoginBonus, []*UserPresent, error) {
-	user := new(User)
-	query := "SELECT * FROM users WHERE id=?"
-	if err := tx.Get(user, query, userID); err != nil {
+func (h *Handler) loginProcess(tx Repositories, userID int64, requestAt int64) (*User, []*UserLoginBonus, []*UserPresent, error) {
+	user, err := tx.GetUser(userID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil, nil, ErrUserNotFound
 		}
@@ -317,18 +398,23 @@ func (h *Handler) loginProcess(tx *sqlx.Tx, userID int64, requestAt int64) (*Use
 		return nil, nil, nil, err
 	}
 
-	if err = tx.Get(&user.IsuCoin, "SELECT isu_coin FROM users WHERE id=?", user.ID); err != nil {
+	current, err := tx.GetUser(user.ID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil, nil, ErrUserNotFound
 		}
 		return nil, nil, nil, err
 	}
+	user.IsuCoin = current.IsuCoin
 
 	user.UpdatedAt = requestAt
 	user.LastActivatedAt = requestAt
 
-	query = "UPDATE users SET updated_at=?, last_activated_at=? WHERE id=?"
-	if _, err := tx.Exec(query, requestAt, requestAt, userID); err != nil {
+	if err = tx.UpdateUserLastActivatedAt(userID, requestAt); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if err = tx.InsertStatsEvent(&StatsEvent{EventType: StatsEventLogin, UserID: userID, CreatedAt: requestAt}); err != nil {
 		return nil, nil, nil, err
 	}
 
@@ -343,20 +429,19 @@ func isCompleteTodayLogin(lastActivatedAt, requestAt time.Time) bool {
 }
 
 // obtainLoginBonus ログインボーナス付与
-func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) ([]*UserLoginBonus, error) {
-	loginBonuses := make([]*LoginBonusMaster, 0)
-	query := "SELECT * FROM login_bonus_masters WHERE start_at <= ? AND end_at >= ?"
-	if err := tx.Select(&loginBonuses, query, requestAt, requestAt); err != nil {
+func (h *Handler) obtainLoginBonus(tx Repositories, userID int64, requestAt int64) ([]*UserLoginBonus, error) {
+	masters, err := h.masterData()
+	if err != nil {
 		return nil, err
 	}
+	loginBonuses := masters.ActiveLoginBonuses(requestAt)
 
 	sendLoginBonuses := make([]*UserLoginBonus, 0)
 
 	for _, bonus := range loginBonuses {
 		initBonus := false
-		userBonus := new(UserLoginBonus)
-		query = "SELECT * FROM user_login_bonuses WHERE user_id=? AND login_bonus_id=?"
-		if err := tx.Get(userBonus, query, userID, bonus.ID); err != nil {
+		userBonus, err := tx.GetUserLoginBonus(userID, bonus.ID)
+		if err != nil {
 			if err != sql.ErrNoRows {
 				return nil, err
 			}
@@ -392,29 +477,23 @@ func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) (
 		userBonus.UpdatedAt = requestAt
 
 		// 付与するリソース取得
-		rewardItem := new(LoginBonusRewardMaster)
-		query = "SELECT * FROM login_bonus_reward_masters WHERE login_bonus_id=? AND reward_sequence=?"
-		if err := tx.Get(rewardItem, query, bonus.ID, userBonus.LastRewardSequence); err != nil {
-			if err == sql.ErrNoRows {
-				return nil, ErrLoginBonusRewardNotFound
-			}
-			return nil, err
+		rewardItem, ok := masters.LoginBonusReward(bonus.ID, userBonus.LastRewardSequence)
+		if !ok {
+			return nil, ErrLoginBonusRewardNotFound
 		}
 
-		_, _, _, err := h.obtainItem(tx, userID, rewardItem.ItemID, rewardItem.ItemType, rewardItem.Amount, requestAt)
+		_, _, _, err = h.obtainItem(tx, userID, rewardItem.ItemID, rewardItem.ItemType, rewardItem.Amount, requestAt)
 		if err != nil {
 			return nil, err
 		}
 
 		// 進捗の保存
 		if initBonus {
-			query = "INSERT INTO user_login_bonuses(id, user_id, login_bonus_id, last_reward_sequence, loop_count, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-			if _, err = tx.Exec(query, userBonus.ID, userBonus.UserID, userBonus.LoginBonusID, userBonus.LastRewardSequence, userBonus.LoopCount, userBonus.CreatedAt, userBonus.UpdatedAt); err != nil {
+			if err = tx.InsertUserLoginBonus(userBonus); err != nil {
 				return nil, err
 			}
 		} else {
-			query = "UPDATE user_login_bonuses SET last_reward_sequence=?, loop_count=?, updated_at=? WHERE id=?"
-			if _, err = tx.Exec(query, userBonus.LastRewardSequence, userBonus.LoopCount, userBonus.UpdatedAt, userBonus.ID); err != nil {
+			if err = tx.UpdateUserLoginBonus(userBonus); err != nil {
 				return nil, err
 			}
 		}
@@ -426,25 +505,33 @@ func (h *Handler) obtainLoginBonus(tx *sqlx.Tx, userID int64, requestAt int64) (
 }
 
 // obtainPresent プレゼント付与
-func (h *Handler) obtainPresent(tx *sqlx.Tx, userID int64, requestAt int64) ([]*UserPresent, error) {
-	normalPresents := make([]*PresentAllMaster, 0)
-	query := "SELECT * FROM present_all_masters WHERE registered_start_at <= ? AND registered_end_at >= ?"
-	if err := tx.Select(&normalPresents, query, requestAt, requestAt); err != nil {
+func (h *Handler) obtainPresent(tx Repositories, userID int64, requestAt int64) ([]*UserPresent, error) {
+	masters, err := h.masterData()
+	if err != nil {
 		return nil, err
 	}
+	normalPresents := masters.ActivePresentAlls(requestAt)
 
 	obtainPresents := make([]*UserPresent, 0)
+	target := newPresentAllTargetUser(tx, masters, userID)
 	for _, np := range normalPresents {
-		received := new(UserPresentAllReceivedHistory)
-		query = "SELECT * FROM user_present_all_received_history WHERE user_id=? AND present_all_id=?"
-		err := tx.Get(received, query, userID, np.ID)
-		if err == nil {
-			// プレゼント配布済
+		ok, err := target.match(&np.PresentAllTarget)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// 配布対象外
 			continue
 		}
-		if err != sql.ErrNoRows {
+
+		received, err := tx.ExistsPresentAllReceivedHistory(userID, np.ID)
+		if err != nil {
 			return nil, err
 		}
+		if received {
+			// プレゼント配布済
+			continue
+		}
 
 		pID, err := h.generateID()
 		if err != nil {
@@ -461,8 +548,7 @@ func (h *Handler) obtainPresent(tx *sqlx.Tx, userID int64, requestAt int64) ([]*
 			CreatedAt:      requestAt,
 			UpdatedAt:      requestAt,
 		}
-		query = "INSERT INTO user_presents(id, user_id, sent_at, item_type, item_id, amount, present_message, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
-		if _, err := tx.Exec(query, up.ID, up.UserID, up.SentAt, up.ItemType, up.ItemID, up.Amount, up.PresentMessage, up.CreatedAt, up.UpdatedAt); err != nil {
+		if err = tx.InsertUserPresent(up); err != nil {
 			return nil, err
 		}
 
@@ -478,16 +564,7 @@ func (h *Handler) obtainPresent(tx *sqlx.Tx, userID int64, requestAt int64) ([]*
 			CreatedAt:    requestAt,
 			UpdatedAt:    requestAt,
 		}
-		query = "INSERT INTO user_present_all_received_history(id, user_id, present_all_id, received_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)"
-		if _, err := tx.Exec(
-			query,
-			history.ID,
-			history.UserID,
-			history.PresentAllID,
-			history.ReceivedAt,
-			history.CreatedAt,
-			history.UpdatedAt,
-		); err != nil {
+		if err = tx.InsertPresentAllReceivedHistory(history); err != nil {
 			return nil, err
 		}
 
@@ -498,38 +575,36 @@ func (h *Handler) obtainPresent(tx *sqlx.Tx, userID int64, requestAt int64) ([]*
 }
 
 // obtainItem アイテム付与処理
-func (h *Handler) obtainItem(tx *sqlx.Tx, userID, itemID int64, itemType int, obtainAmount int64, requestAt int64) ([]int64, []*UserCard, []*UserItem, error) {
+func (h *Handler) obtainItem(tx Repositories, userID, itemID int64, itemType int, obtainAmount int64, requestAt int64) ([]int64, []*UserCard, []*UserItem, error) {
 	obtainCoins := make([]int64, 0)
 	obtainCards := make([]*UserCard, 0)
 	obtainItems := make([]*UserItem, 0)
 
 	switch itemType {
 	case 1: // coin
-		user := new(User)
-		query := "SELECT * FROM users WHERE id=?"
-		if err := tx.Get(user, query, userID); err != nil {
+		user, err := tx.GetUser(userID)
+		if err != nil {
 			if err == sql.ErrNoRows {
 				return nil, nil, nil, ErrUserNotFound
 			}
 			return nil, nil, nil, err
 		}
 
-		query = "UPDATE users SET isu_coin=? WHERE id=?"
 		totalCoin := user.IsuCoin + obtainAmount
-		if _, err := tx.Exec(query, totalCoin, user.ID); err != nil {
+		if err = tx.UpdateUserCoin(user.ID, totalCoin); err != nil {
 			return nil, nil, nil, err
 		}
 		obtainCoins = append(obtainCoins, obtainAmount)
 
 	case 2: // card(ハンマー)
-		query := "SELECT * FROM item_masters WHERE id=? AND item_type=?"
-		item := new(ItemMaster)
-		if err := tx.Get(item, query, itemID, itemType); err != nil {
-			if err == sql.ErrNoRows {
-				return nil, nil, nil, ErrItemNotFound
-			}
+		masters, err := h.masterData()
+		if err != nil {
 			return nil, nil, nil, err
 		}
+		item, ok := masters.Item(itemID, itemType)
+		if !ok {
+			return nil, nil, nil, ErrItemNotFound
+		}
 
 		cID, err := h.generateID()
 		if err != nil {
@@ -545,25 +620,23 @@ func (h *Handler) obtainItem(tx *sqlx.Tx, userID, itemID int64, itemType int, ob
 			CreatedAt:    requestAt,
 			UpdatedAt:    requestAt,
 		}
-		query = "INSERT INTO user_cards(id, user_id, card_id, amount_per_sec, level, total_exp, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
-		if _, err := tx.Exec(query, card.ID, card.UserID, card.CardID, card.AmountPerSec, card.Level, card.TotalExp, card.CreatedAt, card.UpdatedAt); err != nil {
+		if err = tx.InsertUserCard(card); err != nil {
 			return nil, nil, nil, err
 		}
 		obtainCards = append(obtainCards, card)
 
 	case 3, 4: // 強化素材
-		query := "SELECT * FROM item_masters WHERE id=? AND item_type=?"
-		item := new(ItemMaster)
-		if err := tx.Get(item, query, itemID, itemType); err != nil {
-			if err == sql.ErrNoRows {
-				return nil, nil, nil, ErrItemNotFound
-			}
+		masters, err := h.masterData()
+		if err != nil {
 			return nil, nil, nil, err
 		}
+		item, ok := masters.Item(itemID, itemType)
+		if !ok {
+			return nil, nil, nil, ErrItemNotFound
+		}
 
-		query = "SELECT * FROM user_items WHERE user_id=? AND item_id=?"
-		uitem := new(UserItem)
-		if err := tx.Get(uitem, query, userID, item.ID); err != nil {
+		uitem, err := tx.GetUserItemByItemID(userID, item.ID)
+		if err != nil {
 			if err != sql.ErrNoRows {
 				return nil, nil, nil, err
 			}
@@ -584,16 +657,14 @@ func (h *Handler) obtainItem(tx *sqlx.Tx, userID, itemID int64, itemType int, ob
 				CreatedAt: requestAt,
 				UpdatedAt: requestAt,
 			}
-			query = "INSERT INTO user_items(id, user_id, item_id, item_type, amount, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-			if _, err := tx.Exec(query, uitem.ID, userID, uitem.ItemID, uitem.ItemType, uitem.Amount, requestAt, requestAt); err != nil {
+			if err = tx.InsertUserItem(uitem); err != nil {
 				return nil, nil, nil, err
 			}
 
 		} else {
 			uitem.Amount += int(obtainAmount)
 			uitem.UpdatedAt = requestAt
-			query = "UPDATE user_items SET amount=?, updated_at=? WHERE id=?"
-			if _, err := tx.Exec(query, uitem.Amount, uitem.UpdatedAt, uitem.ID); err != nil {
+			if err = tx.UpdateUserItemAmount(uitem.ID, uitem.Amount, uitem.UpdatedAt); err != nil {
 				return nil, nil, nil, err
 			}
 		}
@@ -609,7 +680,7 @@ func (h *Handler) obtainItem(tx *sqlx.Tx, userID, itemID int64, itemType int, ob
 
 // initialize 初期化処理
 // POST /initialize
-func initialize(c echo.Context) error {
+func (h *Handler) initialize(c echo.Context) error {
 	dbx, err := connectDB(true)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
@@ -621,6 +692,7 @@ func initialize(c echo.Context) error {
 		c.Logger().Errorf("Failed to initialize %s: %v", string(out), err)
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	h.reloadMasterCache(c.Logger())
 
 	return successResponse(c, &InitializeResponse{
 		Language: "go",
@@ -649,7 +721,7 @@ func (h *Handler) createUser(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	tx, err := h.DB.Beginx()
+	tx, err := h.Repo.Begin()
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
@@ -669,8 +741,7 @@ func (h *Handler) createUser(c echo.Context) error {
 		CreatedAt:       requestAt,
 		UpdatedAt:       requestAt,
 	}
-	query := "INSERT INTO users(id, last_activated_at, registered_at, last_getreward_at, created_at, updated_at) VALUES(?, ?, ?, ?, ?, ?)"
-	if _, err = tx.Exec(query, user.ID, user.LastActivatedAt, user.RegisteredAt, user.LastGetRewardAt, user.CreatedAt, user.UpdatedAt); err != nil {
+	if err = tx.InsertUser(user); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -686,21 +757,24 @@ func (h *Handler) createUser(c echo.Context) error {
 		CreatedAt:    requestAt,
 		UpdatedAt:    requestAt,
 	}
-	query = "INSERT INTO user_devices(id, user_id, platform_id, platform_type, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)"
-	_, err = tx.Exec(query, userDevice.ID, user.ID, req.ViewerID, req.PlatformType, requestAt, requestAt)
+	if err = tx.InsertUserDevice(userDevice); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.InsertStatsEvent(&StatsEvent{EventType: StatsEventRegister, UserID: user.ID, PlatformType: &req.PlatformType, CreatedAt: requestAt})
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	// 初期デッキ付与
-	initCard := new(ItemMaster)
-	query = "SELECT * FROM item_masters WHERE id=?"
-	if err = tx.Get(initCard, query, 2); err != nil {
-		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, ErrItemNotFound)
-		}
+	masters, err := h.masterData()
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	initCard, ok := masters.Item(2, 0)
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, ErrItemNotFound)
+	}
 
 	initCards := make([]*UserCard, 0, 3)
 	for i := 0; i < 3; i++ {
@@ -718,8 +792,7 @@ func (h *Handler) createUser(c echo.Context) error {
 			CreatedAt:    requestAt,
 			UpdatedAt:    requestAt,
 		}
-		query = "INSERT INTO user_cards(id, user_id, card_id, amount_per_sec, level, total_exp, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
-		if _, err := tx.Exec(query, card.ID, card.UserID, card.CardID, card.AmountPerSec, card.Level, card.TotalExp, card.CreatedAt, card.UpdatedAt); err != nil {
+		if err := tx.InsertUserCard(card); err != nil {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
 		initCards = append(initCards, card)
@@ -738,8 +811,7 @@ func (h *Handler) createUser(c echo.Context) error {
 		CreatedAt: requestAt,
 		UpdatedAt: requestAt,
 	}
-	query = "INSERT INTO user_decks(id, user_id, user_card_id_1, user_card_id_2, user_card_id_3, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-	if _, err := tx.Exec(query, initDeck.ID, initDeck.UserID, initDeck.CardID1, initDeck.CardID2, initDeck.CardID3, initDeck.CreatedAt, initDeck.UpdatedAt); err != nil {
+	if err := tx.InsertUserDeck(initDeck); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -772,8 +844,7 @@ func (h *Handler) createUser(c echo.Context) error {
 		UpdatedAt: requestAt,
 		ExpiredAt: requestAt + 86400,
 	}
-	query = "INSERT INTO user_sessions(id, user_id, session_id, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?)"
-	if _, err = tx.Exec(query, sess.ID, sess.UserID, sess.SessionID, sess.CreatedAt, sess.UpdatedAt, sess.ExpiredAt); err != nil {
+	if err = tx.InsertSession(sess); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -818,21 +889,20 @@ func (h *Handler) login(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	user := new(User)
-	query := "SELECT * FROM users WHERE id=?"
-	if err := h.DB.Get(user, query, req.UserID); err != nil {
+	user, err := h.Repo.GetUser(req.UserID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	isBan, err := h.checkBan(user.ID)
+	ban, err := h.checkBan(user.ID, requestAt)
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
-	if isBan {
-		return errorResponse(c, http.StatusForbidden, ErrForbidden)
+	if ban != nil {
+		return banErrorResponse(c, ban)
 	}
 
 	if err = h.checkViewerID(user.ID, req.ViewerID); err != nil {
@@ -842,14 +912,13 @@ func (h *Handler) login(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	tx, err := h.DB.Beginx()
+	tx, err := h.Repo.Begin()
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 	defer tx.Rollback() //nolint:errcheck
 
-	query = "UPDATE user_sessions SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
-	if _, err = tx.Exec(query, requestAt, req.UserID); err != nil {
+	if err = tx.DeleteUserSessions(req.UserID, requestAt); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 	sID, err := h.generateID()
@@ -868,8 +937,7 @@ func (h *Handler) login(c echo.Context) error {
 		UpdatedAt: requestAt,
 		ExpiredAt: requestAt + 86400,
 	}
-	query = "INSERT INTO user_sessions(id, user_id, session_id, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?)"
-	if _, err = tx.Exec(query, sess.ID, sess.UserID, sess.SessionID, sess.CreatedAt, sess.UpdatedAt, sess.ExpiredAt); err != nil {
+	if err = tx.InsertSession(sess); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -878,8 +946,7 @@ func (h *Handler) login(c echo.Context) error {
 		user.UpdatedAt = requestAt
 		user.LastActivatedAt = requestAt
 
-		query = "UPDATE users SET updated_at=?, last_activated_at=? WHERE id=?"
-		if _, err := tx.Exec(query, requestAt, requestAt, req.UserID); err != nil {
+		if err := tx.UpdateUserLastActivatedAt(req.UserID, requestAt); err != nil {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
 
@@ -942,12 +1009,11 @@ func (h *Handler) listGacha(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	gachaMasterList := []*GachaMaster{}
-	query := "SELECT * FROM gacha_masters WHERE start_at <= ? AND end_at >= ? ORDER BY display_order ASC"
-	err = h.DB.Select(&gachaMasterList, query, requestAt, requestAt)
+	masters, err := h.masterData()
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	gachaMasterList := masters.ActiveGachas(requestAt)
 
 	if len(gachaMasterList) == 0 {
 		return successResponse(c, &ListGachaResponse{
@@ -956,14 +1022,8 @@ func (h *Handler) listGacha(c echo.Context) error {
 	}
 
 	gachaDataList := make([]*GachaData, 0)
-	query = "SELECT * FROM gacha_item_masters WHERE gacha_id=? ORDER BY id ASC"
 	for _, v := range gachaMasterList {
-		var gachaItem []*GachaItemMaster
-		err = h.DB.Select(&gachaItem, query, v.ID)
-		if err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
-
+		gachaItem := masters.GachaItems(v.ID)
 		if len(gachaItem) == 0 {
 			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha item"))
 		}
@@ -975,8 +1035,7 @@ func (h *Handler) listGacha(c echo.Context) error {
 	}
 
 	// ガチャ実行用のワンタイムトークンの発行
-	query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
-	if _, err = h.DB.Exec(query, requestAt, userID); err != nil {
+	if err = h.Repo.DeleteUserOneTimeTokens(userID, requestAt); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 	tID, err := h.generateID()
@@ -996,8 +1055,7 @@ func (h *Handler) listGacha(c echo.Context) error {
 		UpdatedAt: requestAt,
 		ExpiredAt: requestAt + 600,
 	}
-	query = "INSERT INTO user_one_time_tokens(id, user_id, token, token_type, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-	if _, err = h.DB.Exec(query, token.ID, token.UserID, token.Token, token.TokenType, token.CreatedAt, token.UpdatedAt, token.ExpiredAt); err != nil {
+	if err = h.Repo.InsertOneTimeToken(token); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -1025,8 +1083,8 @@ func (h *Handler) drawGacha(c echo.Context) error {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
 
-	gachaID := c.Param("gachaID")
-	if gachaID == "" {
+	gachaID, err := strconv.ParseInt(c.Param("gachaID"), 10, 64)
+	if err != nil {
 		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid gachaID"))
 	}
 
@@ -1063,11 +1121,10 @@ func (h *Handler) drawGacha(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	consumedCoin := int64(gachaCount * 1000)
+	consumedCoin := gachaCount * GachaDrawCoin
 
-	user := new(User)
-	query := "SELECT * FROM users WHERE id=?"
-	if err := h.DB.Get(user, query, userID); err != nil {
+	user, err := h.Repo.GetUser(userID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
 		}
@@ -1077,49 +1134,32 @@ func (h *Handler) drawGacha(c echo.Context) error {
 		return errorResponse(c, http.StatusConflict, fmt.Errorf("not enough isucon"))
 	}
 
-	query = "SELECT * FROM gacha_masters WHERE id=? AND start_at <= ? AND end_at >= ?"
-	gachaInfo := new(GachaMaster)
-	if err = h.DB.Get(gachaInfo, query, gachaID, requestAt, requestAt); err != nil {
-		if sql.ErrNoRows == err {
-			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha"))
-		}
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
-
-	gachaItemList := make([]*GachaItemMaster, 0)
-	err = h.DB.Select(&gachaItemList, "SELECT * FROM gacha_item_masters WHERE gacha_id=? ORDER BY id ASC", gachaID)
+	masters, err := h.masterData()
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	gachaInfo, ok := masters.Gacha(gachaID)
+	if !ok || gachaInfo.StartAt > requestAt || gachaInfo.EndAt < requestAt {
+		return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha"))
+	}
+
+	gachaItemList := masters.GachaItems(gachaID)
 	if len(gachaItemList) == 0 {
 		return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found gacha item"))
 	}
 
 	// ガチャ提供割合(weight)の合計値を算出
-	var sum int64
-	err = h.DB.Get(&sum, "SELECT SUM(weight) FROM gacha_item_masters WHERE gacha_id=?", gachaID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return errorResponse(c, http.StatusNotFound, err)
-		}
-		return errorResponse(c, http.StatusInternalServerError, err)
-	}
+	sum := masters.GachaWeightSum(gachaID)
 
 	// random値の導出 & 抽選
 	result := make([]*GachaItemMaster, 0, gachaCount)
 	for i := 0; i < int(gachaCount); i++ {
-		random := rand.Int63n(sum)
-		boundary := 0
-		for _, v := range gachaItemList {
-			boundary += v.Weight
-			if random < int64(boundary) {
-				result = append(result, v)
-				break
-			}
+		if v := pickGachaItem(gachaItemList, rand.Int63n(sum)); v != nil {
+			result = append(result, v)
 		}
 	}
 
-	tx, err := h.DB.Beginx()
+	tx, err := h.Repo.Begin()
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
@@ -1143,17 +1183,20 @@ func (h *Handler) drawGacha(c echo.Context) error {
 			CreatedAt:      requestAt,
 			UpdatedAt:      requestAt,
 		}
-		query = "INSERT INTO user_presents(id, user_id, sent_at, item_type, item_id, amount, present_message, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
-		if _, err := tx.Exec(query, present.ID, present.UserID, present.SentAt, present.ItemType, present.ItemID, present.Amount, present.PresentMessage, present.CreatedAt, present.UpdatedAt); err != nil {
+		if err := tx.InsertUserPresent(present); err != nil {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
 
 		presents = append(presents, present)
 	}
 
-	query = "UPDATE users SET isu_coin=? WHERE id=?"
 	totalCoin := user.IsuCoin - consumedCoin
-	if _, err := tx.Exec(query, totalCoin, user.ID); err != nil {
+	if err := tx.UpdateUserCoin(user.ID, totalCoin); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.InsertStatsEvent(&StatsEvent{EventType: StatsEventGacha, UserID: user.ID, GachaID: &gachaInfo.ID, Draws: gachaCount, Coins: consumedCoin, CreatedAt: requestAt})
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -1167,6 +1210,18 @@ func (h *Handler) drawGacha(c echo.Context) error {
 	})
 }
 
+// pickGachaItem random値(0以上、提供割合(weight)の合計未満)に対応するガチャアイテムを返す
+func pickGachaItem(gachaItemList []*GachaItemMaster, random int64) *GachaItemMaster {
+	boundary := 0
+	for _, v := range gachaItemList {
+		boundary += v.Weight
+		if random < int64(boundary) {
+			return v
+		}
+	}
+	return nil
+}
+
 type DrawGachaRequest struct {
 	ViewerID     string `json:"viewerId"`
 	OneTimeToken string `json:"oneTimeToken"`
@@ -1193,18 +1248,13 @@ func (h *Handler) listPresent(c echo.Context) error {
 	}
 
 	offset := PresentCountPerPage * (n - 1)
-	presentList := []*UserPresent{}
-	query := `
-	SELECT * FROM user_presents 
-	WHERE user_id = ? AND deleted_at IS NULL
-	ORDER BY created_at DESC, id
-	LIMIT ? OFFSET ?`
-	if err = h.DB.Select(&presentList, query, userID, PresentCountPerPage, offset); err != nil {
+	presentList, err := h.Repo.ListUserPresents(userID, PresentCountPerPage, offset)
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	var presentCount int
-	if err = h.DB.Get(&presentCount, "SELECT COUNT(*) FROM user_presents WHERE user_id = ? AND deleted_at IS NULL", userID); err != nil {
+	presentCount, err := h.Repo.CountUserPresents(userID)
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -1255,15 +1305,10 @@ func (h *Handler) receivePresent(c echo.Context) error {
 	}
 
 	// 未取得のプレゼント取得
-	query := "SELECT * FROM user_presents WHERE id IN (?) AND deleted_at IS NULL"
-	query, params, err := sqlx.In(query, req.PresentIDs)
+	obtainPresent, err := h.Repo.ListUserPresentsByIDs(req.PresentIDs)
 	if err != nil {
 		return errorResponse(c, http.StatusBadRequest, err)
 	}
-	obtainPresent := []*UserPresent{}
-	if err = h.DB.Select(&obtainPresent, query, params...); err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
-	}
 
 	if len(obtainPresent) == 0 {
 		return successResponse(c, &ReceivePresentResponse{
@@ -1271,7 +1316,7 @@ func (h *Handler) receivePresent(c echo.Context) error {
 		})
 	}
 
-	tx, err := h.DB.Beginx()
+	tx, err := h.Repo.Begin()
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
@@ -1286,8 +1331,7 @@ func (h *Handler) receivePresent(c echo.Context) error {
 		obtainPresent[i].UpdatedAt = requestAt
 		obtainPresent[i].DeletedAt = &requestAt
 		v := obtainPresent[i]
-		query = "UPDATE user_presents SET deleted_at=?, updated_at=? WHERE id=?"
-		_, err := tx.Exec(query, requestAt, requestAt, v.ID)
+		err := tx.DeleteUserPresent(v.ID, requestAt)
 		if err != nil {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
@@ -1336,30 +1380,26 @@ func (h *Handler) listItem(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	user := new(User)
-	query := "SELECT * FROM users WHERE id=?"
-	if err = h.DB.Get(user, query, userID); err != nil {
+	user, err := h.Repo.GetUser(userID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	itemList := []*UserItem{}
-	query = "SELECT * FROM user_items WHERE user_id = ?"
-	if err = h.DB.Select(&itemList, query, userID); err != nil {
+	itemList, err := h.Repo.ListUserItems(userID)
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	cardList := make([]*UserCard, 0)
-	query = "SELECT * FROM user_cards WHERE user_id=?"
-	if err = h.DB.Select(&cardList, query, userID); err != nil {
+	cardList, err := h.Repo.ListUserCards(userID)
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	// アイテムの強化に使うためのワンタイムトークンを発行
-	query = "UPDATE user_one_time_tokens SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
-	if _, err = h.DB.Exec(query, requestAt, userID); err != nil {
+	if err = h.Repo.DeleteUserOneTimeTokens(userID, requestAt); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 	tID, err := h.generateID()
@@ -1379,8 +1419,7 @@ func (h *Handler) listItem(c echo.Context) error {
 		UpdatedAt: requestAt,
 		ExpiredAt: requestAt + 600,
 	}
-	query = "INSERT INTO user_one_time_tokens(id, user_id, token, token_type, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-	if _, err = h.DB.Exec(query, token.ID, token.UserID, token.Token, token.TokenType, token.CreatedAt, token.UpdatedAt, token.ExpiredAt); err != nil {
+	if err = h.Repo.InsertOneTimeToken(token); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -1438,39 +1477,42 @@ func (h *Handler) addExpToCard(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	card := new(TargetUserCardData)
-	query := `
-	SELECT uc.id , uc.user_id , uc.card_id , uc.amount_per_sec , uc.level, uc.total_exp, im.amount_per_sec as 'base_amount_per_sec', im.max_level , im.max_amount_per_sec , im.base_exp_per_level
-	FROM user_cards as uc
-	INNER JOIN item_masters as im ON uc.card_id = im.id
-	WHERE uc.id = ? AND uc.user_id=?
-	`
-	if err = h.DB.Get(card, query, cardID, userID); err != nil {
+	masters, err := h.masterData()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	userCard, err := h.Repo.GetUserCard(userID, cardID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, err)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
+	cardMaster, ok := masters.Item(userCard.CardID, 0)
+	if !ok {
+		return errorResponse(c, http.StatusNotFound, sql.ErrNoRows)
+	}
+	card := newTargetUserCardData(userCard, cardMaster)
 
 	if card.Level == card.MaxLevel {
 		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("target card is max level"))
 	}
 
 	items := make([]*ConsumeUserItemData, 0)
-	query = `
-	SELECT ui.id, ui.user_id, ui.item_id, ui.item_type, ui.amount, ui.created_at, ui.updated_at, im.gained_exp
-	FROM user_items as ui
-	INNER JOIN item_masters as im ON ui.item_id = im.id
-	WHERE ui.item_type = 3 AND ui.id=? AND ui.user_id=?
-	`
 	for _, v := range req.Items {
-		item := new(ConsumeUserItemData)
-		if err = h.DB.Get(item, query, v.ID, userID); err != nil {
+		userItem, err := h.Repo.GetUserItem(userID, v.ID)
+		if err != nil {
 			if err == sql.ErrNoRows {
 				return errorResponse(c, http.StatusNotFound, err)
 			}
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
+		itemMaster, ok := masters.Item(userItem.ItemID, 0)
+		if userItem.ItemType != 3 || !ok {
+			return errorResponse(c, http.StatusNotFound, sql.ErrNoRows)
+		}
+		item := newConsumeUserItemData(userItem, itemMaster)
 
 		if v.Amount > item.Amount {
 			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("item not enough"))
@@ -1495,28 +1537,29 @@ func (h *Handler) addExpToCard(c echo.Context) error {
 		card.AmountPerSec += (card.MaxAmountPerSec - card.BaseAmountPerSec) / (card.MaxLevel - 1)
 	}
 
-	tx, err := h.DB.Beginx()
+	tx, err := h.Repo.Begin()
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	defer tx.Rollback() //nolint:errcheck
 
-	query = "UPDATE user_cards SET amount_per_sec=?, level=?, total_exp=?, updated_at=? WHERE id=?"
-	if _, err = tx.Exec(query, card.AmountPerSec, card.Level, card.TotalExp, requestAt, card.ID); err != nil {
+	userCard.AmountPerSec = card.AmountPerSec
+	userCard.Level = card.Level
+	userCard.TotalExp = int64(card.TotalExp)
+	userCard.UpdatedAt = requestAt
+	if err = tx.UpdateUserCard(userCard); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	query = "UPDATE user_items SET amount=?, updated_at=? WHERE id=?"
 	for _, v := range items {
-		if _, err = tx.Exec(query, v.Amount-v.ConsumeAmount, requestAt, v.ID); err != nil {
+		if err = tx.UpdateUserItemAmount(v.ID, v.Amount-v.ConsumeAmount, requestAt); err != nil {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
 	}
 
-	resultCard := new(UserCard)
-	query = "SELECT * FROM user_cards WHERE id=?"
-	if err = tx.Get(resultCard, query, card.ID); err != nil {
+	resultCard, err := tx.GetUserCard(userID, card.ID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, fmt.Errorf("not found card"))
 		}
@@ -1586,6 +1629,44 @@ type TargetUserCardData struct {
 	BaseExpPerLevel  int   `db:"base_exp_per_level"`
 }
 
+// newTargetUserCardData ユーザのカードに強化計算用のマスタの値を付ける
+func newTargetUserCardData(card *UserCard, master *ItemMaster) *TargetUserCardData {
+	return &TargetUserCardData{
+		ID:               card.ID,
+		UserID:           card.UserID,
+		CardID:           card.CardID,
+		AmountPerSec:     card.AmountPerSec,
+		Level:            card.Level,
+		TotalExp:         int(card.TotalExp),
+		BaseAmountPerSec: intValue(master.AmountPerSec),
+		MaxLevel:         intValue(master.MaxLevel),
+		MaxAmountPerSec:  intValue(master.MaxAmountPerSec),
+		BaseExpPerLevel:  intValue(master.BaseExpPerLevel),
+	}
+}
+
+// newConsumeUserItemData 消費するアイテムに獲得経験値を付ける
+func newConsumeUserItemData(item *UserItem, master *ItemMaster) *ConsumeUserItemData {
+	return &ConsumeUserItemData{
+		ID:        item.ID,
+		UserID:    item.UserID,
+		ItemID:    item.ItemID,
+		ItemType:  item.ItemType,
+		Amount:    item.Amount,
+		CreatedAt: item.CreatedAt,
+		UpdatedAt: item.UpdatedAt,
+		GainedExp: intValue(master.GainedExp),
+	}
+}
+
+// intValue マスタのNULLを許容する列を0として扱う
+func intValue(v *int) int {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
 // updateDeck 装備変更
 // POST /user/{userID}/card
 func (h *Handler) updateDeck(c echo.Context) error {
@@ -1616,28 +1697,22 @@ func (h *Handler) updateDeck(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	query := "SELECT * FROM user_cards WHERE id IN (?)"
-	query, params, err := sqlx.In(query, req.CardIDs)
+	cards, err := h.Repo.ListUserCardsByIDs(req.CardIDs)
 	if err != nil {
-		return errorResponse(c, http.StatusBadRequest, err)
-	}
-	cards := make([]*UserCard, 0)
-	if err = h.DB.Select(&cards, query, params...); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 	if len(cards) != DeckCardNumber {
 		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid card ids"))
 	}
 
-	tx, err := h.DB.Beginx()
+	tx, err := h.Repo.Begin()
 	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
 	defer tx.Rollback() //nolint:errcheck
 
-	query = "UPDATE user_decks SET updated_at=?, deleted_at=? WHERE user_id=? AND deleted_at IS NULL"
-	if _, err = tx.Exec(query, requestAt, requestAt, userID); err != nil {
+	if err = tx.DeleteUserDecks(userID, requestAt); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -1654,8 +1729,7 @@ func (h *Handler) updateDeck(c echo.Context) error {
 		CreatedAt: requestAt,
 		UpdatedAt: requestAt,
 	}
-	query = "INSERT INTO user_decks(id, user_id, user_card_id_1, user_card_id_2, user_card_id_3, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
-	if _, err := tx.Exec(query, newDeck.ID, newDeck.UserID, newDeck.CardID1, newDeck.CardID2, newDeck.CardID3, newDeck.CreatedAt, newDeck.UpdatedAt); err != nil {
+	if err := tx.InsertUserDeck(newDeck); err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -1704,41 +1778,62 @@ func (h *Handler) reward(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	user := new(User)
-	query := "SELECT * FROM users WHERE id=?"
-	if err = h.DB.Get(user, query, userID); err != nil {
+	user, err := h.Repo.GetUser(userID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	deck := new(UserDeck)
-	query = "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL"
-	if err = h.DB.Get(deck, query, userID); err != nil {
+	deck, err := h.Repo.GetUserDeck(userID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, err)
 		}
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
-	cards := make([]*UserCard, 0)
-	query = "SELECT * FROM user_cards WHERE id IN (?, ?, ?)"
-	if err = h.DB.Select(&cards, query, deck.CardID1, deck.CardID2, deck.CardID3); err != nil {
+	cards, err := h.Repo.ListUserCardsByIDs([]int64{deck.CardID1, deck.CardID2, deck.CardID3})
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 	if len(cards) != 3 {
 		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid cards length"))
 	}
 
-	pastTime := requestAt - user.LastGetRewardAt
-	getCoin := int(pastTime) * (cards[0].AmountPerSec + cards[1].AmountPerSec + cards[2].AmountPerSec)
+	// 蓄積上限とブーストイベントを考慮して報酬を算出
+	startAt := h.rewardStartAt(user.LastGetRewardAt, requestAt)
+	boosts, err := h.getRewardBoosts(startAt, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	amountPerSec := int64(cards[0].AmountPerSec + cards[1].AmountPerSec + cards[2].AmountPerSec)
+	getCoin := calcRewardCoin(startAt, requestAt, amountPerSec, boosts)
 
-	user.IsuCoin += int64(getCoin)
+	user.IsuCoin += getCoin
 	user.LastGetRewardAt = requestAt
 
-	query = "UPDATE users SET isu_coin=?, last_getreward_at=? WHERE id=?"
-	if _, err = h.DB.Exec(query, user.IsuCoin, user.LastGetRewardAt, user.ID); err != nil {
+	// 集計用のイベントとコインの更新を同じトランザクションで記録する
+	tx, err := h.Repo.Begin()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if err = tx.UpdateUserReward(user.ID, user.IsuCoin, user.LastGetRewardAt); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	if getCoin > 0 {
+		err = tx.InsertStatsEvent(&StatsEvent{EventType: StatsEventReward, UserID: user.ID, Coins: getCoin, CreatedAt: requestAt})
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
 		return errorResponse(c, http.StatusInternalServerError, err)
 	}
 
@@ -1768,9 +1863,8 @@ func (h *Handler) home(c echo.Context) error {
 		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
 	}
 
-	deck := new(UserDeck)
-	query := "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL"
-	if err = h.DB.Get(deck, query, userID); err != nil {
+	deck, err := h.Repo.GetUserDeck(userID)
+	if err != nil {
 		if err != sql.ErrNoRows {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
@@ -1780,22 +1874,18 @@ func (h *Handler) home(c echo.Context) error {
 	cards := make([]*UserCard, 0)
 	if deck != nil {
 		cardIds := []int64{deck.CardID1, deck.CardID2, deck.CardID3}
-		query, params, err := sqlx.In("SELECT * FROM user_cards WHERE id IN (?)", cardIds)
+		cards, err = h.Repo.ListUserCardsByIDs(cardIds)
 		if err != nil {
 			return errorResponse(c, http.StatusInternalServerError, err)
 		}
-		if err = h.DB.Select(&cards, query, params...); err != nil {
-			return errorResponse(c, http.StatusInternalServerError, err)
-		}
 	}
 	totalAmountPerSec := 0
 	for _, v := range cards {
 		totalAmountPerSec += v.AmountPerSec
 	}
 
-	user := new(User)
-	query = "SELECT * FROM users WHERE id=?"
-	if err = h.DB.Get(user, query, userID); err != nil {
+	user, err := h.Repo.GetUser(userID)
+	if err != nil {
 		if err == sql.ErrNoRows {
 			return errorResponse(c, http.StatusNotFound, ErrUserNotFound)
 		}
@@ -1803,21 +1893,35 @@ func (h *Handler) home(c echo.Context) error {
 	}
 	pastTime := requestAt - user.LastGetRewardAt
 
+	// rewardで受け取れる報酬の見込み
+	startAt := h.rewardStartAt(user.LastGetRewardAt, requestAt)
+	boosts, err := h.getRewardBoosts(startAt, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	rewardCoin := calcRewardCoin(startAt, requestAt, int64(totalAmountPerSec), boosts)
+
 	return successResponse(c, &HomeResponse{
 		Now:               requestAt,
 		User:              user,
 		Deck:              deck,
 		TotalAmountPerSec: totalAmountPerSec,
 		PastTime:          pastTime,
+		RewardPastTime:    requestAt - startAt,
+		RewardCoin:        rewardCoin,
+		RewardBoosts:      boosts,
 	})
 }
 
 type HomeResponse struct {
-	Now               int64     `json:"now"`
-	User              *User     `json:"user"`
-	Deck              *UserDeck `json:"deck,omitempty"`
-	TotalAmountPerSec int       `json:"totalAmountPerSec"`
-	PastTime          int64     `json:"pastTime"` // 経過時間を秒単位で
+	Now               int64                `json:"now"`
+	User              *User                `json:"user"`
+	Deck              *UserDeck            `json:"deck,omitempty"`
+	TotalAmountPerSec int                  `json:"totalAmountPerSec"`
+	PastTime          int64                `json:"pastTime"`       // 経過時間を秒単位で
+	RewardPastTime    int64                `json:"rewardPastTime"` // 蓄積上限を考慮した報酬対象の経過時間を秒単位で
+	RewardCoin        int64                `json:"rewardCoin"`     // 現時点でrewardを受け取った場合の獲得ISU-COIN
+	RewardBoosts      []*RewardBoostMaster `json:"rewardBoosts"`   // 報酬対象期間中のブーストイベント
 }
 
 // //////////////////////////////////////
@@ -1841,6 +1945,23 @@ func errorResponse(c echo.Context, statusCode int, err error) error {
 	})
 }
 
+// banErrorResponse BANされたユーザ向けのエラーレスポンス。クライアントで表示できるよう理由と期限を含める
+func banErrorResponse(c echo.Context, ban *UserBan) error {
+	c.Logger().Errorf("status=%d, err=%+v", http.StatusForbidden, errors.WithStack(ErrForbidden))
+
+	return c.JSON(http.StatusForbidden, struct {
+		StatusCode int    `json:"status_code"`
+		Message    string `json:"message"`
+		Reason     string `json:"reason"`
+		ExpiredAt  *int64 `json:"expiredAt"`
+	}{
+		StatusCode: http.StatusForbidden,
+		Message:    ErrForbidden.Error(),
+		Reason:     ban.Reason,
+		ExpiredAt:  ban.ExpiredAt,
+	})
+}
+
 // successResponse 成功時のレスポンス
 func successResponse(c echo.Context, v interface{}) error {
 	return c.JSON(http.StatusOK, v)
@@ -1853,25 +1974,7 @@ func noContentResponse(c echo.Context, status int) error {
 
 // generateID ユニークなIDを生成する
 func (h *Handler) generateID() (int64, error) {
-	var updateErr error
-	for i := 0; i < 100; i++ {
-		res, err := h.DB.Exec("UPDATE id_generator SET id=LAST_INSERT_ID(id+1)")
-		if err != nil {
-			if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1213 {
-				updateErr = err
-				continue
-			}
-			return 0, err
-		}
-
-		id, err := res.LastInsertId()
-		if err != nil {
-			return 0, err
-		}
-		return id, nil
-	}
-
-	return 0, fmt.Errorf("failed to generate id: %w", updateErr)
+	return h.Repo.GenerateID()
 }
 
 // generateUUID UUIDの生成
@@ -1898,6 +2001,15 @@ func getEnv(key, defaultVal string) string {
 	}
 }
 
+// getEnvInt 環境変数から整数値を取得する
+func getEnvInt(key string, defaultVal int64) int64 {
+	v, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil {
+		return defaultVal
+	}
+	return v
+}
+
 // parseRequestBody リクエストボディをパースする
 func parseRequestBody(c echo.Context, dist interface{}) error {
 	buf, err := io.ReadAll(c.Request().Body)
@@ -1970,11 +2082,14 @@ type UserDevice struct {
 }
 
 type UserBan struct {
-	ID        int64  `db:"id"`
-	UserID    int64  `db:"user_id"`
-	CreatedAt int64  `db:"created_at"`
-	UpdatedAt int64  `db:"updated_at"`
-	DeletedAt *int64 `db:"deleted_at"`
+	ID        int64  `json:"id" db:"id"`
+	UserID    int64  `json:"userId" db:"user_id"`
+	Reason    string `json:"reason" db:"reason"`
+	AdminID   *int64 `json:"adminId" db:"admin_id"`
+	ExpiredAt *int64 `json:"expiredAt" db:"expired_at"`
+	CreatedAt int64  `json:"createdAt" db:"created_at"`
+	UpdatedAt int64  `json:"updatedAt" db:"updated_at"`
+	DeletedAt *int64 `json:"deletedAt,omitempty" db:"deleted_at"`
 }
 
 type UserCard struct {
@@ -2130,6 +2245,16 @@ type PresentAllMaster struct {
 	Amount            int64  `json:"amount" db:"amount"`
 	PresentMessage    string `json:"presentMessage" db:"present_message"`
 	CreatedAt         int64  `json:"createdAt" db:"created_at"`
+	PresentAllTarget
+}
+
+type RewardBoostMaster struct {
+	ID         int64  `json:"id" db:"id"`
+	Name       string `json:"name" db:"name"`
+	Multiplier int64  `json:"multiplier" db:"multiplier"`
+	StartAt    int64  `json:"startAt" db:"start_at"`
+	EndAt      int64  `json:"endAt" db:"end_at"`
+	CreatedAt  int64  `json:"createdAt" db:"created_at"`
 }
 
 type VersionMaster struct {
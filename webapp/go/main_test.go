@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// testRequestAt テストで使うリクエスト時刻(2022-08-27 11:00:00 JST)
+const testRequestAt int64 = 1661565600
+
+const (
+	testItemCoin  int64 = 1
+	testItemCard  int64 = 2
+	testItemExp   int64 = 3
+	testItemTimer int64 = 4
+
+	testGachaID int64 = 1
+
+	testLoopBonusID   int64 = 1
+	testOnceBonusID   int64 = 2
+	testPresentAllID  int64 = 1
+	testPlatformAllID int64 = 2
+	testSegmentAllID  int64 = 3
+	testSegmentID     int64 = 100
+)
+
+func TestMain(m *testing.M) {
+	time.Local = time.FixedZone("Local", 9*60*60)
+	os.Exit(m.Run())
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+// newTestMasters テスト用のマスタ
+func newTestMasters() *MasterData {
+	return NewMasterData(
+		&VersionMaster{ID: 1, Status: 1, MasterVersion: "1"},
+		[]*ItemMaster{
+			{ID: testItemCoin, ItemType: 1, Name: "ISU-COIN"},
+			{ID: testItemCard, ItemType: 2, Name: "ハンマー", AmountPerSec: intPtr(8), MaxLevel: intPtr(5), MaxAmountPerSec: intPtr(16), BaseExpPerLevel: intPtr(100)},
+			{ID: testItemExp, ItemType: 3, Name: "強化素材", GainedExp: intPtr(60)},
+			{ID: testItemTimer, ItemType: 4, Name: "時短", ShorteningMin: int64Ptr(10)},
+		},
+		[]*GachaMaster{
+			{ID: testGachaID, Name: "通常ガチャ", StartAt: 0, EndAt: testRequestAt + 86400*30, DisplayOrder: 1},
+			{ID: testGachaID + 1, Name: "終了したガチャ", StartAt: 0, EndAt: testRequestAt - 1, DisplayOrder: 2},
+		},
+		[]*GachaItemMaster{
+			{ID: 1, GachaID: testGachaID, ItemType: 3, ItemID: testItemExp, Amount: 1, Weight: 1},
+			{ID: 2, GachaID: testGachaID + 1, ItemType: 3, ItemID: testItemExp, Amount: 1, Weight: 1},
+		},
+		[]*LoginBonusMaster{
+			{ID: testLoopBonusID, StartAt: 0, EndAt: testRequestAt + 86400*30, ColumnCount: 2, Looped: true},
+			{ID: testOnceBonusID, StartAt: 0, EndAt: testRequestAt + 86400*30, ColumnCount: 1, Looped: false},
+		},
+		[]*LoginBonusRewardMaster{
+			{ID: 1, LoginBonusID: testLoopBonusID, RewardSequence: 1, ItemType: 1, ItemID: testItemCoin, Amount: 100},
+			{ID: 2, LoginBonusID: testLoopBonusID, RewardSequence: 2, ItemType: 3, ItemID: testItemExp, Amount: 3},
+			{ID: 3, LoginBonusID: testOnceBonusID, RewardSequence: 1, ItemType: 1, ItemID: testItemCoin, Amount: 1000},
+		},
+		[]*PresentAllMaster{
+			{ID: testPresentAllID, RegisteredStartAt: 0, RegisteredEndAt: testRequestAt + 86400*30, ItemType: 1, ItemID: testItemCoin, Amount: 500, PresentMessage: "全員プレゼント"},
+			{ID: testPlatformAllID, RegisteredStartAt: 0, RegisteredEndAt: testRequestAt + 86400*30, ItemType: 4, ItemID: testItemTimer, Amount: 1, PresentMessage: "Android限定",
+				PresentAllTarget: PresentAllTarget{PlatformType: intPtr(2)}},
+			{ID: testSegmentAllID, RegisteredStartAt: 0, RegisteredEndAt: testRequestAt + 86400*30, ItemType: 3, ItemID: testItemExp, Amount: 5, PresentMessage: "セグメント限定",
+				PresentAllTarget: PresentAllTarget{SegmentID: int64Ptr(testSegmentID)}},
+		},
+		nil,
+	)
+}
+
+// newTestHandler メモリ上のRepositoryを使うHandler
+func newTestHandler(t *testing.T) (*Handler, *MemoryRepository) {
+	t.Helper()
+	repo := NewMemoryRepository(newTestMasters())
+	h := &Handler{
+		Repo:    repo,
+		Masters: NewMasterCache(repo),
+	}
+	if _, err := h.Masters.Reload(); err != nil {
+		t.Fatalf("failed to load masters: %v", err)
+	}
+	return h, repo
+}
+
+// callHandler ハンドラを直接呼び出す。paramsはパスパラメータの名前と値を交互に指定する
+func callHandler(t *testing.T, handler echo.HandlerFunc, method string, requestAt int64, body interface{}, params ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	if body != nil {
+		if err := json.NewEncoder(buf).Encode(body); err != nil {
+			t.Fatalf("failed to encode request body: %v", err)
+		}
+	}
+	req := httptest.NewRequest(method, "/", buf)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	e := echo.New()
+	c := e.NewContext(req, rec)
+	names, values := make([]string, 0), make([]string, 0)
+	for i := 0; i+1 < len(params); i += 2 {
+		names = append(names, params[i])
+		values = append(values, params[i+1])
+	}
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+	c.Set("requestTime", requestAt)
+
+	if err := handler(c); err != nil {
+		t.Fatalf("handler returned error: %v", err)
+	}
+	return rec
+}
+
+// decodeResponse ステータスコードを確認してレスポンスを読み込む
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status: want %d, got %d: %s", status, rec.Code, rec.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+}
+
+// createTestUser ユーザを作成する
+func createTestUser(t *testing.T, h *Handler, viewerID string, platformType int, requestAt int64) *CreateUserResponse {
+	t.Helper()
+	res := new(CreateUserResponse)
+	rec := callHandler(t, h.createUser, http.MethodPost, requestAt, &CreateUserRequest{ViewerID: viewerID, PlatformType: platformType})
+	decodeResponse(t, rec, http.StatusOK, res)
+	return res
+}
+
+// loginTestUser ログインする
+func loginTestUser(t *testing.T, h *Handler, userID int64, viewerID string, requestAt int64) *LoginResponse {
+	t.Helper()
+	res := new(LoginResponse)
+	rec := callHandler(t, h.login, http.MethodPost, requestAt, &LoginRequest{ViewerID: viewerID, UserID: userID})
+	decodeResponse(t, rec, http.StatusOK, res)
+	return res
+}
+
+func userIDParam(userID int64) []string {
+	return []string{"userID", strconv.FormatInt(userID, 10)}
+}
+
+func findLoginBonus(bonuses []*UserLoginBonus, loginBonusID int64) *UserLoginBonus {
+	for _, v := range bonuses {
+		if v.LoginBonusID == loginBonusID {
+			return v
+		}
+	}
+	return nil
+}
+
+func TestCreateUserObtainsLoginBonus(t *testing.T) {
+	h, repo := newTestHandler(t)
+
+	res := createTestUser(t, h, "viewer", 1, testRequestAt)
+
+	bonuses := res.UpdatedResources.UserLoginBonuses
+	if len(bonuses) != 2 {
+		t.Fatalf("login bonuses: want 2, got %d", len(bonuses))
+	}
+	for _, id := range []int64{testLoopBonusID, testOnceBonusID} {
+		bonus := findLoginBonus(bonuses, id)
+		if bonus == nil || bonus.LastRewardSequence != 1 || bonus.LoopCount != 1 {
+			t.Errorf("login bonus %d: want sequence 1 and loop 1, got %+v", id, bonus)
+		}
+	}
+
+	user, err := repo.GetUser(res.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.IsuCoin != 1100 {
+		t.Errorf("isu coin: want 1100, got %d", user.IsuCoin)
+	}
+	cards, err := repo.ListUserCards(res.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cards) != 3 {
+		t.Errorf("initial cards: want 3, got %d", len(cards))
+	}
+	deck, err := repo.GetUserDeck(res.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deck.CardID1 != cards[0].ID || deck.CardID2 != cards[1].ID || deck.CardID3 != cards[2].ID {
+		t.Errorf("initial deck: got %+v", deck)
+	}
+	if _, err = repo.GetSession(res.SessionID); err != nil {
+		t.Errorf("session is not created: %v", err)
+	}
+}
+
+func TestLoginBonusProgress(t *testing.T) {
+	h, repo := newTestHandler(t)
+	created := createTestUser(t, h, "viewer", 1, testRequestAt)
+
+	// 同日の再ログインでは付与しない
+	res := loginTestUser(t, h, created.UserID, "viewer", testRequestAt+60)
+	if len(res.UpdatedResources.UserLoginBonuses) != 0 {
+		t.Errorf("same day login: want no login bonus, got %d", len(res.UpdatedResources.UserLoginBonuses))
+	}
+	if res.SessionID == created.SessionID {
+		t.Errorf("session is not reissued")
+	}
+	if _, err := repo.GetSession(created.SessionID); err == nil {
+		t.Errorf("old session is not deleted")
+	}
+
+	// 翌日は2日目の報酬。ループしないボーナスは付与済み
+	res = loginTestUser(t, h, created.UserID, "viewer", testRequestAt+86400)
+	bonuses := res.UpdatedResources.UserLoginBonuses
+	if len(bonuses) != 1 {
+		t.Fatalf("second day: want 1 login bonus, got %d", len(bonuses))
+	}
+	if bonus := findLoginBonus(bonuses, testLoopBonusID); bonus == nil || bonus.LastRewardSequence != 2 || bonus.LoopCount != 1 {
+		t.Errorf("second day: want sequence 2 and loop 1, got %+v", bonus)
+	}
+	item, err := repo.GetUserItemByItemID(created.UserID, testItemExp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Amount != 3 {
+		t.Errorf("exp item: want 3, got %d", item.Amount)
+	}
+
+	// 最終日の翌日は1日目に戻る
+	res = loginTestUser(t, h, created.UserID, "viewer", testRequestAt+86400*2)
+	bonus := findLoginBonus(res.UpdatedResources.UserLoginBonuses, testLoopBonusID)
+	if bonus == nil || bonus.LastRewardSequence != 1 || bonus.LoopCount != 2 {
+		t.Errorf("third day: want sequence 1 and loop 2, got %+v", bonus)
+	}
+	user, err := repo.GetUser(created.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.IsuCoin != 1200 {
+		t.Errorf("isu coin: want 1200, got %d", user.IsuCoin)
+	}
+	if user.LastActivatedAt != testRequestAt+86400*2 {
+		t.Errorf("last activated at: want %d, got %d", testRequestAt+86400*2, user.LastActivatedAt)
+	}
+}
+
+func TestLoginRejectsInvalidViewer(t *testing.T) {
+	h, _ := newTestHandler(t)
+	created := createTestUser(t, h, "viewer", 1, testRequestAt)
+
+	rec := callHandler(t, h.login, http.MethodPost, testRequestAt+86400, &LoginRequest{ViewerID: "other", UserID: created.UserID})
+	decodeResponse(t, rec, http.StatusNotFound, nil)
+}
+
+func TestLoginRejectsBannedUser(t *testing.T) {
+	h, repo := newTestHandler(t)
+	created := createTestUser(t, h, "viewer", 1, testRequestAt)
+	repo.InsertUserBan(&UserBan{ID: 1, UserID: created.UserID, Reason: "cheat", CreatedAt: testRequestAt})
+
+	rec := callHandler(t, h.login, http.MethodPost, testRequestAt+86400, &LoginRequest{ViewerID: "viewer", UserID: created.UserID})
+	decodeResponse(t, rec, http.StatusForbidden, nil)
+}
+
+func TestDrawGacha(t *testing.T) {
+	h, repo := newTestHandler(t)
+	created := createTestUser(t, h, "viewer", 1, testRequestAt)
+	userID := strconv.FormatInt(created.UserID, 10)
+
+	list := new(ListGachaResponse)
+	rec := callHandler(t, h.listGacha, http.MethodGet, testRequestAt, nil, userIDParam(created.UserID)...)
+	decodeResponse(t, rec, http.StatusOK, list)
+	if len(list.Gachas) != 1 || list.Gachas[0].Gacha.ID != testGachaID {
+		t.Fatalf("gachas: want only active gacha, got %d", len(list.Gachas))
+	}
+	if list.OneTimeToken == "" {
+		t.Fatal("one time token is not issued")
+	}
+
+	draw := new(DrawGachaResponse)
+	body := &DrawGachaRequest{ViewerID: "viewer", OneTimeToken: list.OneTimeToken}
+	rec = callHandler(t, h.drawGacha, http.MethodPost, testRequestAt, body, "userID", userID, "gachaID", "1", "n", "1")
+	decodeResponse(t, rec, http.StatusOK, draw)
+	if len(draw.Presents) != 1 || draw.Presents[0].ItemID != testItemExp {
+		t.Fatalf("presents: want 1 exp item, got %+v", draw.Presents)
+	}
+
+	user, err := repo.GetUser(created.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.IsuCoin != 100 {
+		t.Errorf("isu coin: want 100, got %d", user.IsuCoin)
+	}
+	count, err := repo.CountUserPresents(created.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("presents: want 2, got %d", count)
+	}
+
+	// 使ったトークンは再利用できない
+	rec = callHandler(t, h.drawGacha, http.MethodPost, testRequestAt, body, "userID", userID, "gachaID", "1", "n", "1")
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestDrawGachaNotEnoughCoin(t *testing.T) {
+	h, repo := newTestHandler(t)
+	created := createTestUser(t, h, "viewer", 1, testRequestAt)
+
+	list := new(ListGachaResponse)
+	rec := callHandler(t, h.listGacha, http.MethodGet, testRequestAt, nil, userIDParam(created.UserID)...)
+	decodeResponse(t, rec, http.StatusOK, list)
+
+	body := &DrawGachaRequest{ViewerID: "viewer", OneTimeToken: list.OneTimeToken}
+	rec = callHandler(t, h.drawGacha, http.MethodPost, testRequestAt, body, "userID", strconv.FormatInt(created.UserID, 10), "gachaID", "1", "n", "10")
+	decodeResponse(t, rec, http.StatusConflict, nil)
+
+	user, err := repo.GetUser(created.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.IsuCoin != 1100 {
+		t.Errorf("isu coin: want 1100, got %d", user.IsuCoin)
+	}
+}
+
+func TestDrawGachaInvalidToken(t *testing.T) {
+	h, _ := newTestHandler(t)
+	created := createTestUser(t, h, "viewer", 1, testRequestAt)
+	userID := strconv.FormatInt(created.UserID, 10)
+
+	body := &DrawGachaRequest{ViewerID: "viewer", OneTimeToken: "invalid"}
+	rec := callHandler(t, h.drawGacha, http.MethodPost, testRequestAt, body, "userID", userID, "gachaID", "1", "n", "1")
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+
+	// 期限切れのトークン
+	list := new(ListGachaResponse)
+	rec = callHandler(t, h.listGacha, http.MethodGet, testRequestAt, nil, userIDParam(created.UserID)...)
+	decodeResponse(t, rec, http.StatusOK, list)
+	body = &DrawGachaRequest{ViewerID: "viewer", OneTimeToken: list.OneTimeToken}
+	rec = callHandler(t, h.drawGacha, http.MethodPost, testRequestAt+601, body, "userID", userID, "gachaID", "1", "n", "1")
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestPresentAllTargeting(t *testing.T) {
+	h, repo := newTestHandler(t)
+	repo.InsertPresentSegmentUsers(testSegmentID, 1)
+
+	// 最初に採番されるIDが1のため、セグメントに含まれる
+	android := createTestUser(t, h, "android", 2, testRequestAt)
+	if android.UserID != 1 {
+		t.Fatalf("user id: want 1, got %d", android.UserID)
+	}
+	ios := createTestUser(t, h, "ios", 1, testRequestAt)
+
+	messages := func(presents []*UserPresent) map[string]bool {
+		m := make(map[string]bool)
+		for _, v := range presents {
+			m[v.PresentMessage] = true
+		}
+		return m
+	}
+	if got := messages(android.UpdatedResources.UserPresents); len(got) != 3 || !got["全員プレゼント"] || !got["Android限定"] || !got["セグメント限定"] {
+		t.Errorf("android presents: got %v", got)
+	}
+	if got := messages(ios.UpdatedResources.UserPresents); len(got) != 1 || !got["全員プレゼント"] {
+		t.Errorf("ios presents: got %v", got)
+	}
+
+	// 受け取り済みの全員プレゼントは再度配布しない
+	res := loginTestUser(t, h, ios.UserID, "ios", testRequestAt+86400)
+	if len(res.UpdatedResources.UserPresents) != 0 {
+		t.Errorf("presents on next login: want 0, got %d", len(res.UpdatedResources.UserPresents))
+	}
+	count, err := repo.CountUserPresents(ios.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("presents: want 1, got %d", count)
+	}
+}
+
+func TestListPresentPagination(t *testing.T) {
+	h, repo := newTestHandler(t)
+	created := createTestUser(t, h, "viewer", 1, testRequestAt)
+
+	for i := 0; i < PresentCountPerPage; i++ {
+		id, err := repo.GenerateID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repo.InsertUserPresent(&UserPresent{
+			ID:             id,
+			UserID:         created.UserID,
+			SentAt:         testRequestAt + int64(i+1),
+			ItemType:       1,
+			ItemID:         testItemCoin,
+			Amount:         1,
+			PresentMessage: fmt.Sprintf("present %d", i),
+			CreatedAt:      testRequestAt + int64(i+1),
+			UpdatedAt:      testRequestAt + int64(i+1),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := new(ListPresentResponse)
+	rec := callHandler(t, h.listPresent, http.MethodGet, testRequestAt, nil, append(userIDParam(created.UserID), "n", "1")...)
+	decodeResponse(t, rec, http.StatusOK, first)
+	if len(first.Presents) != PresentCountPerPage || !first.IsNext {
+		t.Fatalf("first page: want %d presents and next page, got %d, %v", PresentCountPerPage, len(first.Presents), first.IsNext)
+	}
+	if first.Presents[0].PresentMessage != fmt.Sprintf("present %d", PresentCountPerPage-1) {
+		t.Errorf("first page: want newest present first, got %s", first.Presents[0].PresentMessage)
+	}
+
+	second := new(ListPresentResponse)
+	rec = callHandler(t, h.listPresent, http.MethodGet, testRequestAt, nil, append(userIDParam(created.UserID), "n", "2")...)
+	decodeResponse(t, rec, http.StatusOK, second)
+	if len(second.Presents) != 1 || second.IsNext {
+		t.Fatalf("second page: want 1 present and no next page, got %d, %v", len(second.Presents), second.IsNext)
+	}
+	if second.Presents[0].PresentMessage != "全員プレゼント" {
+		t.Errorf("second page: want oldest present, got %s", second.Presents[0].PresentMessage)
+	}
+
+	rec = callHandler(t, h.listPresent, http.MethodGet, testRequestAt, nil, append(userIDParam(created.UserID), "n", "0")...)
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestReceivePresent(t *testing.T) {
+	h, repo := newTestHandler(t)
+	created := createTestUser(t, h, "viewer", 1, testRequestAt)
+	presentID := created.UpdatedResources.UserPresents[0].ID
+
+	res := new(ReceivePresentResponse)
+	body := &ReceivePresentRequest{ViewerID: "viewer", PresentIDs: []int64{presentID}}
+	rec := callHandler(t, h.receivePresent, http.MethodPost, testRequestAt+10, body, userIDParam(created.UserID)...)
+	decodeResponse(t, rec, http.StatusOK, res)
+	if len(res.UpdatedResources.UserPresents) != 1 || res.UpdatedResources.UserPresents[0].DeletedAt == nil {
+		t.Fatalf("received presents: got %+v", res.UpdatedResources.UserPresents)
+	}
+
+	user, err := repo.GetUser(created.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.IsuCoin != 1600 {
+		t.Errorf("isu coin: want 1600, got %d", user.IsuCoin)
+	}
+	count, err := repo.CountUserPresents(created.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("presents: want 0, got %d", count)
+	}
+
+	// 受け取り済みのプレゼントは付与しない
+	res = new(ReceivePresentResponse)
+	rec = callHandler(t, h.receivePresent, http.MethodPost, testRequestAt+20, body, userIDParam(created.UserID)...)
+	decodeResponse(t, rec, http.StatusOK, res)
+	if len(res.UpdatedResources.UserPresents) != 0 {
+		t.Errorf("received presents: want 0, got %d", len(res.UpdatedResources.UserPresents))
+	}
+	if user, err = repo.GetUser(created.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if user.IsuCoin != 1600 {
+		t.Errorf("isu coin: want 1600, got %d", user.IsuCoin)
+	}
+}
+
+// setupAddExp 強化素材を持つユーザを作成し、強化用のワンタイムトークンを発行する
+func setupAddExp(t *testing.T, h *Handler, repo *MemoryRepository, amount int) (*CreateUserResponse, *UserItem, string) {
+	t.Helper()
+	created := createTestUser(t, h, "viewer", 1, testRequestAt)
+
+	id, err := repo.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := &UserItem{ID: id, UserID: created.UserID, ItemType: 3, ItemID: testItemExp, Amount: amount, CreatedAt: testRequestAt, UpdatedAt: testRequestAt}
+	if err = repo.InsertUserItem(item); err != nil {
+		t.Fatal(err)
+	}
+
+	list := new(ListItemResponse)
+	rec := callHandler(t, h.listItem, http.MethodGet, testRequestAt, nil, userIDParam(created.UserID)...)
+	decodeResponse(t, rec, http.StatusOK, list)
+	if len(list.Items) != 1 || len(list.Cards) != 3 {
+		t.Fatalf("list item: want 1 item and 3 cards, got %d, %d", len(list.Items), len(list.Cards))
+	}
+	return created, item, list.OneTimeToken
+}
+
+func TestAddExpToCardLevelUp(t *testing.T) {
+	h, repo := newTestHandler(t)
+	created, item, token := setupAddExp(t, h, repo, 5)
+	cardID := created.UpdatedResources.UserCards[0].ID
+
+	res := new(AddExpToCardResponse)
+	body := &AddExpToCardRequest{ViewerID: "viewer", OneTimeToken: token, Items: []*ConsumeItem{{ID: item.ID, Amount: 2}}}
+	params := append(userIDParam(created.UserID), "cardID", strconv.FormatInt(cardID, 10))
+	rec := callHandler(t, h.addExpToCard, http.MethodPost, testRequestAt, body, params...)
+	decodeResponse(t, rec, http.StatusOK, res)
+
+	// 経験値120: Lv1->2に100、Lv2->3に120必要。Lvごとに生産性が(16-8)/(5-1)=2増える
+	card, err := repo.GetUserCard(created.UserID, cardID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.Level != 3 || card.TotalExp != 120 || card.AmountPerSec != 12 {
+		t.Errorf("card: want level 3, exp 120, amount 12, got %+v", card)
+	}
+	if got := res.UpdatedResources.UserCards; len(got) != 1 || got[0].Level != 3 {
+		t.Errorf("updated cards: got %+v", got)
+	}
+
+	userItem, err := repo.GetUserItem(created.UserID, item.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userItem.Amount != 3 {
+		t.Errorf("item amount: want 3, got %d", userItem.Amount)
+	}
+}
+
+func TestAddExpToCardItemNotEnough(t *testing.T) {
+	h, repo := newTestHandler(t)
+	created, item, token := setupAddExp(t, h, repo, 1)
+	cardID := created.UpdatedResources.UserCards[0].ID
+
+	body := &AddExpToCardRequest{ViewerID: "viewer", OneTimeToken: token, Items: []*ConsumeItem{{ID: item.ID, Amount: 2}}}
+	params := append(userIDParam(created.UserID), "cardID", strconv.FormatInt(cardID, 10))
+	rec := callHandler(t, h.addExpToCard, http.MethodPost, testRequestAt, body, params...)
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+
+	card, err := repo.GetUserCard(created.UserID, cardID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.Level != 1 || card.TotalExp != 0 {
+		t.Errorf("card: want unchanged, got %+v", card)
+	}
+}
+
+func TestAddExpToCardMaxLevel(t *testing.T) {
+	h, repo := newTestHandler(t)
+	created, item, token := setupAddExp(t, h, repo, 5)
+
+	id, err := repo.GenerateID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	card := &UserCard{ID: id, UserID: created.UserID, CardID: testItemCard, AmountPerSec: 16, Level: 5, TotalExp: 1000, CreatedAt: testRequestAt, UpdatedAt: testRequestAt}
+	if err = repo.InsertUserCard(card); err != nil {
+		t.Fatal(err)
+	}
+
+	body := &AddExpToCardRequest{ViewerID: "viewer", OneTimeToken: token, Items: []*ConsumeItem{{ID: item.ID, Amount: 1}}}
+	params := append(userIDParam(created.UserID), "cardID", strconv.FormatInt(card.ID, 10))
+	rec := callHandler(t, h.addExpToCard, http.MethodPost, testRequestAt, body, params...)
+	decodeResponse(t, rec, http.StatusBadRequest, nil)
+}
+
+func TestAddExpToCardOtherUsersCard(t *testing.T) {
+	h, repo := newTestHandler(t)
+	other := createTestUser(t, h, "other", 1, testRequestAt)
+	created, item, token := setupAddExp(t, h, repo, 5)
+
+	body := &AddExpToCardRequest{ViewerID: "viewer", OneTimeToken: token, Items: []*ConsumeItem{{ID: item.ID, Amount: 1}}}
+	params := append(userIDParam(created.UserID), "cardID", strconv.FormatInt(other.UpdatedResources.UserCards[0].ID, 10))
+	rec := callHandler(t, h.addExpToCard, http.MethodPost, testRequestAt, body, params...)
+	decodeResponse(t, rec, http.StatusNotFound, nil)
+}
+
+func TestMemoryRepositoryRollback(t *testing.T) {
+	repo := NewMemoryRepository(newTestMasters())
+	user := &User{ID: 1, IsuCoin: 10, CreatedAt: testRequestAt, UpdatedAt: testRequestAt}
+	if err := repo.InsertUser(user); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := repo.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.UpdateUserCoin(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.InsertUser(&User{ID: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := repo.GetUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.IsuCoin != 10 {
+		t.Errorf("isu coin: want 10, got %d", got.IsuCoin)
+	}
+	if _, err = repo.GetUser(2); err == nil {
+		t.Errorf("inserted user is not rolled back")
+	}
+}
@@ -0,0 +1,832 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrInvalidMasterData error = fmt.Errorf("invalid master data")
+)
+
+type masterColumnType int
+
+const (
+	masterColumnInt masterColumnType = iota + 1
+	masterColumnString
+	masterColumnBool
+)
+
+// masterColumn マスタのカラム定義。CSVのヘッダ名はカラム名と同じ
+type masterColumn struct {
+	Name     string
+	Type     masterColumnType
+	Nullable bool  // MasterCSVNullをNULLとして扱う。数値と真偽値は空文字もNULLとする
+	Optional bool  // CSVのヘッダで省略できる。後から追加したカラムのため、省略した場合は既存の値を変更しない
+	Min      int64 // 数値の場合は最小値、文字列の場合は最小文字数
+	Max      int64 // 数値の場合は最大値、文字列の場合は最大文字数
+}
+
+// masterTable マスタのテーブル定義
+type masterTable struct {
+	Name     string // アップロード時のフォーム名
+	Table    string
+	Columns  []*masterColumn
+	Validate func(row masterRow) []*MasterValidationError // 行単位の検証
+}
+
+// masterRow カラム名をキーとした1行分のマスタデータ。値はint64、string、bool、nilのいずれか
+type masterRow map[string]interface{}
+
+func intColumn(name string, min, max int64) *masterColumn {
+	return &masterColumn{Name: name, Type: masterColumnInt, Min: min, Max: max}
+}
+
+func nullableIntColumn(name string, min, max int64) *masterColumn {
+	return &masterColumn{Name: name, Type: masterColumnInt, Nullable: true, Min: min, Max: max}
+}
+
+func stringColumn(name string, min, max int64) *masterColumn {
+	return &masterColumn{Name: name, Type: masterColumnString, Min: min, Max: max}
+}
+
+func nullableStringColumn(name string, max int64) *masterColumn {
+	return &masterColumn{Name: name, Type: masterColumnString, Nullable: true, Max: max}
+}
+
+// optionalColumn CSVのヘッダで省略できるカラムにする
+func optionalColumn(col *masterColumn) *masterColumn {
+	col.Optional = true
+	return col
+}
+
+func boolColumn(name string) *masterColumn {
+	return &masterColumn{Name: name, Type: masterColumnBool}
+}
+
+const (
+	maxInt    int64 = math.MaxInt32
+	maxBigint int64 = math.MaxInt64
+)
+
+// masterTables マスタの一覧。参照整合性の確認やupsertはこの順に行う
+var masterTables = []*masterTable{
+	{
+		Name:  "versionMaster",
+		Table: "version_masters",
+		Columns: []*masterColumn{
+			intColumn("id", 1, maxBigint),
+			intColumn("status", 1, 2),
+			stringColumn("master_version", 1, 128),
+		},
+	},
+	{
+		Name:  "itemMaster",
+		Table: "item_masters",
+		Columns: []*masterColumn{
+			intColumn("id", 1, maxBigint),
+			intColumn("item_type", 1, 4),
+			stringColumn("name", 1, 128),
+			nullableStringColumn("description", 255),
+			nullableIntColumn("amount_per_sec", 0, maxInt),
+			nullableIntColumn("max_level", 1, maxInt),
+			nullableIntColumn("max_amount_per_sec", 0, maxInt),
+			nullableIntColumn("base_exp_per_level", 1, maxInt),
+			nullableIntColumn("gained_exp", 0, maxInt),
+			nullableIntColumn("shortening_min", 0, maxBigint),
+		},
+		Validate: validateItemMasterRow,
+	},
+	{
+		Name:  "gachaMaster",
+		Table: "gacha_masters",
+		Columns: []*masterColumn{
+			intColumn("id", 1, maxBigint),
+			nullableStringColumn("name", 255),
+			intColumn("start_at", 0, maxBigint),
+			intColumn("end_at", 0, maxBigint),
+			nullableIntColumn("display_order", 0, maxInt),
+			intColumn("created_at", 0, maxBigint),
+		},
+		Validate: validatePeriodRow("start_at", "end_at"),
+	},
+	{
+		Name:  "gachaItemMaster",
+		Table: "gacha_item_masters",
+		Columns: []*masterColumn{
+			intColumn("id", 1, maxBigint),
+			intColumn("gacha_id", 1, maxBigint),
+			intColumn("item_type", 1, 4),
+			intColumn("item_id", 1, maxInt),
+			intColumn("amount", 1, maxInt),
+			intColumn("weight", 0, maxInt),
+			intColumn("created_at", 0, maxBigint),
+		},
+	},
+	{
+		Name:  "presentAllMaster",
+		Table: "present_all_masters",
+		Columns: []*masterColumn{
+			intColumn("id", 1, maxBigint),
+			intColumn("registered_start_at", 0, maxBigint),
+			intColumn("registered_end_at", 0, maxBigint),
+			intColumn("item_type", 1, 4),
+			intColumn("item_id", 1, maxInt),
+			intColumn("amount", 1, maxInt),
+			nullableStringColumn("present_message", 255),
+			intColumn("created_at", 0, maxBigint),
+			optionalColumn(nullableIntColumn("target_platform_type", 1, 3)),
+			optionalColumn(nullableIntColumn("target_last_activated_from", 0, maxBigint)),
+			optionalColumn(nullableIntColumn("target_last_activated_to", 0, maxBigint)),
+			optionalColumn(nullableIntColumn("target_login_bonus_id", 1, maxBigint)),
+			optionalColumn(nullableIntColumn("target_login_bonus_min_progress", 1, maxInt)),
+			optionalColumn(nullableIntColumn("target_segment_id", 1, maxBigint)),
+		},
+		Validate: validatePresentAllMasterRow,
+	},
+	{
+		Name:  "loginBonusMaster",
+		Table: "login_bonus_masters",
+		Columns: []*masterColumn{
+			intColumn("id", 1, maxBigint),
+			intColumn("start_at", 0, maxBigint),
+			intColumn("end_at", 0, maxBigint),
+			intColumn("column_count", 1, 99),
+			boolColumn("looped"),
+			intColumn("created_at", 0, maxBigint),
+		},
+		Validate: validatePeriodRow("start_at", "end_at"),
+	},
+	{
+		Name:  "loginBonusRewardMaster",
+		Table: "login_bonus_reward_masters",
+		Columns: []*masterColumn{
+			intColumn("id", 1, maxBigint),
+			intColumn("login_bonus_id", 1, maxBigint),
+			intColumn("reward_sequence", 1, 99),
+			intColumn("item_type", 1, 4),
+			intColumn("item_id", 1, maxInt),
+			intColumn("amount", 1, maxBigint),
+			intColumn("created_at", 0, maxBigint),
+		},
+	},
+	{
+		Name:  "rewardBoostMaster",
+		Table: "reward_boost_masters",
+		Columns: []*masterColumn{
+			intColumn("id", 1, maxBigint),
+			stringColumn("name", 1, 255),
+			intColumn("multiplier", 1, maxInt),
+			intColumn("start_at", 0, maxBigint),
+			intColumn("end_at", 0, maxBigint),
+			intColumn("created_at", 0, maxBigint),
+		},
+		Validate: validatePeriodRow("start_at", "end_at"),
+	},
+}
+
+// findMasterTable フォーム名からマスタのテーブル定義を取得する
+func findMasterTable(name string) *masterTable {
+	for _, t := range masterTables {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// MasterValidationError マスタデータの検証エラー。RowはCSVの場合はヘッダを1行目とした行番号、JSON、YAMLの場合は1始まりの要素番号
+type MasterValidationError struct {
+	File    string `json:"file"`
+	Row     int    `json:"row"`
+	Column  string `json:"column"`
+	Message string `json:"message"`
+}
+
+func (e *MasterValidationError) Error() string {
+	return fmt.Sprintf("%s:%d:%s: %s", e.File, e.Row, e.Column, e.Message)
+}
+
+// masterUpload アップロードされた1テーブル分のマスタデータ
+type masterUpload struct {
+	Table      *masterTable
+	Rows       []masterRow
+	RowNumbers []int           // 各行のアップロード元での行番号
+	Omitted    map[string]bool // CSVのヘッダで省略されたカラム。既存の行では更新しない
+}
+
+// readMasterUploads アップロードされたマスタを読み込んで検証する。アップロードされていないマスタは含まない
+// マスタごとのCSVのほか、全マスタをまとめたJSON、YAMLのドキュメントを受け付ける
+func readMasterUploads(c echo.Context) (map[string]*masterUpload, []*MasterValidationError, error) {
+	document, format, err := readMasterDocument(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if document != nil {
+		return parseMasterDocument(document, format)
+	}
+
+	uploads := make(map[string]*masterUpload)
+	verrs := make([]*MasterValidationError, 0)
+	for _, t := range masterTables {
+		records, err := readFormFileToCSV(c, t.Name)
+		if err != nil {
+			if err == ErrNoFormFile {
+				continue
+			}
+			var perr *csv.ParseError
+			if errors.As(err, &perr) {
+				verrs = append(verrs, &MasterValidationError{File: t.Name, Row: perr.Line, Message: perr.Err.Error()})
+				continue
+			}
+			return nil, nil, err
+		}
+
+		upload, uploadErrs := parseMasterCSV(t, records)
+		verrs = append(verrs, uploadErrs...)
+		if upload != nil {
+			uploads[t.Name] = upload
+		}
+	}
+	return uploads, verrs, nil
+}
+
+// parseMasterCSV ヘッダ行をもとにCSVレコードを型付きの行に変換する
+func parseMasterCSV(table *masterTable, records [][]string) (*masterUpload, []*MasterValidationError) {
+	verrs := make([]*MasterValidationError, 0)
+	if len(records) == 0 {
+		return nil, append(verrs, &MasterValidationError{File: table.Name, Row: 1, Message: "header row is required"})
+	}
+
+	// ヘッダ名とカラムの対応付け
+	header := records[0]
+	indexes := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if table.column(name) == nil {
+			verrs = append(verrs, &MasterValidationError{File: table.Name, Row: 1, Column: name, Message: "unknown column"})
+			continue
+		}
+		if _, ok := indexes[name]; ok {
+			verrs = append(verrs, &MasterValidationError{File: table.Name, Row: 1, Column: name, Message: "duplicated column"})
+			continue
+		}
+		indexes[name] = i
+	}
+	for _, col := range table.Columns {
+		if _, ok := indexes[col.Name]; !ok && !col.Optional {
+			verrs = append(verrs, &MasterValidationError{File: table.Name, Row: 1, Column: col.Name, Message: "missing column"})
+		}
+	}
+	if len(verrs) > 0 {
+		return nil, verrs
+	}
+
+	upload := &masterUpload{
+		Table:      table,
+		Rows:       make([]masterRow, 0, len(records)-1),
+		RowNumbers: make([]int, 0, len(records)-1),
+		Omitted:    make(map[string]bool),
+	}
+	for _, col := range table.Columns {
+		if _, ok := indexes[col.Name]; !ok {
+			upload.Omitted[col.Name] = true
+		}
+	}
+	for i, record := range records[1:] {
+		rowNumber := i + 2
+		if len(record) != len(header) {
+			verrs = append(verrs, &MasterValidationError{File: table.Name, Row: rowNumber, Message: fmt.Sprintf("expected %d fields but got %d", len(header), len(record))})
+			continue
+		}
+		values := make(map[string]string, len(table.Columns))
+		for _, col := range table.Columns {
+			if index, ok := indexes[col.Name]; ok {
+				values[col.Name] = record[index]
+			}
+		}
+		row, rowErrs := table.parseRow(values, rowNumber)
+		if len(rowErrs) > 0 {
+			verrs = append(verrs, rowErrs...)
+			continue
+		}
+		upload.Rows = append(upload.Rows, row)
+		upload.RowNumbers = append(upload.RowNumbers, rowNumber)
+	}
+
+	verrs = append(verrs, upload.validateDuplicatedIDs()...)
+
+	return upload, verrs
+}
+
+// column カラム名からカラム定義を取得する
+func (t *masterTable) column(name string) *masterColumn {
+	for _, col := range t.Columns {
+		if col.Name == name {
+			return col
+		}
+	}
+	return nil
+}
+
+// parseRow 文字列の値を型変換して範囲を検証する
+func (t *masterTable) parseRow(values map[string]string, rowNumber int) (masterRow, []*MasterValidationError) {
+	verrs := make([]*MasterValidationError, 0)
+	row := make(masterRow, len(t.Columns))
+	for _, col := range t.Columns {
+		v, err := col.parse(values[col.Name])
+		if err != nil {
+			verrs = append(verrs, &MasterValidationError{File: t.Name, Row: rowNumber, Column: col.Name, Message: err.Error()})
+			continue
+		}
+		row[col.Name] = v
+	}
+	if len(verrs) > 0 {
+		return nil, verrs
+	}
+
+	if t.Validate != nil {
+		for _, verr := range t.Validate(row) {
+			verr.File = t.Name
+			verr.Row = rowNumber
+			verrs = append(verrs, verr)
+		}
+	}
+	return row, verrs
+}
+
+// parse 文字列の値をカラムの型に変換する
+func (col *masterColumn) parse(v string) (interface{}, error) {
+	// 文字列の空文字は値として扱い、NULLと区別する
+	if col.Nullable && (v == MasterCSVNull || (v == "" && col.Type != masterColumnString)) {
+		return nil, nil
+	}
+	if v == MasterCSVNull {
+		return nil, fmt.Errorf("must not be null")
+	}
+
+	switch col.Type {
+	case masterColumnInt:
+		i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("must be an integer: %q", v)
+		}
+		if i < col.Min || i > col.Max {
+			return nil, fmt.Errorf("must be between %d and %d: %d", col.Min, col.Max, i)
+		}
+		return i, nil
+
+	case masterColumnString:
+		n := int64(utf8.RuneCountInString(v))
+		if n < col.Min || n > col.Max {
+			return nil, fmt.Errorf("length must be between %d and %d: %d", col.Min, col.Max, n)
+		}
+		return v, nil
+
+	case masterColumnBool:
+		switch strings.ToUpper(strings.TrimSpace(v)) {
+		case "TRUE", "1":
+			return true, nil
+		case "FALSE", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("must be TRUE or FALSE: %q", v)
+	}
+
+	return nil, fmt.Errorf("unknown column type")
+}
+
+// validateDuplicatedIDs 同じファイル内でのIDの重複を検出する
+func (u *masterUpload) validateDuplicatedIDs() []*MasterValidationError {
+	verrs := make([]*MasterValidationError, 0)
+	seen := make(map[int64]int, len(u.Rows))
+	for i, row := range u.Rows {
+		id := row.int("id")
+		if first, ok := seen[id]; ok {
+			verrs = append(verrs, &MasterValidationError{File: u.Table.Name, Row: u.RowNumbers[i], Column: "id", Message: fmt.Sprintf("duplicated id %d (first defined at row %d)", id, first)})
+			continue
+		}
+		seen[id] = u.RowNumbers[i]
+	}
+	return verrs
+}
+
+// int 数値カラムの値を取得する。NULLの場合は0を返す
+func (r masterRow) int(name string) int64 {
+	if v, ok := r[name].(int64); ok {
+		return v
+	}
+	return 0
+}
+
+// validateItemMasterRow アイテム種別ごとに必要なカラムが埋まっているかを確認する
+func validateItemMasterRow(row masterRow) []*MasterValidationError {
+	required := map[int64][]string{
+		2: {"amount_per_sec", "max_level", "max_amount_per_sec", "base_exp_per_level"},
+		3: {"gained_exp"},
+		4: {"shortening_min"},
+	}
+	verrs := make([]*MasterValidationError, 0)
+	for _, name := range required[row.int("item_type")] {
+		if row[name] == nil {
+			verrs = append(verrs, &MasterValidationError{Column: name, Message: fmt.Sprintf("required for item_type %d", row.int("item_type"))})
+		}
+	}
+	return verrs
+}
+
+// validatePeriodRow 期間の開始が終了より後になっていないかを確認する
+func validatePeriodRow(startColumn, endColumn string) func(row masterRow) []*MasterValidationError {
+	return func(row masterRow) []*MasterValidationError {
+		if row.int(startColumn) > row.int(endColumn) {
+			return []*MasterValidationError{{Column: endColumn, Message: fmt.Sprintf("must be after %s", startColumn)}}
+		}
+		return nil
+	}
+}
+
+// validatePresentAllMasterRow 配布期間と配布対象の条件を確認する
+func validatePresentAllMasterRow(row masterRow) []*MasterValidationError {
+	verrs := validatePeriodRow("registered_start_at", "registered_end_at")(row)
+	if row["target_last_activated_from"] != nil && row["target_last_activated_to"] != nil {
+		verrs = append(verrs, validatePeriodRow("target_last_activated_from", "target_last_activated_to")(row)...)
+	}
+	if (row["target_login_bonus_id"] == nil) != (row["target_login_bonus_min_progress"] == nil) {
+		verrs = append(verrs, &MasterValidationError{Column: "target_login_bonus_min_progress", Message: "target_login_bonus_id and target_login_bonus_min_progress must be set together"})
+	}
+	return verrs
+}
+
+// validateMasterReferences アップロードされたマスタと既存のマスタを合わせて参照整合性を確認する
+func validateMasterReferences(tx *sqlx.Tx, uploads map[string]*masterUpload) ([]*MasterValidationError, error) {
+	verrs := make([]*MasterValidationError, 0)
+
+	// 有効なバージョンは1つだけ
+	if u, ok := uploads["versionMaster"]; ok {
+		versions := make([]*VersionMaster, 0)
+		if err := tx.Select(&versions, "SELECT * FROM version_masters"); err != nil {
+			return nil, err
+		}
+		statuses := make(map[int64]int64, len(versions))
+		for _, v := range versions {
+			statuses[v.ID] = int64(v.Status)
+		}
+		for _, row := range u.Rows {
+			statuses[row.int("id")] = row.int("status")
+		}
+		active := 0
+		for _, status := range statuses {
+			if status == 1 {
+				active++
+			}
+		}
+		if active != 1 {
+			verrs = append(verrs, &MasterValidationError{File: u.Table.Name, Column: "status", Message: fmt.Sprintf("exactly one active version is required but got %d", active)})
+		}
+	}
+
+	// アイテム種別
+	itemTypes := make(map[int64]int64)
+	items := make([]*ItemMaster, 0)
+	if err := tx.Select(&items, "SELECT * FROM item_masters"); err != nil {
+		return nil, err
+	}
+	for _, v := range items {
+		itemTypes[v.ID] = int64(v.ItemType)
+	}
+	if u, ok := uploads["itemMaster"]; ok {
+		for _, row := range u.Rows {
+			itemTypes[row.int("id")] = row.int("item_type")
+		}
+	}
+
+	// アイテムを参照するマスタ
+	for _, name := range []string{"gachaItemMaster", "presentAllMaster", "loginBonusRewardMaster"} {
+		u, ok := uploads[name]
+		if !ok {
+			continue
+		}
+		for i, row := range u.Rows {
+			itemType, ok := itemTypes[row.int("item_id")]
+			if !ok {
+				verrs = append(verrs, &MasterValidationError{File: name, Row: u.RowNumbers[i], Column: "item_id", Message: fmt.Sprintf("item %d does not exist in item_masters", row.int("item_id"))})
+				continue
+			}
+			if itemType != row.int("item_type") {
+				verrs = append(verrs, &MasterValidationError{File: name, Row: u.RowNumbers[i], Column: "item_type", Message: fmt.Sprintf("item %d has item_type %d", row.int("item_id"), itemType)})
+			}
+		}
+	}
+
+	// ガチャ
+	if u, ok := uploads["gachaItemMaster"]; ok {
+		gachaIDs := make(map[int64]bool)
+		ids := make([]int64, 0)
+		if err := tx.Select(&ids, "SELECT id FROM gacha_masters"); err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			gachaIDs[id] = true
+		}
+		if g, ok := uploads["gachaMaster"]; ok {
+			for _, row := range g.Rows {
+				gachaIDs[row.int("id")] = true
+			}
+		}
+		for i, row := range u.Rows {
+			if !gachaIDs[row.int("gacha_id")] {
+				verrs = append(verrs, &MasterValidationError{File: u.Table.Name, Row: u.RowNumbers[i], Column: "gacha_id", Message: fmt.Sprintf("gacha %d does not exist in gacha_masters", row.int("gacha_id"))})
+			}
+		}
+	}
+
+	// ログインボーナスは日数分の報酬がすべて揃っている必要がある
+	bonusUpload, hasBonus := uploads["loginBonusMaster"]
+	rewardUpload, hasReward := uploads["loginBonusRewardMaster"]
+	if hasBonus || hasReward {
+		bonuses := make([]*LoginBonusMaster, 0)
+		if err := tx.Select(&bonuses, "SELECT * FROM login_bonus_masters"); err != nil {
+			return nil, err
+		}
+		columnCounts := make(map[int64]int64, len(bonuses))
+		for _, v := range bonuses {
+			columnCounts[v.ID] = int64(v.ColumnCount)
+		}
+		// 検証対象のボーナスと、エラーの報告先
+		targets := make(map[int64]*MasterValidationError)
+		if hasBonus {
+			for i, row := range bonusUpload.Rows {
+				columnCounts[row.int("id")] = row.int("column_count")
+				targets[row.int("id")] = &MasterValidationError{File: bonusUpload.Table.Name, Row: bonusUpload.RowNumbers[i], Column: "column_count"}
+			}
+		}
+
+		rewards := make([]*LoginBonusRewardMaster, 0)
+		if err := tx.Select(&rewards, "SELECT * FROM login_bonus_reward_masters"); err != nil {
+			return nil, err
+		}
+		sequences := make(map[int64][2]int64, len(rewards)) // reward id -> (login_bonus_id, reward_sequence)
+		for _, v := range rewards {
+			sequences[v.ID] = [2]int64{v.LoginBonusID, int64(v.RewardSequence)}
+		}
+		if hasReward {
+			for i, row := range rewardUpload.Rows {
+				bonusID := row.int("login_bonus_id")
+				sequences[row.int("id")] = [2]int64{bonusID, row.int("reward_sequence")}
+				if _, ok := columnCounts[bonusID]; !ok {
+					verrs = append(verrs, &MasterValidationError{File: rewardUpload.Table.Name, Row: rewardUpload.RowNumbers[i], Column: "login_bonus_id", Message: fmt.Sprintf("login bonus %d does not exist in login_bonus_masters", bonusID)})
+					continue
+				}
+				if _, ok := targets[bonusID]; !ok {
+					targets[bonusID] = &MasterValidationError{File: rewardUpload.Table.Name, Row: rewardUpload.RowNumbers[i], Column: "reward_sequence"}
+				}
+			}
+		}
+
+		defined := make(map[int64]map[int64]bool)
+		for _, v := range sequences {
+			if defined[v[0]] == nil {
+				defined[v[0]] = make(map[int64]bool)
+			}
+			defined[v[0]][v[1]] = true
+		}
+		for bonusID, at := range targets {
+			missing := make([]string, 0)
+			for seq := int64(1); seq <= columnCounts[bonusID]; seq++ {
+				if !defined[bonusID][seq] {
+					missing = append(missing, strconv.FormatInt(seq, 10))
+				}
+			}
+			if len(missing) > 0 {
+				at.Message = fmt.Sprintf("login bonus %d has no reward for sequence %s", bonusID, strings.Join(missing, ","))
+				verrs = append(verrs, at)
+			}
+		}
+	}
+
+	// 全員プレゼントの配布対象
+	if u, ok := uploads["presentAllMaster"]; ok {
+		bonusIDs := make(map[int64]bool)
+		ids := make([]int64, 0)
+		if err := tx.Select(&ids, "SELECT id FROM login_bonus_masters"); err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			bonusIDs[id] = true
+		}
+		if hasBonus {
+			for _, row := range bonusUpload.Rows {
+				bonusIDs[row.int("id")] = true
+			}
+		}
+		segmentIDs := make(map[int64]bool)
+		ids = make([]int64, 0)
+		if err := tx.Select(&ids, "SELECT id FROM present_segments"); err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			segmentIDs[id] = true
+		}
+		for i, row := range u.Rows {
+			if row["target_login_bonus_id"] != nil && !bonusIDs[row.int("target_login_bonus_id")] {
+				verrs = append(verrs, &MasterValidationError{File: u.Table.Name, Row: u.RowNumbers[i], Column: "target_login_bonus_id", Message: fmt.Sprintf("login bonus %d does not exist in login_bonus_masters", row.int("target_login_bonus_id"))})
+			}
+			if row["target_segment_id"] != nil && !segmentIDs[row.int("target_segment_id")] {
+				verrs = append(verrs, &MasterValidationError{File: u.Table.Name, Row: u.RowNumbers[i], Column: "target_segment_id", Message: fmt.Sprintf("segment %d does not exist in present_segments", row.int("target_segment_id"))})
+			}
+		}
+	}
+
+	return verrs, nil
+}
+
+// upsertMaster マスタデータをまとめて登録、更新する
+func upsertMaster(tx *sqlx.Tx, upload *masterUpload) error {
+	if len(upload.Rows) == 0 {
+		return nil
+	}
+
+	columns := make([]string, 0, len(upload.Table.Columns))
+	values := make([]string, 0, len(upload.Table.Columns))
+	updates := make([]string, 0, len(upload.Table.Columns))
+	for _, col := range upload.Table.Columns {
+		columns = append(columns, col.Name)
+		values = append(values, ":"+col.Name)
+		if col.Name != "id" && !upload.Omitted[col.Name] {
+			updates = append(updates, fmt.Sprintf("%s=VALUES(%s)", col.Name, col.Name))
+		}
+	}
+	query := strings.Join([]string{
+		fmt.Sprintf("INSERT INTO %s(%s)", upload.Table.Table, strings.Join(columns, ", ")),
+		fmt.Sprintf("VALUES (%s)", strings.Join(values, ", ")),
+		"ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", "),
+	}, " ")
+
+	data := make([]map[string]interface{}, 0, len(upload.Rows))
+	for _, row := range upload.Rows {
+		data = append(data, row)
+	}
+	_, err := tx.NamedExec(query, data)
+	return err
+}
+
+// MasterTableDiff マスタ更新による1テーブル分の差分
+type MasterTableDiff struct {
+	Name      string           `json:"name"`
+	Table     string           `json:"table"`
+	Inserted  []masterRow      `json:"inserted"`
+	Updated   []*MasterRowDiff `json:"updated"`
+	Untouched []int64          `json:"untouched"` // 更新によって変化しない既存の行のID
+}
+
+// MasterRowDiff 更新される行の変更内容
+type MasterRowDiff struct {
+	ID      int64                          `json:"id"`
+	Changes map[string]*MasterColumnChange `json:"changes"`
+}
+
+type MasterColumnChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// diffMaster アップロードされたマスタと既存のマスタを比較する。upsertより前に呼び出す
+func diffMaster(tx *sqlx.Tx, upload *masterUpload) (*MasterTableDiff, error) {
+	currentRows, err := selectMasterRows(tx, upload.Table)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[int64]masterRow, len(currentRows))
+	ids := make([]int64, 0, len(currentRows))
+	for _, row := range currentRows {
+		current[row.int("id")] = row
+		ids = append(ids, row.int("id"))
+	}
+
+	diff := &MasterTableDiff{
+		Name:      upload.Table.Name,
+		Table:     upload.Table.Table,
+		Inserted:  make([]masterRow, 0),
+		Updated:   make([]*MasterRowDiff, 0),
+		Untouched: make([]int64, 0),
+	}
+	updated := make(map[int64]bool)
+	for _, row := range upload.Rows {
+		before, ok := current[row.int("id")]
+		if !ok {
+			diff.Inserted = append(diff.Inserted, row)
+			continue
+		}
+		changes := make(map[string]*MasterColumnChange)
+		for _, col := range upload.Table.Columns {
+			if upload.Omitted[col.Name] {
+				continue
+			}
+			if before[col.Name] != row[col.Name] {
+				changes[col.Name] = &MasterColumnChange{Before: before[col.Name], After: row[col.Name]}
+			}
+		}
+		if len(changes) > 0 {
+			diff.Updated = append(diff.Updated, &MasterRowDiff{ID: row.int("id"), Changes: changes})
+			updated[row.int("id")] = true
+		}
+	}
+	for _, id := range ids {
+		if !updated[id] {
+			diff.Untouched = append(diff.Untouched, id)
+		}
+	}
+
+	return diff, nil
+}
+
+// selectMasterRows マスタの全行をカラムの型に変換して取得する
+func selectMasterRows(q sqlx.Queryer, table *masterTable) ([]masterRow, error) {
+	rows, err := q.Queryx(fmt.Sprintf("SELECT * FROM %s ORDER BY id", table.Table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]masterRow, 0)
+	for rows.Next() {
+		values := make(map[string]interface{})
+		if err = rows.MapScan(values); err != nil {
+			return nil, err
+		}
+		row := make(masterRow, len(table.Columns))
+		for _, col := range table.Columns {
+			if row[col.Name], err = col.scan(values[col.Name]); err != nil {
+				return nil, err
+			}
+		}
+		result = append(result, row)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// scan DBやJSONから取得した値をカラムの型に変換する
+func (col *masterColumn) scan(v interface{}) (interface{}, error) {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case bool:
+		if col.Type == masterColumnBool {
+			return v, nil
+		}
+		return nil, fmt.Errorf("unexpected value for %s: %T", col.Name, v)
+	case int64:
+		if col.Type == masterColumnBool {
+			return v != 0, nil
+		}
+		if col.Type == masterColumnInt {
+			return v, nil
+		}
+		s = strconv.FormatInt(v, 10)
+	default:
+		return nil, fmt.Errorf("unexpected value for %s: %T", col.Name, v)
+	}
+
+	switch col.Type {
+	case masterColumnInt:
+		return strconv.ParseInt(s, 10, 64)
+	case masterColumnBool:
+		return s != "0", nil
+	}
+	return s, nil
+}
+
+// masterValidationErrorResponse マスタデータの検証エラーのレスポンス
+func masterValidationErrorResponse(c echo.Context, verrs []*MasterValidationError) error {
+	c.Logger().Errorf("status=%d, err=%+v, errors=%d", http.StatusBadRequest, errors.WithStack(ErrInvalidMasterData), len(verrs))
+
+	return c.JSON(http.StatusBadRequest, struct {
+		StatusCode int                      `json:"status_code"`
+		Message    string                   `json:"message"`
+		Errors     []*MasterValidationError `json:"errors"`
+	}{
+		StatusCode: http.StatusBadRequest,
+		Message:    ErrInvalidMasterData.Error(),
+		Errors:     verrs,
+	})
+}
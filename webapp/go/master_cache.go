@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var ErrActiveMasterVersionNotFound error = fmt.Errorf("active master version is not found")
+
+// MasterCache プロセス全体で共有するマスタデータのキャッシュ
+// 読み込んだマスタはMasterDataとしてまとめて差し替えるため、1リクエストの中では同じバージョンのマスタを参照できる
+type MasterCache struct {
+	source  MasterRepository
+	current atomic.Value // *MasterData
+	mu      sync.Mutex   // 読み込みを直列にする
+}
+
+// MasterCacheKey キャッシュしたマスタの世代
+// マスタの更新、ロールバック、予約リリースは必ずスナップショットを保存するため、
+// 有効なバージョンと最新のスナップショットが変わらなければマスタも変わっていない
+type MasterCacheKey struct {
+	VersionID      int64  `json:"versionId" db:"version_id"`
+	MasterVersion  string `json:"masterVersion" db:"master_version"`
+	LastSnapshotID int64  `json:"lastSnapshotId" db:"last_snapshot_id"`
+}
+
+func NewMasterCache(source MasterRepository) *MasterCache {
+	return &MasterCache{source: source}
+}
+
+// Current 現在のマスタ。読み込み前はnil
+func (m *MasterCache) Current() *MasterData {
+	data, _ := m.current.Load().(*MasterData)
+	return data
+}
+
+// Set 読み込み済みのマスタに差し替える
+func (m *MasterCache) Set(data *MasterData) {
+	m.current.Store(data)
+}
+
+// Reload すべてのマスタを読み込んで差し替える
+func (m *MasterCache) Reload() (*MasterData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	data, err := m.source.LoadMasters()
+	if err != nil {
+		return nil, err
+	}
+	data.LoadedAt = time.Now()
+	m.Set(data)
+	return data, nil
+}
+
+// ReloadIfChanged 保存されているマスタの世代がキャッシュと異なる場合にのみ読み込み直す
+func (m *MasterCache) ReloadIfChanged() (bool, error) {
+	key, err := m.source.GetMasterCacheKey()
+	if err != nil {
+		return false, err
+	}
+	if current := m.Current(); current != nil && current.Key == *key {
+		return false, nil
+	}
+	if _, err = m.Reload(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// masterData 現在のマスタを取得する。起動時の読み込みに失敗していた場合はここで読み込む
+func (h *Handler) masterData() (*MasterData, error) {
+	if data := h.Masters.Current(); data != nil {
+		return data, nil
+	}
+	return h.Masters.Reload()
+}
+
+// reloadMasterCache マスタを更新した後にこのサーバのキャッシュを差し替える
+// 失敗しても更新は完了しているため、ポーリングでの再読み込みに任せる
+func (h *Handler) reloadMasterCache(logger echo.Logger) {
+	if _, err := h.Masters.Reload(); err != nil {
+		logger.Errorf("failed to reload master cache: %v", err)
+	}
+}
+
+// runMasterCachePoller 他のサーバでのマスタ更新を検知してキャッシュを差し替える
+func (h *Handler) runMasterCachePoller(logger echo.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reloaded, err := h.Masters.ReloadIfChanged()
+		if err != nil {
+			logger.Errorf("failed to poll master version: %v", err)
+			continue
+		}
+		if reloaded {
+			key := h.Masters.Current().Key
+			logger.Infof("master cache reloaded: version=%s, snapshot=%d", key.MasterVersion, key.LastSnapshotID)
+		}
+	}
+}
+
+// MasterData 読み込んだ時点のマスタ一式
+// 返す値はすべてのリクエストで共有しているため、呼び出し側で変更しない
+type MasterData struct {
+	Key      MasterCacheKey
+	LoadedAt time.Time
+	Version  *VersionMaster
+
+	items             map[int64]*ItemMaster
+	gachas            []*GachaMaster // display_order順
+	gachaByID         map[int64]*GachaMaster
+	gachaItems        map[int64][]*GachaItemMaster // ガチャごとのID順
+	gachaWeightSums   map[int64]int64
+	loginBonuses      []*LoginBonusMaster // ID順
+	loginBonusByID    map[int64]*LoginBonusMaster
+	loginBonusRewards map[int64]map[int]*LoginBonusRewardMaster
+	presentAlls       []*PresentAllMaster
+	rewardBoosts      []*RewardBoostMaster // start_at、id順
+}
+
+// NewMasterData マスタの一覧から検索用のインデックスを作る
+func NewMasterData(
+	version *VersionMaster,
+	items []*ItemMaster,
+	gachas []*GachaMaster,
+	gachaItems []*GachaItemMaster,
+	loginBonuses []*LoginBonusMaster,
+	loginBonusRewards []*LoginBonusRewardMaster,
+	presentAlls []*PresentAllMaster,
+	rewardBoosts []*RewardBoostMaster,
+) *MasterData {
+	data := &MasterData{
+		Version:           version,
+		items:             make(map[int64]*ItemMaster, len(items)),
+		gachas:            append([]*GachaMaster{}, gachas...),
+		gachaByID:         make(map[int64]*GachaMaster, len(gachas)),
+		gachaItems:        make(map[int64][]*GachaItemMaster),
+		gachaWeightSums:   make(map[int64]int64),
+		loginBonuses:      append([]*LoginBonusMaster{}, loginBonuses...),
+		loginBonusByID:    make(map[int64]*LoginBonusMaster, len(loginBonuses)),
+		loginBonusRewards: make(map[int64]map[int]*LoginBonusRewardMaster),
+		presentAlls:       append([]*PresentAllMaster{}, presentAlls...),
+		rewardBoosts:      append([]*RewardBoostMaster{}, rewardBoosts...),
+	}
+	if data.Version != nil {
+		data.Key.VersionID = data.Version.ID
+		data.Key.MasterVersion = data.Version.MasterVersion
+	}
+
+	for _, v := range items {
+		data.items[v.ID] = v
+	}
+
+	sort.SliceStable(data.gachas, func(i, j int) bool {
+		if data.gachas[i].DisplayOrder != data.gachas[j].DisplayOrder {
+			return data.gachas[i].DisplayOrder < data.gachas[j].DisplayOrder
+		}
+		return data.gachas[i].ID < data.gachas[j].ID
+	})
+	for _, v := range data.gachas {
+		data.gachaByID[v.ID] = v
+	}
+
+	for _, v := range gachaItems {
+		data.gachaItems[v.GachaID] = append(data.gachaItems[v.GachaID], v)
+		data.gachaWeightSums[v.GachaID] += int64(v.Weight)
+	}
+	for _, list := range data.gachaItems {
+		list := list
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	}
+
+	sort.Slice(data.loginBonuses, func(i, j int) bool { return data.loginBonuses[i].ID < data.loginBonuses[j].ID })
+	for _, v := range data.loginBonuses {
+		data.loginBonusByID[v.ID] = v
+	}
+	for _, v := range loginBonusRewards {
+		if data.loginBonusRewards[v.LoginBonusID] == nil {
+			data.loginBonusRewards[v.LoginBonusID] = make(map[int]*LoginBonusRewardMaster)
+		}
+		data.loginBonusRewards[v.LoginBonusID][v.RewardSequence] = v
+	}
+
+	sort.Slice(data.presentAlls, func(i, j int) bool { return data.presentAlls[i].ID < data.presentAlls[j].ID })
+
+	sort.Slice(data.rewardBoosts, func(i, j int) bool {
+		if data.rewardBoosts[i].StartAt != data.rewardBoosts[j].StartAt {
+			return data.rewardBoosts[i].StartAt < data.rewardBoosts[j].StartAt
+		}
+		return data.rewardBoosts[i].ID < data.rewardBoosts[j].ID
+	})
+
+	return data
+}
+
+// Item アイテムを取得する。itemTypeが0以外の場合は種類も一致するものに限る
+func (d *MasterData) Item(itemID int64, itemType int) (*ItemMaster, bool) {
+	item, ok := d.items[itemID]
+	if !ok || (itemType != 0 && item.ItemType != itemType) {
+		return nil, false
+	}
+	return item, true
+}
+
+// ActiveGachas 開催中のガチャをdisplay_order順に取得する
+func (d *MasterData) ActiveGachas(requestAt int64) []*GachaMaster {
+	gachas := make([]*GachaMaster, 0, len(d.gachas))
+	for _, v := range d.gachas {
+		if v.StartAt <= requestAt && requestAt <= v.EndAt {
+			gachas = append(gachas, v)
+		}
+	}
+	return gachas
+}
+
+// Gacha ガチャを取得する
+func (d *MasterData) Gacha(gachaID int64) (*GachaMaster, bool) {
+	gacha, ok := d.gachaByID[gachaID]
+	return gacha, ok
+}
+
+// GachaItems ガチャの排出アイテムをID順に取得する
+func (d *MasterData) GachaItems(gachaID int64) []*GachaItemMaster {
+	return d.gachaItems[gachaID]
+}
+
+// GachaWeightSum ガチャの提供割合(weight)の合計
+func (d *MasterData) GachaWeightSum(gachaID int64) int64 {
+	return d.gachaWeightSums[gachaID]
+}
+
+// ActiveLoginBonuses 開催中のログインボーナスを取得する
+func (d *MasterData) ActiveLoginBonuses(requestAt int64) []*LoginBonusMaster {
+	bonuses := make([]*LoginBonusMaster, 0)
+	for _, v := range d.loginBonuses {
+		if v.StartAt <= requestAt && requestAt <= v.EndAt {
+			bonuses = append(bonuses, v)
+		}
+	}
+	return bonuses
+}
+
+// LoginBonus ログインボーナスを取得する
+func (d *MasterData) LoginBonus(loginBonusID int64) (*LoginBonusMaster, bool) {
+	bonus, ok := d.loginBonusByID[loginBonusID]
+	return bonus, ok
+}
+
+// LoginBonusReward ログインボーナスのsequence日目の報酬を取得する
+func (d *MasterData) LoginBonusReward(loginBonusID int64, sequence int) (*LoginBonusRewardMaster, bool) {
+	reward, ok := d.loginBonusRewards[loginBonusID][sequence]
+	return reward, ok
+}
+
+// ActivePresentAlls 配布期間中の全員プレゼントを取得する
+func (d *MasterData) ActivePresentAlls(requestAt int64) []*PresentAllMaster {
+	presents := make([]*PresentAllMaster, 0)
+	for _, v := range d.presentAlls {
+		if v.RegisteredStartAt <= requestAt && requestAt <= v.RegisteredEndAt {
+			presents = append(presents, v)
+		}
+	}
+	return presents
+}
+
+// RewardBoosts 期間と重なる報酬ブーストイベントをstart_at順に取得する
+func (d *MasterData) RewardBoosts(startAt, endAt int64) []*RewardBoostMaster {
+	boosts := make([]*RewardBoostMaster, 0)
+	for _, v := range d.rewardBoosts {
+		if v.StartAt < endAt && v.EndAt > startAt {
+			boosts = append(boosts, v)
+		}
+	}
+	return boosts
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	MasterDocumentFormatJSON string = "json"
+	MasterDocumentFormatYAML string = "yaml"
+
+	MasterDocumentFormName string = "master" // JSON、YAMLをファイルとしてアップロードする場合のフォーム名
+)
+
+// masterDocumentFormat リクエストのContent-Typeからマスタのドキュメント形式を判定する。CSVの場合は空文字を返す
+func masterDocumentFormat(contentType string) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case echo.MIMEApplicationJSON:
+		return MasterDocumentFormatJSON
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return MasterDocumentFormatYAML
+	}
+	return ""
+}
+
+// masterDocumentFormatByFilename ファイルの拡張子からマスタのドキュメント形式を判定する
+func masterDocumentFormatByFilename(filename string) (string, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return MasterDocumentFormatJSON, nil
+	case ".yaml", ".yml":
+		return MasterDocumentFormatYAML, nil
+	}
+	return "", fmt.Errorf("unsupported master document: %s", filename)
+}
+
+// readMasterDocument リクエストボディまたはアップロードされたファイルからマスタのドキュメントを読み込む
+// ドキュメントでない場合はnilを返す
+func readMasterDocument(c echo.Context) ([]byte, string, error) {
+	if format := masterDocumentFormat(c.Request().Header.Get(echo.HeaderContentType)); format != "" {
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return nil, "", err
+		}
+		return body, format, nil
+	}
+
+	file, err := c.FormFile(MasterDocumentFormName)
+	if err != nil {
+		return nil, "", nil
+	}
+	format, err := masterDocumentFormatByFilename(file.Filename)
+	if err != nil {
+		return nil, "", err
+	}
+	src, err := file.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+
+	body, err := io.ReadAll(src)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, format, nil
+}
+
+// parseMasterDocument フォーム名をキーとしたJSON、YAMLのドキュメントを型付きの行に変換する
+// CSVと同じ検証を行い、エラーの行番号は1始まりの要素番号とする
+func parseMasterDocument(data []byte, format string) (map[string]*masterUpload, []*MasterValidationError, error) {
+	doc := make(map[string][]map[string]interface{})
+	switch format {
+	case MasterDocumentFormatJSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, nil, err
+		}
+	case MasterDocumentFormatYAML:
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, nil, err
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported master document format: %s", format)
+	}
+
+	uploads := make(map[string]*masterUpload)
+	verrs := make([]*MasterValidationError, 0)
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if findMasterTable(name) == nil {
+			verrs = append(verrs, &MasterValidationError{File: name, Message: "unknown master"})
+		}
+	}
+	for _, t := range masterTables {
+		elements, ok := doc[t.Name]
+		if !ok {
+			continue
+		}
+
+		upload := &masterUpload{
+			Table:      t,
+			Rows:       make([]masterRow, 0, len(elements)),
+			RowNumbers: make([]int, 0, len(elements)),
+		}
+		for i, element := range elements {
+			rowNumber := i + 1
+			values, elementErrs := documentElementValues(t, element, rowNumber)
+			if len(elementErrs) > 0 {
+				verrs = append(verrs, elementErrs...)
+				continue
+			}
+			row, rowErrs := t.parseRow(values, rowNumber)
+			if len(rowErrs) > 0 {
+				verrs = append(verrs, rowErrs...)
+				continue
+			}
+			upload.Rows = append(upload.Rows, row)
+			upload.RowNumbers = append(upload.RowNumbers, rowNumber)
+		}
+		verrs = append(verrs, upload.validateDuplicatedIDs()...)
+		uploads[t.Name] = upload
+	}
+
+	return uploads, verrs, nil
+}
+
+// documentElementValues ドキュメントの1要素をCSVと同じ文字列の値に変換する
+// 省略されたキーはNULLとして扱う
+func documentElementValues(table *masterTable, element map[string]interface{}, rowNumber int) (map[string]string, []*MasterValidationError) {
+	verrs := make([]*MasterValidationError, 0)
+	for key := range element {
+		if table.column(key) == nil {
+			verrs = append(verrs, &MasterValidationError{File: table.Name, Row: rowNumber, Column: key, Message: "unknown column"})
+		}
+	}
+
+	values := make(map[string]string, len(table.Columns))
+	for _, col := range table.Columns {
+		switch v := element[col.Name].(type) {
+		case nil:
+			values[col.Name] = MasterCSVNull
+		case string:
+			values[col.Name] = v
+		case json.Number:
+			values[col.Name] = v.String()
+		case bool:
+			values[col.Name] = col.format(v)
+		case int:
+			values[col.Name] = strconv.Itoa(v)
+		case int64:
+			values[col.Name] = strconv.FormatInt(v, 10)
+		case uint64:
+			values[col.Name] = strconv.FormatUint(v, 10)
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				values[col.Name] = strconv.FormatInt(int64(v), 10)
+			} else {
+				values[col.Name] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		default:
+			verrs = append(verrs, &MasterValidationError{File: table.Name, Row: rowNumber, Column: col.Name, Message: fmt.Sprintf("unsupported value: %T", v)})
+		}
+	}
+	return values, verrs
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	MasterExportFormatCSV  string = "csv"
+	MasterExportFormatJSON string = "json"
+
+	MasterCSVNull string = `\N` // CSVでNULLを表す値。空文字の文字列と区別するため、LOAD DATAと同じ表記を使う
+)
+
+// adminExportMaster マスタデータのエクスポート
+// GET /admin/master/export?format=csv|json&tables=itemMaster,gachaMaster
+// csvはマスタ更新のファイルと同じ形式で、複数のマスタを指定した場合はzipにまとめる
+// jsonはフォーム名をキーとした1つのドキュメントを返す
+func (h *Handler) adminExportMaster(c echo.Context) error {
+	format := c.QueryParam("format")
+	if format == "" {
+		format = MasterExportFormatCSV
+	}
+	if format != MasterExportFormatCSV && format != MasterExportFormatJSON {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid format: %s", format))
+	}
+
+	tables := make([]*masterTable, 0, len(masterTables))
+	if v := c.QueryParam("tables"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			t := findMasterTable(strings.TrimSpace(name))
+			if t == nil {
+				return errorResponse(c, http.StatusBadRequest, fmt.Errorf("unknown master: %s", name))
+			}
+			tables = append(tables, t)
+		}
+	} else {
+		tables = append(tables, masterTables...)
+	}
+
+	uploads := make(map[string]*masterUpload, len(tables))
+	for _, t := range tables {
+		rows, err := selectMasterRows(h.DB, t)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		uploads[t.Name] = &masterUpload{Table: t, Rows: rows}
+	}
+
+	if format == MasterExportFormatJSON {
+		data, err := encodeMasterBundle(uploads)
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		return attachmentResponse(c, "master.json", echo.MIMEApplicationJSONCharsetUTF8, data)
+	}
+
+	if len(tables) == 1 {
+		data, err := encodeMasterCSV(uploads[tables[0].Name])
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		return attachmentResponse(c, tables[0].Name+".csv", "text/csv; charset=UTF-8", data)
+	}
+
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, t := range tables {
+		data, err := encodeMasterCSV(uploads[t.Name])
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		w, err := zw.Create(t.Name + ".csv")
+		if err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if _, err = w.Write(data); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	return attachmentResponse(c, "master.zip", "application/zip", buf.Bytes())
+}
+
+// encodeMasterCSV マスタ更新で受け付ける形式(ヘッダ行あり)のCSVに変換する
+func encodeMasterCSV(upload *masterUpload) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+
+	header := make([]string, 0, len(upload.Table.Columns))
+	for _, col := range upload.Table.Columns {
+		header = append(header, col.Name)
+	}
+	if err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	for _, row := range upload.Rows {
+		record := make([]string, 0, len(upload.Table.Columns))
+		for _, col := range upload.Table.Columns {
+			record = append(record, col.format(row[col.Name]))
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// format カラムの値をCSVの文字列に変換する。NULLはMasterCSVNullになる
+func (col *masterColumn) format(v interface{}) string {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case bool:
+		if v {
+			return "TRUE"
+		}
+		return "FALSE"
+	case string:
+		return v
+	}
+	return MasterCSVNull
+}
+
+// attachmentResponse ファイルとしてダウンロードさせるレスポンス
+func attachmentResponse(c echo.Context, filename, contentType string, data []byte) error {
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	return c.Blob(http.StatusOK, contentType, data)
+}
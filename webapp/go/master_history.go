@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	ErrMasterSnapshotNotFound error = fmt.Errorf("not found master snapshot")
+)
+
+const (
+	MasterSnapshotActionInitial  string = "initial" // 最初の変更前の状態
+	MasterSnapshotActionUpdate   string = "update"
+	MasterSnapshotActionRollback string = "rollback"
+	MasterSnapshotActionRelease  string = "release"
+)
+
+// takeMasterSnapshot 全マスタの現在の内容を有効なバージョンのスナップショットとして保存する
+func (h *Handler) takeMasterSnapshot(tx *sqlx.Tx, adminUserID int64, action string, requestAt int64) (*MasterSnapshot, error) {
+	activeMaster := new(VersionMaster)
+	if err := tx.Get(activeMaster, "SELECT * FROM version_masters WHERE status=1"); err != nil {
+		return nil, err
+	}
+
+	tables := make(map[string]*masterUpload, len(masterTables))
+	for _, t := range masterTables {
+		rows, err := selectMasterRows(tx, t)
+		if err != nil {
+			return nil, err
+		}
+		tables[t.Name] = &masterUpload{Table: t, Rows: rows}
+	}
+	data, err := encodeMasterBundle(tables)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotID, err := h.generateID()
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &MasterSnapshot{
+		ID:            snapshotID,
+		VersionID:     activeMaster.ID,
+		MasterVersion: activeMaster.MasterVersion,
+		AdminID:       adminUserID,
+		Action:        action,
+		CreatedAt:     requestAt,
+	}
+	query := "INSERT INTO master_snapshots(id, version_id, master_version, admin_id, action, data, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	if _, err = tx.Exec(query, snapshot.ID, snapshot.VersionID, snapshot.MasterVersion, snapshot.AdminID, snapshot.Action, data, snapshot.CreatedAt); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// takeInitialMasterSnapshot スナップショットがまだない場合に、変更前のマスタを保存する
+// 初期データのマスタにもロールバックできるよう、マスタを変更する前に呼び出す
+func (h *Handler) takeInitialMasterSnapshot(tx *sqlx.Tx, adminUserID int64, requestAt int64) error {
+	var exists bool
+	if err := tx.Get(&exists, "SELECT EXISTS(SELECT 1 FROM master_snapshots)"); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	_, err := h.takeMasterSnapshot(tx, adminUserID, MasterSnapshotActionInitial, requestAt)
+	return err
+}
+
+// encodeMasterBundle マスタごとの行をスナップショットや予約リリースの保存形式(JSON)に変換する
+func encodeMasterBundle(uploads map[string]*masterUpload) ([]byte, error) {
+	tables := make(map[string][]masterRow, len(uploads))
+	for name, upload := range uploads {
+		tables[name] = upload.Rows
+	}
+	return json.Marshal(tables)
+}
+
+// decodeMasterBundle 保存形式(JSON)のデータをマスタごとの行に変換する
+func decodeMasterBundle(data []byte) (map[string]*masterUpload, error) {
+	raw := make(map[string][]map[string]interface{})
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	uploads := make(map[string]*masterUpload, len(raw))
+	for _, t := range masterTables {
+		values, ok := raw[t.Name]
+		if !ok {
+			continue
+		}
+		upload := &masterUpload{Table: t, Rows: make([]masterRow, 0, len(values))}
+		for _, v := range values {
+			row := make(masterRow, len(t.Columns))
+			for _, col := range t.Columns {
+				var err error
+				if row[col.Name], err = col.scan(v[col.Name]); err != nil {
+					return nil, err
+				}
+			}
+			upload.Rows = append(upload.Rows, row)
+		}
+		uploads[t.Name] = upload
+	}
+	return uploads, nil
+}
+
+// adminListMasterVersions マスタの更新履歴
+// GET /admin/master/versions
+func (h *Handler) adminListMasterVersions(c echo.Context) error {
+	snapshots := make([]*MasterSnapshot, 0)
+	query := "SELECT id, version_id, master_version, admin_id, action, created_at FROM master_snapshots ORDER BY created_at DESC, id DESC"
+	if err := h.DB.Select(&snapshots, query); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	versions := make([]*VersionMaster, 0)
+	if err := h.DB.Select(&versions, "SELECT * FROM version_masters ORDER BY id"); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminListMasterVersionsResponse{
+		VersionMasters: versions,
+		Snapshots:      snapshots,
+	})
+}
+
+type AdminListMasterVersionsResponse struct {
+	VersionMasters []*VersionMaster  `json:"versionMasters"`
+	Snapshots      []*MasterSnapshot `json:"snapshots"`
+}
+
+// adminRollbackMaster 指定したバージョンの最新のスナップショットにマスタを戻す
+// 最新のスナップショットは現在のマスタそのものなので除く。有効なバージョンを指定した場合は直前の変更を取り消す
+// POST /admin/master/rollback/{versionID}
+func (h *Handler) adminRollbackMaster(c echo.Context) error {
+	versionID, err := strconv.ParseInt(c.Param("versionID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid versionID parameter"))
+	}
+
+	adminUserID, err := getAdminUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	var currentID int64
+	query := "SELECT id FROM master_snapshots ORDER BY created_at DESC, id DESC LIMIT 1"
+	if err = tx.Get(&currentID, query); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrMasterSnapshotNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	var data []byte
+	query = "SELECT data FROM master_snapshots WHERE version_id=? AND id<>? ORDER BY created_at DESC, id DESC LIMIT 1"
+	if err = tx.Get(&data, query, versionID, currentID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrMasterSnapshotNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	uploads, err := decodeMasterBundle(data)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	for _, t := range masterTables {
+		// バージョンは履歴として残し、有効なバージョンの切り替えだけを行う
+		if t.Name == "versionMaster" {
+			continue
+		}
+		upload, ok := uploads[t.Name]
+		if !ok {
+			continue
+		}
+		if _, err = tx.Exec(fmt.Sprintf("DELETE FROM %s", t.Table)); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+		if err = upsertMaster(tx, upload); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	if upload, ok := uploads["versionMaster"]; ok {
+		for _, row := range upload.Rows {
+			if row.int("id") != versionID {
+				continue
+			}
+			query = "INSERT INTO version_masters(id, status, master_version) VALUES (?, 1, ?) ON DUPLICATE KEY UPDATE status=1, master_version=VALUES(master_version)"
+			if _, err = tx.Exec(query, versionID, row["master_version"]); err != nil {
+				return errorResponse(c, http.StatusInternalServerError, err)
+			}
+		}
+	}
+	if _, err = tx.Exec("UPDATE version_masters SET status=2 WHERE status=1 AND id<>?", versionID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	snapshot, err := h.takeMasterSnapshot(tx, adminUserID, MasterSnapshotActionRollback, requestAt)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	activeMaster := new(VersionMaster)
+	if err = tx.Get(activeMaster, "SELECT * FROM version_masters WHERE status=1"); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	h.reloadMasterCache(c.Logger())
+
+	return successResponse(c, &AdminRollbackMasterResponse{
+		VersionMaster: activeMaster,
+		Snapshot:      snapshot,
+	})
+}
+
+type AdminRollbackMasterResponse struct {
+	VersionMaster *VersionMaster  `json:"versionMaster"`
+	Snapshot      *MasterSnapshot `json:"snapshot"`
+}
+
+type MasterSnapshot struct {
+	ID            int64  `json:"id" db:"id"`
+	VersionID     int64  `json:"versionId" db:"version_id"`
+	MasterVersion string `json:"masterVersion" db:"master_version"`
+	AdminID       int64  `json:"adminId" db:"admin_id"`
+	Action        string `json:"action" db:"action"`
+	CreatedAt     int64  `json:"createdAt" db:"created_at"`
+}
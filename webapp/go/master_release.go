@@ -0,0 +1,350 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrMasterReleaseNotFound   error = fmt.Errorf("not found master release")
+	ErrMasterReleaseNotPending error = fmt.Errorf("master release is not pending")
+	ErrInvalidActivateAt       error = fmt.Errorf("activateAt must be in the future")
+)
+
+const (
+	MasterReleaseStatusPending  string = "pending"
+	MasterReleaseStatusReleased string = "released"
+	MasterReleaseStatusCanceled string = "canceled"
+	MasterReleaseStatusFailed   string = "failed"
+)
+
+// adminScheduleMasterRelease マスタの予約リリースの登録
+// POST /admin/master/releases
+// マスタ更新と同じ形式のファイルに加え、activateAtに反映日時を指定する
+func (h *Handler) adminScheduleMasterRelease(c echo.Context) error {
+	adminUserID, err := getAdminUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	activateAt, err := strconv.ParseInt(c.FormValue("activateAt"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid activateAt"))
+	}
+	// 反映はrunMasterReleaseSchedulerがサーバ時刻で判定するため、予約も同じ時刻と比べる
+	if activateAt <= h.Clock.Now().Unix() {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidActivateAt)
+	}
+
+	uploads, verrs, err := readMasterUploads(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if len(verrs) > 0 {
+		return masterValidationErrorResponse(c, verrs)
+	}
+	if len(uploads) == 0 {
+		return errorResponse(c, http.StatusBadRequest, ErrNoFormFile)
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 反映時にも再検証するが、登録時点のマスタに対しても整合性を確認しておく
+	verrs, err = validateMasterReferences(tx, uploads)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if len(verrs) > 0 {
+		return masterValidationErrorResponse(c, verrs)
+	}
+
+	data, err := encodeMasterBundle(uploads)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	tables := make([]string, 0, len(uploads))
+	for _, t := range masterTables {
+		if _, ok := uploads[t.Name]; ok {
+			tables = append(tables, t.Name)
+		}
+	}
+
+	releaseID, err := h.generateID()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	release := &MasterRelease{
+		ID:         releaseID,
+		AdminID:    adminUserID,
+		Tables:     strings.Join(tables, ","),
+		ActivateAt: activateAt,
+		Status:     MasterReleaseStatusPending,
+		CreatedAt:  requestAt,
+		UpdatedAt:  requestAt,
+	}
+	query := "INSERT INTO master_releases(id, admin_id, table_names, data, activate_at, status, message, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	if _, err = tx.Exec(query, release.ID, release.AdminID, release.Tables, data, release.ActivateAt, release.Status, release.Message, release.CreatedAt, release.UpdatedAt); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminMasterReleaseResponse{
+		Release: release,
+	})
+}
+
+// adminListMasterReleases マスタの予約リリース一覧
+// GET /admin/master/releases
+func (h *Handler) adminListMasterReleases(c echo.Context) error {
+	releases := make([]*MasterRelease, 0)
+	query := "SELECT id, admin_id, table_names, activate_at, status, message, released_at, created_at, updated_at FROM master_releases"
+	args := []interface{}{}
+	if status := c.QueryParam("status"); status != "" {
+		query += " WHERE status=?"
+		args = append(args, status)
+	}
+	query += " ORDER BY activate_at DESC, id DESC"
+	if err := h.DB.Select(&releases, query, args...); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminListMasterReleasesResponse{
+		Releases: releases,
+	})
+}
+
+type AdminListMasterReleasesResponse struct {
+	Releases []*MasterRelease `json:"releases"`
+}
+
+// adminRescheduleMasterRelease マスタの予約リリースの反映日時の変更
+// PUT /admin/master/releases/{releaseID}
+func (h *Handler) adminRescheduleMasterRelease(c echo.Context) error {
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	defer c.Request().Body.Close()
+	req := new(AdminRescheduleMasterReleaseRequest)
+	if err = parseRequestBody(c, req); err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	if req.ActivateAt <= h.Clock.Now().Unix() {
+		return errorResponse(c, http.StatusBadRequest, ErrInvalidActivateAt)
+	}
+
+	return h.updatePendingMasterRelease(c, func(release *MasterRelease) {
+		release.ActivateAt = req.ActivateAt
+		release.UpdatedAt = requestAt
+	})
+}
+
+type AdminRescheduleMasterReleaseRequest struct {
+	ActivateAt int64 `json:"activateAt"`
+}
+
+// adminCancelMasterRelease マスタの予約リリースの取り消し
+// DELETE /admin/master/releases/{releaseID}
+func (h *Handler) adminCancelMasterRelease(c echo.Context) error {
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	return h.updatePendingMasterRelease(c, func(release *MasterRelease) {
+		release.Status = MasterReleaseStatusCanceled
+		release.UpdatedAt = requestAt
+	})
+}
+
+// updatePendingMasterRelease 反映待ちの予約リリースを更新する
+func (h *Handler) updatePendingMasterRelease(c echo.Context, update func(release *MasterRelease)) error {
+	releaseID, err := strconv.ParseInt(c.Param("releaseID"), 10, 64)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid releaseID parameter"))
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	release := new(MasterRelease)
+	query := "SELECT id, admin_id, table_names, activate_at, status, message, released_at, created_at, updated_at FROM master_releases WHERE id=? FOR UPDATE"
+	if err = tx.Get(release, query, releaseID); err != nil {
+		if err == sql.ErrNoRows {
+			return errorResponse(c, http.StatusNotFound, ErrMasterReleaseNotFound)
+		}
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	if release.Status != MasterReleaseStatusPending {
+		return errorResponse(c, http.StatusConflict, ErrMasterReleaseNotPending)
+	}
+
+	update(release)
+	query = "UPDATE master_releases SET activate_at=?, status=?, updated_at=? WHERE id=?"
+	if _, err = tx.Exec(query, release.ActivateAt, release.Status, release.UpdatedAt, release.ID); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminMasterReleaseResponse{
+		Release: release,
+	})
+}
+
+type AdminMasterReleaseResponse struct {
+	Release *MasterRelease `json:"release"`
+}
+
+// runMasterReleaseScheduler 反映日時を過ぎた予約リリースを定期的に反映する
+func (h *Handler) runMasterReleaseScheduler(logger echo.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := h.Clock.Now().Unix()
+		releaseIDs := make([]int64, 0)
+		query := "SELECT id FROM master_releases WHERE status=? AND activate_at<=? ORDER BY activate_at, id"
+		if err := h.DB.Select(&releaseIDs, query, MasterReleaseStatusPending, now); err != nil {
+			logger.Errorf("failed to select master releases: %v", err)
+			continue
+		}
+		for _, releaseID := range releaseIDs {
+			if err := h.promoteMasterRelease(releaseID, now); err != nil {
+				logger.Errorf("failed to promote master release: id=%d, err=%v", releaseID, err)
+				// DBの一時的なエラーは次の周期で再試行する。内容の不正は再試行しても反映できない
+				if !isMasterReleaseDataError(err) {
+					continue
+				}
+				if err = h.failMasterRelease(releaseID, err, now); err != nil {
+					logger.Errorf("failed to update master release: id=%d, err=%v", releaseID, err)
+				}
+				continue
+			}
+			logger.Infof("master release promoted: id=%d", releaseID)
+			h.reloadMasterCache(logger)
+		}
+	}
+}
+
+// promoteMasterRelease 予約リリースを1トランザクションで反映する
+func (h *Handler) promoteMasterRelease(releaseID, now int64) error {
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// 複数のサーバで同時に反映しないように行ロックを取ってから状態を確認する
+	release := struct {
+		AdminID int64  `db:"admin_id"`
+		Status  string `db:"status"`
+		Data    []byte `db:"data"`
+	}{}
+	query := "SELECT admin_id, status, data FROM master_releases WHERE id=? FOR UPDATE"
+	if err = tx.Get(&release, query, releaseID); err != nil {
+		return err
+	}
+	if release.Status != MasterReleaseStatusPending {
+		return nil
+	}
+
+	uploads, err := decodeMasterBundle(release.Data)
+	if err != nil {
+		return &masterReleaseDataError{err: err}
+	}
+	verrs, err := validateMasterReferences(tx, uploads)
+	if err != nil {
+		return err
+	}
+	if len(verrs) > 0 {
+		return verrs[0]
+	}
+	if err = h.takeInitialMasterSnapshot(tx, release.AdminID, now); err != nil {
+		return err
+	}
+	for _, t := range masterTables {
+		if upload, ok := uploads[t.Name]; ok {
+			if err = upsertMaster(tx, upload); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err = h.takeMasterSnapshot(tx, release.AdminID, MasterSnapshotActionRelease, now); err != nil {
+		return err
+	}
+
+	query = "UPDATE master_releases SET status=?, released_at=?, updated_at=? WHERE id=?"
+	if _, err = tx.Exec(query, MasterReleaseStatusReleased, now, now, releaseID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// masterReleaseDataError 予約リリースのデータを読み込めない
+type masterReleaseDataError struct {
+	err error
+}
+
+func (e *masterReleaseDataError) Error() string {
+	return fmt.Sprintf("invalid master release data: %v", e.err)
+}
+
+// isMasterReleaseDataError 予約リリースの内容に起因するエラーか
+func isMasterReleaseDataError(err error) bool {
+	var verr *MasterValidationError
+	var derr *masterReleaseDataError
+	return errors.As(err, &verr) || errors.As(err, &derr)
+}
+
+// failMasterRelease 反映に失敗した予約リリースを失敗として記録する
+func (h *Handler) failMasterRelease(releaseID int64, cause error, now int64) error {
+	message := cause.Error()
+	if len(message) > 255 {
+		message = message[:255]
+	}
+	query := "UPDATE master_releases SET status=?, message=?, updated_at=? WHERE id=? AND status=?"
+	_, err := h.DB.Exec(query, MasterReleaseStatusFailed, message, now, releaseID, MasterReleaseStatusPending)
+	return err
+}
+
+type MasterRelease struct {
+	ID         int64  `json:"id" db:"id"`
+	AdminID    int64  `json:"adminId" db:"admin_id"`
+	Tables     string `json:"tables" db:"table_names"` // 含まれるマスタのフォーム名(カンマ区切り)
+	ActivateAt int64  `json:"activateAt" db:"activate_at"`
+	Status     string `json:"status" db:"status"`
+	Message    string `json:"message" db:"message"` // 反映に失敗した場合の理由
+	ReleasedAt *int64 `json:"releasedAt" db:"released_at"`
+	CreatedAt  int64  `json:"createdAt" db:"created_at"`
+	UpdatedAt  int64  `json:"updatedAt" db:"updated_at"`
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	PresentSegmentMaxUsers    int    = 1000000
+	PresentSegmentBatchSize   int    = 1000    // 1回のINSERTで登録するユーザ数
+	PresentSegmentFormName    string = "users" // ユーザIDのCSVをアップロードする場合のフォーム名
+	PresentSegmentMaxNameSize int    = 255
+)
+
+var (
+	ErrPresentSegmentNoName       error = fmt.Errorf("name is required")
+	ErrPresentSegmentNameTooLong  error = fmt.Errorf("name must be at most %d characters", PresentSegmentMaxNameSize)
+	ErrPresentSegmentNoUsers      error = fmt.Errorf("no user ids")
+	ErrPresentSegmentTooManyUsers error = fmt.Errorf("user ids must be at most %d", PresentSegmentMaxUsers)
+	ErrPresentSegmentInvalidUsers error = fmt.Errorf("invalid user ids")
+)
+
+// adminCreatePresentSegment 全員プレゼントの配布対象とするユーザIDの一覧を登録する
+// 登録したセグメントはpresent_all_mastersのtarget_segment_idで指定する
+// POST /admin/present/segments
+func (h *Handler) adminCreatePresentSegment(c echo.Context) error {
+	requestAt, err := getRequestTime(c)
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, ErrGetRequestTime)
+	}
+
+	adminUserID, err := getAdminUserID(c)
+	if err != nil {
+		return errorResponse(c, http.StatusUnauthorized, err)
+	}
+
+	req, rows, err := readPresentSegmentRequest(c)
+	if err != nil {
+		return errorResponse(c, http.StatusBadRequest, err)
+	}
+	invalids := make([]*userIDRecord, 0)
+	for _, row := range rows {
+		if row.UserID == nil {
+			invalids = append(invalids, row)
+		}
+	}
+	if len(invalids) > 0 {
+		return presentSegmentInvalidRowsResponse(c, invalids)
+	}
+
+	userIDs := make([]int64, 0, len(rows))
+	seen := make(map[int64]struct{}, len(rows))
+	for _, row := range rows {
+		if _, ok := seen[*row.UserID]; ok {
+			continue
+		}
+		seen[*row.UserID] = struct{}{}
+		userIDs = append(userIDs, *row.UserID)
+	}
+
+	segmentID, err := h.generateID()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	segment := &PresentSegment{
+		ID:        segmentID,
+		Name:      req.Name,
+		UserCount: int64(len(userIDs)),
+		AdminID:   adminUserID,
+		CreatedAt: requestAt,
+	}
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	query := "INSERT INTO present_segments(id, name, user_count, admin_id, created_at) VALUES (?, ?, ?, ?, ?)"
+	if _, err = tx.Exec(query, segment.ID, segment.Name, segment.UserCount, segment.AdminID, segment.CreatedAt); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	for start := 0; start < len(userIDs); start += PresentSegmentBatchSize {
+		end := start + PresentSegmentBatchSize
+		if end > len(userIDs) {
+			end = len(userIDs)
+		}
+		members := make([]map[string]interface{}, 0, end-start)
+		for _, userID := range userIDs[start:end] {
+			members = append(members, map[string]interface{}{"segment_id": segment.ID, "user_id": userID})
+		}
+		query = "INSERT INTO present_segment_users(segment_id, user_id) VALUES (:segment_id, :user_id)"
+		if _, err = tx.NamedExec(query, members); err != nil {
+			return errorResponse(c, http.StatusInternalServerError, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminCreatePresentSegmentResponse{
+		PresentSegment: segment,
+	})
+}
+
+// adminListPresentSegments 登録済みのセグメント一覧
+// GET /admin/present/segments
+func (h *Handler) adminListPresentSegments(c echo.Context) error {
+	segments := make([]*PresentSegment, 0)
+	if err := h.DB.Select(&segments, "SELECT * FROM present_segments ORDER BY id DESC"); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	return successResponse(c, &AdminListPresentSegmentsResponse{
+		PresentSegments: segments,
+	})
+}
+
+// readPresentSegmentRequest JSONのボディ、またはユーザIDのCSVをアップロードしたフォームからセグメントを読み込む
+func readPresentSegmentRequest(c echo.Context) (*AdminCreatePresentSegmentRequest, []*userIDRecord, error) {
+	defer c.Request().Body.Close()
+	req := new(AdminCreatePresentSegmentRequest)
+	rows := make([]*userIDRecord, 0)
+
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if mediaType == echo.MIMEMultipartForm {
+		req.Name = c.FormValue("name")
+		records, err := readFormFileToCSV(c, PresentSegmentFormName)
+		if err != nil {
+			return nil, nil, err
+		}
+		rows = parseUserIDCSV(records)
+	} else {
+		if err := parseRequestBody(c, req); err != nil {
+			return nil, nil, err
+		}
+		for i, userID := range req.UserIDs {
+			userID := userID
+			rows = append(rows, &userIDRecord{Row: i + 1, UserID: &userID})
+		}
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return nil, nil, ErrPresentSegmentNoName
+	}
+	if len([]rune(req.Name)) > PresentSegmentMaxNameSize {
+		return nil, nil, ErrPresentSegmentNameTooLong
+	}
+	if len(rows) == 0 {
+		return nil, nil, ErrPresentSegmentNoUsers
+	}
+	if len(rows) > PresentSegmentMaxUsers {
+		return nil, nil, ErrPresentSegmentTooManyUsers
+	}
+
+	return req, rows, nil
+}
+
+// presentSegmentInvalidRowsResponse 不正なユーザIDを含むセグメントのエラーレスポンス。不正な行をすべて返す
+func presentSegmentInvalidRowsResponse(c echo.Context, rows []*userIDRecord) error {
+	c.Logger().Errorf("status=%d, err=%+v, rows=%d", http.StatusBadRequest, errors.WithStack(ErrPresentSegmentInvalidUsers), len(rows))
+
+	return c.JSON(http.StatusBadRequest, struct {
+		StatusCode int             `json:"status_code"`
+		Message    string          `json:"message"`
+		Errors     []*userIDRecord `json:"errors"`
+	}{
+		StatusCode: http.StatusBadRequest,
+		Message:    ErrPresentSegmentInvalidUsers.Error(),
+		Errors:     rows,
+	})
+}
+
+// presentAllTargetUser 全員プレゼントの配布対象の判定に使うユーザの状態
+// 条件を指定したプレゼントがある場合にのみ、必要な値を読み込む
+type presentAllTargetUser struct {
+	tx      Repositories
+	masters *MasterData
+	userID  int64
+
+	lastActivatedAt    *int64
+	platformTypes      map[int]bool
+	loginBonusProgress map[int64]int64
+}
+
+func newPresentAllTargetUser(tx Repositories, masters *MasterData, userID int64) *presentAllTargetUser {
+	return &presentAllTargetUser{
+		tx:                 tx,
+		masters:            masters,
+		userID:             userID,
+		loginBonusProgress: make(map[int64]int64),
+	}
+}
+
+// match ユーザがプレゼントの配布条件をすべて満たすか
+func (u *presentAllTargetUser) match(target *PresentAllTarget) (bool, error) {
+	if target.PlatformType != nil {
+		if u.platformTypes == nil {
+			platformTypes, err := u.tx.ListUserPlatformTypes(u.userID)
+			if err != nil {
+				return false, err
+			}
+			u.platformTypes = make(map[int]bool, len(platformTypes))
+			for _, v := range platformTypes {
+				u.platformTypes[v] = true
+			}
+		}
+		if !u.platformTypes[*target.PlatformType] {
+			return false, nil
+		}
+	}
+
+	if target.LastActivatedFrom != nil || target.LastActivatedTo != nil {
+		// ログイン処理でlast_activated_atを更新する前に呼ぶため、前回のログイン日時となる
+		if u.lastActivatedAt == nil {
+			user, err := u.tx.GetUser(u.userID)
+			if err != nil {
+				if err == sql.ErrNoRows {
+					return false, ErrUserNotFound
+				}
+				return false, err
+			}
+			u.lastActivatedAt = &user.LastActivatedAt
+		}
+		if target.LastActivatedFrom != nil && *u.lastActivatedAt < *target.LastActivatedFrom {
+			return false, nil
+		}
+		if target.LastActivatedTo != nil && *u.lastActivatedAt > *target.LastActivatedTo {
+			return false, nil
+		}
+	}
+
+	if target.LoginBonusID != nil && target.LoginBonusMinProgress != nil {
+		progress, ok := u.loginBonusProgress[*target.LoginBonusID]
+		if !ok {
+			// ループしたボーナスは周回分も含めた累計の受け取り回数とする
+			userBonus, err := u.tx.GetUserLoginBonus(u.userID, *target.LoginBonusID)
+			if err != nil && err != sql.ErrNoRows {
+				return false, err
+			}
+			bonus, ok := u.masters.LoginBonus(*target.LoginBonusID)
+			if userBonus != nil && userBonus.DeletedAt == nil && ok {
+				progress = int64((userBonus.LoopCount-1)*bonus.ColumnCount + userBonus.LastRewardSequence)
+			}
+			u.loginBonusProgress[*target.LoginBonusID] = progress
+		}
+		if progress < *target.LoginBonusMinProgress {
+			return false, nil
+		}
+	}
+
+	if target.SegmentID != nil {
+		exists, err := u.tx.ExistsPresentSegmentUser(*target.SegmentID, u.userID)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// PresentAllTarget 全員プレゼントの配布条件。NULLの条件は判定しない
+type PresentAllTarget struct {
+	PlatformType          *int   `json:"targetPlatformType" db:"target_platform_type"`
+	LastActivatedFrom     *int64 `json:"targetLastActivatedFrom" db:"target_last_activated_from"`
+	LastActivatedTo       *int64 `json:"targetLastActivatedTo" db:"target_last_activated_to"`
+	LoginBonusID          *int64 `json:"targetLoginBonusId" db:"target_login_bonus_id"`
+	LoginBonusMinProgress *int64 `json:"targetLoginBonusMinProgress" db:"target_login_bonus_min_progress"`
+	SegmentID             *int64 `json:"targetSegmentId" db:"target_segment_id"`
+}
+
+type PresentSegment struct {
+	ID        int64  `json:"id" db:"id"`
+	Name      string `json:"name" db:"name"`
+	UserCount int64  `json:"userCount" db:"user_count"`
+	AdminID   int64  `json:"adminId" db:"admin_id"`
+	CreatedAt int64  `json:"createdAt" db:"created_at"`
+}
+
+type AdminCreatePresentSegmentRequest struct {
+	Name    string  `json:"name"`
+	UserIDs []int64 `json:"userIds"`
+}
+
+type AdminCreatePresentSegmentResponse struct {
+	PresentSegment *PresentSegment `json:"presentSegment"`
+}
+
+type AdminListPresentSegmentsResponse struct {
+	PresentSegments []*PresentSegment `json:"presentSegments"`
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	ErrTooManyRequests error = fmt.Errorf("too many requests")
+)
+
+const (
+	RateLimitGroupAuth  string = "auth"  // POST /user, POST /login
+	RateLimitGroupUser  string = "user"  // セッション確認済みのユーザ向けAPI
+	RateLimitGroupAdmin string = "admin" // 管理者向けAPI
+
+	RateLimitSweepInterval time.Duration = time.Minute
+)
+
+// RateLimitRule トークンバケットの設定
+type RateLimitRule struct {
+	Rate  float64 // 1秒あたりに補充されるトークン数
+	Burst float64 // バケットの容量
+}
+
+// RateLimitConfig ルートグループごとの制限設定。nilの項目は制限しない
+// ユーザごとの制限はセッションを確認したuserグループでのみ行う
+type RateLimitConfig struct {
+	IP     *RateLimitRule
+	User   *RateLimitRule
+	Viewer *RateLimitRule
+}
+
+// RateLimitBucket 制限に使うバケットのキーと設定
+type RateLimitBucket struct {
+	Key  string
+	Rule *RateLimitRule
+}
+
+// RateLimitStore トークンバケットの保存先
+type RateLimitStore interface {
+	// Take すべてのバケットからトークンを1つずつ消費する
+	// 1つでも消費できないバケットがある場合はどのバケットも消費せず、次にトークンが補充されるまでの時間を返す
+	Take(buckets []*RateLimitBucket, now time.Time) (bool, time.Duration, error)
+}
+
+// parseRateLimitRule "rate,burst" 形式の設定値をパースする。空文字の場合はnilを返す
+func parseRateLimitRule(v string) (*RateLimitRule, error) {
+	if v == "" {
+		return nil, nil
+	}
+	parts := strings.Split(v, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid rate limit rule: %s", v)
+	}
+	rate, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("invalid rate limit rate: %s", v)
+	}
+	burst, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || burst < 1 {
+		return nil, fmt.Errorf("invalid rate limit burst: %s", v)
+	}
+	return &RateLimitRule{Rate: rate, Burst: burst}, nil
+}
+
+// loadRateLimitConfigs 環境変数からルートグループごとの制限設定を読み込む
+// ISUCON_RATE_LIMIT_{GROUP}_{IP|VIEWER}="rate,burst"、ISUCON_RATE_LIMIT_USER_USER="rate,burst"
+func loadRateLimitConfigs() (map[string]*RateLimitConfig, error) {
+	configs := make(map[string]*RateLimitConfig)
+	for _, group := range []string{RateLimitGroupAuth, RateLimitGroupUser, RateLimitGroupAdmin} {
+		prefix := "ISUCON_RATE_LIMIT_" + strings.ToUpper(group) + "_"
+		conf := new(RateLimitConfig)
+		var err error
+		if conf.IP, err = parseRateLimitRule(getEnv(prefix+"IP", "")); err != nil {
+			return nil, err
+		}
+		// 認証前のリクエストのユーザIDは詐称できるため、他のユーザのバケットを使い切れないようにする
+		if group == RateLimitGroupUser {
+			if conf.User, err = parseRateLimitRule(getEnv(prefix+"USER", "")); err != nil {
+				return nil, err
+			}
+		}
+		if conf.Viewer, err = parseRateLimitRule(getEnv(prefix+"VIEWER", "")); err != nil {
+			return nil, err
+		}
+		configs[group] = conf
+	}
+	return configs, nil
+}
+
+// newRateLimitStore 設定に応じたバックエンドを作成する。空文字の場合はレート制限を行わない
+func newRateLimitStore(backend string, dbx *sqlx.DB) (RateLimitStore, error) {
+	switch backend {
+	case "":
+		return nil, nil
+	case "memory":
+		return newMemoryRateLimitStore(), nil
+	case "mysql":
+		return &mysqlRateLimitStore{DB: dbx}, nil
+	}
+	return nil, fmt.Errorf("invalid rate limit backend: %s", backend)
+}
+
+// newIPExtractor リクエスト元IPの取得方法を設定から作成する
+// "direct"の場合は接続元のIPを使う。それ以外はカンマ区切りのCIDRを信頼するプロキシとし、X-Forwarded-Forをたどる
+// 信頼しないクライアントから直接届いたX-Forwarded-Forは無視されるため、IPを詐称してレート制限を回避できない
+func newIPExtractor(v string) (echo.IPExtractor, error) {
+	if v == "direct" {
+		return echo.ExtractIPDirect(), nil
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, cidr := range strings.Split(v, ",") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", cidr)
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// rateLimitMiddleware ルートグループの設定に従ってIP、ユーザID、viewerIDごとにリクエスト数を制限するmiddleware
+func (h *Handler) rateLimitMiddleware(group string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			conf := h.RateLimits[group]
+			if h.RateLimitStore == nil || conf == nil {
+				return next(c)
+			}
+
+			buckets := make([]*RateLimitBucket, 0, 3)
+			if conf.IP != nil {
+				buckets = append(buckets, &RateLimitBucket{Key: fmt.Sprintf("%s:ip:%s", group, c.RealIP()), Rule: conf.IP})
+			}
+			// userグループはセッションの確認後に呼ばれるため、パスのユーザIDは本人のもの
+			if conf.User != nil {
+				if userID, err := getUserID(c); err == nil {
+					buckets = append(buckets, &RateLimitBucket{Key: fmt.Sprintf("%s:user:%d", group, userID), Rule: conf.User})
+				}
+			}
+			if conf.Viewer != nil {
+				viewerID, err := peekRateLimitViewerID(c)
+				if err != nil {
+					return errorResponse(c, http.StatusBadRequest, ErrInvalidRequestBody)
+				}
+				if viewerID != "" {
+					buckets = append(buckets, &RateLimitBucket{Key: fmt.Sprintf("%s:viewer:%s", group, viewerID), Rule: conf.Viewer})
+				}
+			}
+			if len(buckets) == 0 {
+				return next(c)
+			}
+
+			allowed, retryAfter, err := h.RateLimitStore.Take(buckets, h.Clock.Now())
+			if err != nil {
+				return errorResponse(c, http.StatusInternalServerError, err)
+			}
+			if !allowed {
+				c.Response().Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+				return errorResponse(c, http.StatusTooManyRequests, ErrTooManyRequests)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// peekRateLimitViewerID リクエストボディからviewerIDを取得する
+// ボディは後続のハンドラで読めるように戻しておく
+func peekRateLimitViewerID(c echo.Context) (string, error) {
+	buf, err := peekRequestBody(c)
+	if err != nil {
+		return "", err
+	}
+	if len(buf) == 0 {
+		return "", nil
+	}
+
+	body := struct {
+		ViewerID string `json:"viewerId"`
+	}{}
+	// ボディの不正はハンドラ側で検出するためここでは無視する
+	_ = json.Unmarshal(buf, &body)
+
+	return body.ViewerID, nil
+}
+
+// takeToken バケットの状態からトークンを1つ消費した結果を計算する
+func takeToken(tokens float64, elapsed time.Duration, rule *RateLimitRule) (float64, bool, time.Duration) {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	tokens = math.Min(rule.Burst, tokens+elapsed.Seconds()*rule.Rate)
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	return tokens, false, time.Duration((1 - tokens) / rule.Rate * float64(time.Second))
+}
+
+// memoryRateLimitStore プロセス内でバケットを管理するRateLimitStore
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryTokenBucket
+	lastSwept time.Time
+}
+
+type memoryTokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	rule      *RateLimitRule
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		buckets: make(map[string]*memoryTokenBucket),
+	}
+}
+
+func (s *memoryRateLimitStore) Take(buckets []*RateLimitBucket, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now)
+
+	// すべてのバケットで消費できることを確認してから反映する
+	tokens := make([]float64, len(buckets))
+	allowed, retryAfter := true, time.Duration(0)
+	for i, v := range buckets {
+		current, elapsed := v.Rule.Burst, time.Duration(0)
+		if b, ok := s.buckets[v.Key]; ok {
+			current, elapsed = b.tokens, now.Sub(b.updatedAt)
+		}
+		var ok bool
+		var wait time.Duration
+		tokens[i], ok, wait = takeToken(current, elapsed, v.Rule)
+		if !ok {
+			allowed = false
+			if wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	if !allowed {
+		return false, retryAfter, nil
+	}
+
+	for i, v := range buckets {
+		s.buckets[v.Key] = &memoryTokenBucket{tokens: tokens[i], updatedAt: now, rule: v.Rule}
+	}
+	return true, 0, nil
+}
+
+// sweep 満タンまで回復したバケットを削除する
+func (s *memoryRateLimitStore) sweep(now time.Time) {
+	if now.Sub(s.lastSwept) < RateLimitSweepInterval {
+		return
+	}
+	for key, b := range s.buckets {
+		if b.tokens+now.Sub(b.updatedAt).Seconds()*b.rule.Rate >= b.rule.Burst {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSwept = now
+}
+
+// mysqlRateLimitStore 複数のアプリケーションサーバで共有するためにDBでバケットを管理するRateLimitStore
+type mysqlRateLimitStore struct {
+	DB *sqlx.DB
+
+	mu        sync.Mutex
+	lastSwept time.Time
+}
+
+func (s *mysqlRateLimitStore) Take(buckets []*RateLimitBucket, now time.Time) (bool, time.Duration, error) {
+	if err := s.sweep(now); err != nil {
+		return false, 0, err
+	}
+
+	tx, err := s.DB.Beginx()
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	// デッドロックを避けるため、キーの順にロックする
+	sorted := append([]*RateLimitBucket{}, buckets...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	tokens := make([]float64, len(sorted))
+	allowed, retryAfter := true, time.Duration(0)
+	for i, v := range sorted {
+		query := "INSERT IGNORE INTO rate_limit_buckets(bucket_key, tokens, updated_at, full_at) VALUES (?, ?, ?, ?)"
+		if _, err = tx.Exec(query, v.Key, v.Rule.Burst, now.UnixMilli(), now.UnixMilli()); err != nil {
+			return false, 0, err
+		}
+
+		bucket := struct {
+			Tokens    float64 `db:"tokens"`
+			UpdatedAt int64   `db:"updated_at"`
+		}{}
+		query = "SELECT tokens, updated_at FROM rate_limit_buckets WHERE bucket_key=? FOR UPDATE"
+		if err = tx.Get(&bucket, query, v.Key); err != nil {
+			return false, 0, err
+		}
+
+		elapsed := time.Duration(now.UnixMilli()-bucket.UpdatedAt) * time.Millisecond
+		var ok bool
+		var wait time.Duration
+		tokens[i], ok, wait = takeToken(bucket.Tokens, elapsed, v.Rule)
+		if !ok {
+			allowed = false
+			if wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	if !allowed {
+		return false, retryAfter, nil
+	}
+
+	for i, v := range sorted {
+		// 満タンまで回復する日時。これを過ぎたバケットはsweepで削除する
+		fullAt := now.Add(time.Duration((v.Rule.Burst - tokens[i]) / v.Rule.Rate * float64(time.Second)))
+		query := "UPDATE rate_limit_buckets SET tokens=?, updated_at=?, full_at=? WHERE bucket_key=?"
+		if _, err = tx.Exec(query, tokens[i], now.UnixMilli(), fullAt.UnixMilli(), v.Key); err != nil {
+			return false, 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, 0, err
+	}
+	return true, 0, nil
+}
+
+// sweep 満タンまで回復したバケットを削除する
+// 削除したバケットは次に使われた時点で満タンの状態から作り直される
+func (s *mysqlRateLimitStore) sweep(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSwept) < RateLimitSweepInterval {
+		return nil
+	}
+	if _, err := s.DB.Exec("DELETE FROM rate_limit_buckets WHERE full_at<=?", now.UnixMilli()); err != nil {
+		return err
+	}
+	s.lastSwept = now
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+// Repository ユーザ向けAPIが読み書きするデータの保存先
+// 本番ではMySQL、テストではメモリ上の実装を使う。該当するデータがない場合はsql.ErrNoRowsを返す
+type Repository interface {
+	Repositories
+	MasterRepository
+
+	// Begin トランザクションを開始する
+	Begin() (RepositoryTx, error)
+	// GenerateID ユニークなIDを生成する。トランザクションとは独立して採番する
+	GenerateID() (int64, error)
+}
+
+// RepositoryTx トランザクション内での読み書き
+type RepositoryTx interface {
+	Repositories
+
+	Commit() error
+	Rollback() error
+}
+
+// Repositories テーブルごとの読み書きをまとめたもの
+type Repositories interface {
+	UserRepository
+	UserDeviceRepository
+	UserBanRepository
+	SessionRepository
+	OneTimeTokenRepository
+	CardRepository
+	DeckRepository
+	ItemRepository
+	LoginBonusRepository
+	PresentRepository
+	StatsEventRepository
+}
+
+type UserRepository interface {
+	// GetUser 削除されていないユーザを取得する
+	GetUser(userID int64) (*User, error)
+	InsertUser(user *User) error
+	UpdateUserCoin(userID, isuCoin int64) error
+	UpdateUserLastActivatedAt(userID, lastActivatedAt int64) error
+	UpdateUserReward(userID, isuCoin, lastGetRewardAt int64) error
+}
+
+type UserDeviceRepository interface {
+	// GetUserDevice 削除されていない端末を取得する
+	GetUserDevice(userID int64, platformID string) (*UserDevice, error)
+	InsertUserDevice(device *UserDevice) error
+	// ListUserPlatformTypes 削除されていない端末のplatform_typeの一覧
+	ListUserPlatformTypes(userID int64) ([]int, error)
+}
+
+type UserBanRepository interface {
+	// GetActiveUserBan 解除済み、期限切れを除いた最新のBANを取得する
+	GetActiveUserBan(userID, requestAt int64) (*UserBan, error)
+}
+
+type SessionRepository interface {
+	// GetSession 削除されていないセッションを取得する
+	GetSession(sessionID string) (*Session, error)
+	InsertSession(sess *Session) error
+	DeleteSession(sessionID string, deletedAt int64) error
+	DeleteUserSessions(userID, deletedAt int64) error
+}
+
+type OneTimeTokenRepository interface {
+	// GetOneTimeToken 削除されていないトークンを取得する
+	GetOneTimeToken(token string, tokenType int) (*UserOneTimeToken, error)
+	InsertOneTimeToken(token *UserOneTimeToken) error
+	DeleteOneTimeToken(token string, deletedAt int64) error
+	DeleteUserOneTimeTokens(userID, deletedAt int64) error
+}
+
+type CardRepository interface {
+	// GetUserCard 削除されていないユーザのカードを取得する
+	GetUserCard(userID, userCardID int64) (*UserCard, error)
+	ListUserCards(userID int64) ([]*UserCard, error)
+	// ListUserCardsByIDs 削除されていないカードをIDで取得する
+	ListUserCardsByIDs(userCardIDs []int64) ([]*UserCard, error)
+	InsertUserCard(card *UserCard) error
+	// UpdateUserCard 生産性、レベル、経験値を更新する
+	UpdateUserCard(card *UserCard) error
+}
+
+type DeckRepository interface {
+	// GetUserDeck 削除されていないデッキを取得する
+	GetUserDeck(userID int64) (*UserDeck, error)
+	InsertUserDeck(deck *UserDeck) error
+	DeleteUserDecks(userID, deletedAt int64) error
+}
+
+type ItemRepository interface {
+	GetUserItem(userID, userItemID int64) (*UserItem, error)
+	GetUserItemByItemID(userID, itemID int64) (*UserItem, error)
+	ListUserItems(userID int64) ([]*UserItem, error)
+	InsertUserItem(item *UserItem) error
+	UpdateUserItemAmount(userItemID int64, amount int, updatedAt int64) error
+}
+
+type LoginBonusRepository interface {
+	GetUserLoginBonus(userID, loginBonusID int64) (*UserLoginBonus, error)
+	InsertUserLoginBonus(bonus *UserLoginBonus) error
+	// UpdateUserLoginBonus 進捗を更新する
+	UpdateUserLoginBonus(bonus *UserLoginBonus) error
+}
+
+type PresentRepository interface {
+	// ListUserPresents 受け取っていないプレゼントを新しい順に取得する
+	ListUserPresents(userID int64, limit, offset int) ([]*UserPresent, error)
+	CountUserPresents(userID int64) (int, error)
+	// ListUserPresentsByIDs 受け取っていないプレゼントをIDで取得する
+	ListUserPresentsByIDs(presentIDs []int64) ([]*UserPresent, error)
+	InsertUserPresent(present *UserPresent) error
+	DeleteUserPresent(presentID, deletedAt int64) error
+	ExistsPresentAllReceivedHistory(userID, presentAllID int64) (bool, error)
+	InsertPresentAllReceivedHistory(history *UserPresentAllReceivedHistory) error
+	ExistsPresentSegmentUser(segmentID, userID int64) (bool, error)
+}
+
+type StatsEventRepository interface {
+	InsertStatsEvent(event *StatsEvent) error
+}
+
+// MasterRepository マスタデータの読み込み元
+type MasterRepository interface {
+	// LoadMasters 有効なバージョンのマスタ一式を読み込む
+	LoadMasters() (*MasterData, error)
+	// GetMasterCacheKey 保存されているマスタの世代を取得する
+	GetMasterCacheKey() (*MasterCacheKey, error)
+}
@@ -0,0 +1,728 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// MemoryRepository メモリ上に保存するRepository。MySQLなしでハンドラをテストするために使う
+// トランザクションは取り消し用の記録を持つだけで、他のリクエストからは分離されない
+type MemoryRepository struct {
+	memoryRepositories
+	lastID int64
+
+	mastersMu sync.Mutex
+	masters   *MasterData
+}
+
+func NewMemoryRepository(masters *MasterData) *MemoryRepository {
+	return &MemoryRepository{
+		memoryRepositories: memoryRepositories{s: newMemoryStore()},
+		masters:            masters,
+	}
+}
+
+func (r *MemoryRepository) Begin() (RepositoryTx, error) {
+	return &memoryRepositoryTx{memoryRepositories: memoryRepositories{s: r.s, undo: new([]func())}}, nil
+}
+
+func (r *MemoryRepository) GenerateID() (int64, error) {
+	return atomic.AddInt64(&r.lastID, 1), nil
+}
+
+func (r *MemoryRepository) LoadMasters() (*MasterData, error) {
+	r.mastersMu.Lock()
+	defer r.mastersMu.Unlock()
+	if r.masters == nil {
+		return nil, ErrActiveMasterVersionNotFound
+	}
+	return r.masters, nil
+}
+
+func (r *MemoryRepository) GetMasterCacheKey() (*MasterCacheKey, error) {
+	masters, err := r.LoadMasters()
+	if err != nil {
+		return nil, err
+	}
+	key := masters.Key
+	return &key, nil
+}
+
+// SetMasters マスタを差し替える。キャッシュへの反映はMasterCacheのReloadで行う
+func (r *MemoryRepository) SetMasters(masters *MasterData) {
+	r.mastersMu.Lock()
+	defer r.mastersMu.Unlock()
+	r.masters = masters
+}
+
+// InsertUserBan BANを登録する。ユーザ向けAPIからは登録しないためRepositoryには含めない
+func (r *MemoryRepository) InsertUserBan(ban *UserBan) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	v := *ban
+	r.s.bans[v.ID] = &v
+}
+
+// InsertPresentSegmentUsers セグメントにユーザを登録する
+func (r *MemoryRepository) InsertPresentSegmentUsers(segmentID int64, userIDs ...int64) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, userID := range userIDs {
+		r.s.segmentUsers[[2]int64{segmentID, userID}] = true
+	}
+}
+
+// StatsEvents 記録した集計用のイベント
+func (r *MemoryRepository) StatsEvents() []*StatsEvent {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	events := make([]*StatsEvent, 0, len(r.s.statsEvents))
+	for _, e := range r.s.statsEvents {
+		v := *e
+		events = append(events, &v)
+	}
+	return events
+}
+
+// memoryRepositoryTx メモリ上のトランザクション。ロールバック時は記録した逆の操作を新しい順に適用する
+type memoryRepositoryTx struct {
+	memoryRepositories
+	done bool
+}
+
+func (r *memoryRepositoryTx) Commit() error {
+	if r.done {
+		return sql.ErrTxDone
+	}
+	r.done = true
+	return nil
+}
+
+func (r *memoryRepositoryTx) Rollback() error {
+	if r.done {
+		return sql.ErrTxDone
+	}
+	r.done = true
+
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	undo := *r.undo
+	for i := len(undo) - 1; i >= 0; i-- {
+		undo[i]()
+	}
+	return nil
+}
+
+type memoryStore struct {
+	mu sync.Mutex
+
+	users             map[int64]*User
+	devices           map[int64]*UserDevice
+	bans              map[int64]*UserBan
+	sessions          map[int64]*Session
+	tokens            map[int64]*UserOneTimeToken
+	cards             map[int64]*UserCard
+	decks             map[int64]*UserDeck
+	items             map[int64]*UserItem
+	loginBonuses      map[int64]*UserLoginBonus
+	presents          map[int64]*UserPresent
+	receivedHistories map[int64]*UserPresentAllReceivedHistory
+	segmentUsers      map[[2]int64]bool // segment_id, user_id
+	statsEvents       []*StatsEvent
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:             make(map[int64]*User),
+		devices:           make(map[int64]*UserDevice),
+		bans:              make(map[int64]*UserBan),
+		sessions:          make(map[int64]*Session),
+		tokens:            make(map[int64]*UserOneTimeToken),
+		cards:             make(map[int64]*UserCard),
+		decks:             make(map[int64]*UserDeck),
+		items:             make(map[int64]*UserItem),
+		loginBonuses:      make(map[int64]*UserLoginBonus),
+		presents:          make(map[int64]*UserPresent),
+		receivedHistories: make(map[int64]*UserPresentAllReceivedHistory),
+		segmentUsers:      make(map[[2]int64]bool),
+	}
+}
+
+// memoryRepositories ストアとトランザクションで共通の操作。行は保存時と取得時にコピーし、呼び出し側と共有しない
+type memoryRepositories struct {
+	s    *memoryStore
+	undo *[]func() // トランザクション外ではnil
+}
+
+// read ロックを取って読み込む
+func (r *memoryRepositories) read(f func()) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	f()
+}
+
+// write ロックを取って更新し、トランザクション中であれば取り消し用の操作を記録する
+func (r *memoryRepositories) write(f func() (undo func())) {
+	r.s.mu.Lock()
+	undo := f()
+	r.s.mu.Unlock()
+	if r.undo != nil && undo != nil {
+		*r.undo = append(*r.undo, undo)
+	}
+}
+
+func (r *memoryRepositories) GetUser(userID int64) (*User, error) {
+	var user *User
+	r.read(func() {
+		if v, ok := r.s.users[userID]; ok && v.DeletedAt == nil {
+			c := *v
+			user = &c
+		}
+	})
+	if user == nil {
+		return nil, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+func (r *memoryRepositories) InsertUser(user *User) error {
+	v := *user
+	r.write(func() func() {
+		r.s.users[v.ID] = &v
+		return func() { delete(r.s.users, v.ID) }
+	})
+	return nil
+}
+
+// updateUser ユーザを更新する。存在しない場合は何もしない
+func (r *memoryRepositories) updateUser(userID int64, update func(u *User)) {
+	r.write(func() func() {
+		u, ok := r.s.users[userID]
+		if !ok {
+			return nil
+		}
+		prev := *u
+		update(u)
+		return func() { *u = prev }
+	})
+}
+
+func (r *memoryRepositories) UpdateUserCoin(userID, isuCoin int64) error {
+	r.updateUser(userID, func(u *User) {
+		u.IsuCoin = isuCoin
+	})
+	return nil
+}
+
+func (r *memoryRepositories) UpdateUserLastActivatedAt(userID, lastActivatedAt int64) error {
+	r.updateUser(userID, func(u *User) {
+		u.UpdatedAt = lastActivatedAt
+		u.LastActivatedAt = lastActivatedAt
+	})
+	return nil
+}
+
+func (r *memoryRepositories) UpdateUserReward(userID, isuCoin, lastGetRewardAt int64) error {
+	r.updateUser(userID, func(u *User) {
+		u.IsuCoin = isuCoin
+		u.LastGetRewardAt = lastGetRewardAt
+	})
+	return nil
+}
+
+func (r *memoryRepositories) GetUserDevice(userID int64, platformID string) (*UserDevice, error) {
+	var device *UserDevice
+	r.read(func() {
+		for _, v := range r.s.devices {
+			if v.UserID == userID && v.PlatformID == platformID && v.DeletedAt == nil {
+				c := *v
+				device = &c
+				return
+			}
+		}
+	})
+	if device == nil {
+		return nil, sql.ErrNoRows
+	}
+	return device, nil
+}
+
+func (r *memoryRepositories) InsertUserDevice(device *UserDevice) error {
+	v := *device
+	r.write(func() func() {
+		r.s.devices[v.ID] = &v
+		return func() { delete(r.s.devices, v.ID) }
+	})
+	return nil
+}
+
+func (r *memoryRepositories) ListUserPlatformTypes(userID int64) ([]int, error) {
+	platformTypes := make([]int, 0)
+	r.read(func() {
+		seen := make(map[int]bool)
+		for _, v := range r.s.devices {
+			if v.UserID == userID && v.DeletedAt == nil && !seen[v.PlatformType] {
+				seen[v.PlatformType] = true
+				platformTypes = append(platformTypes, v.PlatformType)
+			}
+		}
+	})
+	sort.Ints(platformTypes)
+	return platformTypes, nil
+}
+
+func (r *memoryRepositories) GetActiveUserBan(userID, requestAt int64) (*UserBan, error) {
+	var ban *UserBan
+	r.read(func() {
+		for _, v := range r.s.bans {
+			if v.UserID != userID || v.DeletedAt != nil || (v.ExpiredAt != nil && *v.ExpiredAt <= requestAt) {
+				continue
+			}
+			if ban == nil || v.CreatedAt > ban.CreatedAt || (v.CreatedAt == ban.CreatedAt && v.ID > ban.ID) {
+				c := *v
+				ban = &c
+			}
+		}
+	})
+	if ban == nil {
+		return nil, sql.ErrNoRows
+	}
+	return ban, nil
+}
+
+func (r *memoryRepositories) GetSession(sessionID string) (*Session, error) {
+	var sess *Session
+	r.read(func() {
+		for _, v := range r.s.sessions {
+			if v.SessionID == sessionID && v.DeletedAt == nil {
+				c := *v
+				sess = &c
+				return
+			}
+		}
+	})
+	if sess == nil {
+		return nil, sql.ErrNoRows
+	}
+	return sess, nil
+}
+
+func (r *memoryRepositories) InsertSession(sess *Session) error {
+	v := *sess
+	r.write(func() func() {
+		r.s.sessions[v.ID] = &v
+		return func() { delete(r.s.sessions, v.ID) }
+	})
+	return nil
+}
+
+// deleteSessions 条件に一致するセッションのdeleted_atを設定する
+func (r *memoryRepositories) deleteSessions(match func(v *Session) bool, deletedAt int64) {
+	r.write(func() func() {
+		undo := make([]func(), 0)
+		for _, v := range r.s.sessions {
+			if !match(v) {
+				continue
+			}
+			v, prev := v, *v
+			v.DeletedAt = &deletedAt
+			undo = append(undo, func() { *v = prev })
+		}
+		return func() {
+			for _, f := range undo {
+				f()
+			}
+		}
+	})
+}
+
+func (r *memoryRepositories) DeleteSession(sessionID string, deletedAt int64) error {
+	r.deleteSessions(func(v *Session) bool { return v.SessionID == sessionID }, deletedAt)
+	return nil
+}
+
+func (r *memoryRepositories) DeleteUserSessions(userID, deletedAt int64) error {
+	r.deleteSessions(func(v *Session) bool { return v.UserID == userID && v.DeletedAt == nil }, deletedAt)
+	return nil
+}
+
+func (r *memoryRepositories) GetOneTimeToken(token string, tokenType int) (*UserOneTimeToken, error) {
+	var tk *UserOneTimeToken
+	r.read(func() {
+		for _, v := range r.s.tokens {
+			if v.Token == token && v.TokenType == tokenType && v.DeletedAt == nil {
+				c := *v
+				tk = &c
+				return
+			}
+		}
+	})
+	if tk == nil {
+		return nil, sql.ErrNoRows
+	}
+	return tk, nil
+}
+
+func (r *memoryRepositories) InsertOneTimeToken(token *UserOneTimeToken) error {
+	v := *token
+	r.write(func() func() {
+		r.s.tokens[v.ID] = &v
+		return func() { delete(r.s.tokens, v.ID) }
+	})
+	return nil
+}
+
+// deleteOneTimeTokens 条件に一致するトークンのdeleted_atを設定する
+func (r *memoryRepositories) deleteOneTimeTokens(match func(v *UserOneTimeToken) bool, deletedAt int64) {
+	r.write(func() func() {
+		undo := make([]func(), 0)
+		for _, v := range r.s.tokens {
+			if !match(v) {
+				continue
+			}
+			v, prev := v, *v
+			v.DeletedAt = &deletedAt
+			undo = append(undo, func() { *v = prev })
+		}
+		return func() {
+			for _, f := range undo {
+				f()
+			}
+		}
+	})
+}
+
+func (r *memoryRepositories) DeleteOneTimeToken(token string, deletedAt int64) error {
+	r.deleteOneTimeTokens(func(v *UserOneTimeToken) bool { return v.Token == token }, deletedAt)
+	return nil
+}
+
+func (r *memoryRepositories) DeleteUserOneTimeTokens(userID, deletedAt int64) error {
+	r.deleteOneTimeTokens(func(v *UserOneTimeToken) bool { return v.UserID == userID && v.DeletedAt == nil }, deletedAt)
+	return nil
+}
+
+func (r *memoryRepositories) GetUserCard(userID, userCardID int64) (*UserCard, error) {
+	var card *UserCard
+	r.read(func() {
+		if v, ok := r.s.cards[userCardID]; ok && v.UserID == userID && v.DeletedAt == nil {
+			c := *v
+			card = &c
+		}
+	})
+	if card == nil {
+		return nil, sql.ErrNoRows
+	}
+	return card, nil
+}
+
+// listUserCards 条件に一致する削除されていないカードをID順に取得する
+func (r *memoryRepositories) listUserCards(match func(v *UserCard) bool) []*UserCard {
+	cards := make([]*UserCard, 0)
+	r.read(func() {
+		for _, v := range r.s.cards {
+			if v.DeletedAt == nil && match(v) {
+				c := *v
+				cards = append(cards, &c)
+			}
+		}
+	})
+	sort.Slice(cards, func(i, j int) bool { return cards[i].ID < cards[j].ID })
+	return cards
+}
+
+func (r *memoryRepositories) ListUserCards(userID int64) ([]*UserCard, error) {
+	return r.listUserCards(func(v *UserCard) bool { return v.UserID == userID }), nil
+}
+
+func (r *memoryRepositories) ListUserCardsByIDs(userCardIDs []int64) ([]*UserCard, error) {
+	ids := make(map[int64]bool, len(userCardIDs))
+	for _, id := range userCardIDs {
+		ids[id] = true
+	}
+	return r.listUserCards(func(v *UserCard) bool { return ids[v.ID] }), nil
+}
+
+func (r *memoryRepositories) InsertUserCard(card *UserCard) error {
+	v := *card
+	r.write(func() func() {
+		r.s.cards[v.ID] = &v
+		return func() { delete(r.s.cards, v.ID) }
+	})
+	return nil
+}
+
+func (r *memoryRepositories) UpdateUserCard(card *UserCard) error {
+	r.write(func() func() {
+		v, ok := r.s.cards[card.ID]
+		if !ok {
+			return nil
+		}
+		prev := *v
+		v.AmountPerSec = card.AmountPerSec
+		v.Level = card.Level
+		v.TotalExp = card.TotalExp
+		v.UpdatedAt = card.UpdatedAt
+		return func() { *v = prev }
+	})
+	return nil
+}
+
+func (r *memoryRepositories) GetUserDeck(userID int64) (*UserDeck, error) {
+	var deck *UserDeck
+	r.read(func() {
+		for _, v := range r.s.decks {
+			if v.UserID == userID && v.DeletedAt == nil {
+				c := *v
+				deck = &c
+				return
+			}
+		}
+	})
+	if deck == nil {
+		return nil, sql.ErrNoRows
+	}
+	return deck, nil
+}
+
+func (r *memoryRepositories) InsertUserDeck(deck *UserDeck) error {
+	v := *deck
+	r.write(func() func() {
+		r.s.decks[v.ID] = &v
+		return func() { delete(r.s.decks, v.ID) }
+	})
+	return nil
+}
+
+func (r *memoryRepositories) DeleteUserDecks(userID, deletedAt int64) error {
+	r.write(func() func() {
+		undo := make([]func(), 0)
+		for _, v := range r.s.decks {
+			if v.UserID != userID || v.DeletedAt != nil {
+				continue
+			}
+			v, prev := v, *v
+			v.UpdatedAt = deletedAt
+			v.DeletedAt = &deletedAt
+			undo = append(undo, func() { *v = prev })
+		}
+		return func() {
+			for _, f := range undo {
+				f()
+			}
+		}
+	})
+	return nil
+}
+
+// findUserItem 条件に一致するアイテムをID順で最初のものを取得する
+func (r *memoryRepositories) findUserItem(match func(v *UserItem) bool) (*UserItem, error) {
+	items := r.listUserItems(match)
+	if len(items) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return items[0], nil
+}
+
+// listUserItems 条件に一致するアイテムをID順に取得する
+func (r *memoryRepositories) listUserItems(match func(v *UserItem) bool) []*UserItem {
+	items := make([]*UserItem, 0)
+	r.read(func() {
+		for _, v := range r.s.items {
+			if match(v) {
+				c := *v
+				items = append(items, &c)
+			}
+		}
+	})
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items
+}
+
+func (r *memoryRepositories) GetUserItem(userID, userItemID int64) (*UserItem, error) {
+	return r.findUserItem(func(v *UserItem) bool { return v.ID == userItemID && v.UserID == userID })
+}
+
+func (r *memoryRepositories) GetUserItemByItemID(userID, itemID int64) (*UserItem, error) {
+	return r.findUserItem(func(v *UserItem) bool { return v.UserID == userID && v.ItemID == itemID })
+}
+
+func (r *memoryRepositories) ListUserItems(userID int64) ([]*UserItem, error) {
+	return r.listUserItems(func(v *UserItem) bool { return v.UserID == userID }), nil
+}
+
+func (r *memoryRepositories) InsertUserItem(item *UserItem) error {
+	v := *item
+	r.write(func() func() {
+		r.s.items[v.ID] = &v
+		return func() { delete(r.s.items, v.ID) }
+	})
+	return nil
+}
+
+func (r *memoryRepositories) UpdateUserItemAmount(userItemID int64, amount int, updatedAt int64) error {
+	r.write(func() func() {
+		v, ok := r.s.items[userItemID]
+		if !ok {
+			return nil
+		}
+		prev := *v
+		v.Amount = amount
+		v.UpdatedAt = updatedAt
+		return func() { *v = prev }
+	})
+	return nil
+}
+
+func (r *memoryRepositories) GetUserLoginBonus(userID, loginBonusID int64) (*UserLoginBonus, error) {
+	var bonus *UserLoginBonus
+	r.read(func() {
+		for _, v := range r.s.loginBonuses {
+			if v.UserID == userID && v.LoginBonusID == loginBonusID {
+				c := *v
+				bonus = &c
+				return
+			}
+		}
+	})
+	if bonus == nil {
+		return nil, sql.ErrNoRows
+	}
+	return bonus, nil
+}
+
+func (r *memoryRepositories) InsertUserLoginBonus(bonus *UserLoginBonus) error {
+	v := *bonus
+	r.write(func() func() {
+		r.s.loginBonuses[v.ID] = &v
+		return func() { delete(r.s.loginBonuses, v.ID) }
+	})
+	return nil
+}
+
+func (r *memoryRepositories) UpdateUserLoginBonus(bonus *UserLoginBonus) error {
+	r.write(func() func() {
+		v, ok := r.s.loginBonuses[bonus.ID]
+		if !ok {
+			return nil
+		}
+		prev := *v
+		v.LastRewardSequence = bonus.LastRewardSequence
+		v.LoopCount = bonus.LoopCount
+		v.UpdatedAt = bonus.UpdatedAt
+		return func() { *v = prev }
+	})
+	return nil
+}
+
+// listUserPresents 条件に一致する受け取っていないプレゼントを取得する
+func (r *memoryRepositories) listUserPresents(match func(v *UserPresent) bool) []*UserPresent {
+	presents := make([]*UserPresent, 0)
+	r.read(func() {
+		for _, v := range r.s.presents {
+			if v.DeletedAt == nil && match(v) {
+				c := *v
+				presents = append(presents, &c)
+			}
+		}
+	})
+	return presents
+}
+
+func (r *memoryRepositories) ListUserPresents(userID int64, limit, offset int) ([]*UserPresent, error) {
+	presents := r.listUserPresents(func(v *UserPresent) bool { return v.UserID == userID })
+	sort.Slice(presents, func(i, j int) bool {
+		if presents[i].CreatedAt != presents[j].CreatedAt {
+			return presents[i].CreatedAt > presents[j].CreatedAt
+		}
+		return presents[i].ID < presents[j].ID
+	})
+	if offset >= len(presents) {
+		return []*UserPresent{}, nil
+	}
+	presents = presents[offset:]
+	if len(presents) > limit {
+		presents = presents[:limit]
+	}
+	return presents, nil
+}
+
+func (r *memoryRepositories) CountUserPresents(userID int64) (int, error) {
+	return len(r.listUserPresents(func(v *UserPresent) bool { return v.UserID == userID })), nil
+}
+
+func (r *memoryRepositories) ListUserPresentsByIDs(presentIDs []int64) ([]*UserPresent, error) {
+	ids := make(map[int64]bool, len(presentIDs))
+	for _, id := range presentIDs {
+		ids[id] = true
+	}
+	presents := r.listUserPresents(func(v *UserPresent) bool { return ids[v.ID] })
+	sort.Slice(presents, func(i, j int) bool { return presents[i].ID < presents[j].ID })
+	return presents, nil
+}
+
+func (r *memoryRepositories) InsertUserPresent(present *UserPresent) error {
+	v := *present
+	r.write(func() func() {
+		r.s.presents[v.ID] = &v
+		return func() { delete(r.s.presents, v.ID) }
+	})
+	return nil
+}
+
+func (r *memoryRepositories) DeleteUserPresent(presentID, deletedAt int64) error {
+	r.write(func() func() {
+		v, ok := r.s.presents[presentID]
+		if !ok {
+			return nil
+		}
+		prev := *v
+		v.UpdatedAt = deletedAt
+		v.DeletedAt = &deletedAt
+		return func() { *v = prev }
+	})
+	return nil
+}
+
+func (r *memoryRepositories) ExistsPresentAllReceivedHistory(userID, presentAllID int64) (bool, error) {
+	exists := false
+	r.read(func() {
+		for _, v := range r.s.receivedHistories {
+			if v.UserID == userID && v.PresentAllID == presentAllID {
+				exists = true
+				return
+			}
+		}
+	})
+	return exists, nil
+}
+
+func (r *memoryRepositories) InsertPresentAllReceivedHistory(history *UserPresentAllReceivedHistory) error {
+	v := *history
+	r.write(func() func() {
+		r.s.receivedHistories[v.ID] = &v
+		return func() { delete(r.s.receivedHistories, v.ID) }
+	})
+	return nil
+}
+
+func (r *memoryRepositories) ExistsPresentSegmentUser(segmentID, userID int64) (bool, error) {
+	exists := false
+	r.read(func() {
+		exists = r.s.segmentUsers[[2]int64{segmentID, userID}]
+	})
+	return exists, nil
+}
+
+func (r *memoryRepositories) InsertStatsEvent(event *StatsEvent) error {
+	event.EventDate = statsDate(event.CreatedAt)
+	v := *event
+	r.write(func() func() {
+		r.s.statsEvents = append(r.s.statsEvents, &v)
+		n := len(r.s.statsEvents) - 1
+		return func() { r.s.statsEvents = r.s.statsEvents[:n] }
+	})
+	return nil
+}
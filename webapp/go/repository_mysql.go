@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// mysqlRepository MySQLに保存するRepository
+type mysqlRepository struct {
+	mysqlRepositories
+	db *sqlx.DB
+}
+
+func NewMySQLRepository(db *sqlx.DB) Repository {
+	return &mysqlRepository{mysqlRepositories: mysqlRepositories{q: db}, db: db}
+}
+
+func (r *mysqlRepository) Begin() (RepositoryTx, error) {
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	return &mysqlRepositoryTx{mysqlRepositories: mysqlRepositories{q: tx}, tx: tx}, nil
+}
+
+// GenerateID id_generatorで採番する。デッドロックした場合は再試行する
+func (r *mysqlRepository) GenerateID() (int64, error) {
+	var updateErr error
+	for i := 0; i < 100; i++ {
+		res, err := r.db.Exec("UPDATE id_generator SET id=LAST_INSERT_ID(id+1)")
+		if err != nil {
+			if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1213 {
+				updateErr = err
+				continue
+			}
+			return 0, err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		return id, nil
+	}
+
+	return 0, fmt.Errorf("failed to generate id: %w", updateErr)
+}
+
+func (r *mysqlRepository) LoadMasters() (*MasterData, error) {
+	// 読み込み中に更新されても世代とマスタの内容がずれないよう、一貫性のあるスナップショットで読む
+	tx, err := r.db.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	key, err := selectMasterCacheKey(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	version := new(VersionMaster)
+	if err = tx.Get(version, "SELECT * FROM version_masters WHERE id=?", key.VersionID); err != nil {
+		return nil, err
+	}
+	items := make([]*ItemMaster, 0)
+	if err = tx.Select(&items, "SELECT * FROM item_masters"); err != nil {
+		return nil, err
+	}
+	gachas := make([]*GachaMaster, 0)
+	if err = tx.Select(&gachas, "SELECT * FROM gacha_masters"); err != nil {
+		return nil, err
+	}
+	gachaItems := make([]*GachaItemMaster, 0)
+	if err = tx.Select(&gachaItems, "SELECT * FROM gacha_item_masters"); err != nil {
+		return nil, err
+	}
+	loginBonuses := make([]*LoginBonusMaster, 0)
+	if err = tx.Select(&loginBonuses, "SELECT * FROM login_bonus_masters"); err != nil {
+		return nil, err
+	}
+	loginBonusRewards := make([]*LoginBonusRewardMaster, 0)
+	if err = tx.Select(&loginBonusRewards, "SELECT * FROM login_bonus_reward_masters"); err != nil {
+		return nil, err
+	}
+	presentAlls := make([]*PresentAllMaster, 0)
+	if err = tx.Select(&presentAlls, "SELECT * FROM present_all_masters"); err != nil {
+		return nil, err
+	}
+	rewardBoosts := make([]*RewardBoostMaster, 0)
+	if err = tx.Select(&rewardBoosts, "SELECT * FROM reward_boost_masters"); err != nil {
+		return nil, err
+	}
+
+	data := NewMasterData(version, items, gachas, gachaItems, loginBonuses, loginBonusRewards, presentAlls, rewardBoosts)
+	data.Key = *key
+	return data, nil
+}
+
+func (r *mysqlRepository) GetMasterCacheKey() (*MasterCacheKey, error) {
+	return selectMasterCacheKey(r.db)
+}
+
+// selectMasterCacheKey DB上のマスタの世代を取得する
+func selectMasterCacheKey(q sqlx.Queryer) (*MasterCacheKey, error) {
+	key := new(MasterCacheKey)
+	query := "SELECT id AS version_id, master_version, (SELECT COALESCE(MAX(id), 0) FROM master_snapshots) AS last_snapshot_id FROM version_masters WHERE status=1"
+	if err := sqlx.Get(q, key, query); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrActiveMasterVersionNotFound
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// mysqlRepositoryTx MySQLのトランザクション
+type mysqlRepositoryTx struct {
+	mysqlRepositories
+	tx *sqlx.Tx
+}
+
+func (r *mysqlRepositoryTx) Commit() error {
+	return r.tx.Commit()
+}
+
+func (r *mysqlRepositoryTx) Rollback() error {
+	return r.tx.Rollback()
+}
+
+// mysqlRepositories DBとトランザクションで共通のクエリ
+type mysqlRepositories struct {
+	q sqlx.Ext
+}
+
+func (r *mysqlRepositories) GetUser(userID int64) (*User, error) {
+	user := new(User)
+	query := "SELECT * FROM users WHERE id=? AND deleted_at IS NULL"
+	if err := sqlx.Get(r.q, user, query, userID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *mysqlRepositories) InsertUser(user *User) error {
+	query := "INSERT INTO users(id, last_activated_at, registered_at, last_getreward_at, created_at, updated_at) VALUES(?, ?, ?, ?, ?, ?)"
+	_, err := r.q.Exec(query, user.ID, user.LastActivatedAt, user.RegisteredAt, user.LastGetRewardAt, user.CreatedAt, user.UpdatedAt)
+	return err
+}
+
+func (r *mysqlRepositories) UpdateUserCoin(userID, isuCoin int64) error {
+	_, err := r.q.Exec("UPDATE users SET isu_coin=? WHERE id=?", isuCoin, userID)
+	return err
+}
+
+func (r *mysqlRepositories) UpdateUserLastActivatedAt(userID, lastActivatedAt int64) error {
+	_, err := r.q.Exec("UPDATE users SET updated_at=?, last_activated_at=? WHERE id=?", lastActivatedAt, lastActivatedAt, userID)
+	return err
+}
+
+func (r *mysqlRepositories) UpdateUserReward(userID, isuCoin, lastGetRewardAt int64) error {
+	_, err := r.q.Exec("UPDATE users SET isu_coin=?, last_getreward_at=? WHERE id=?", isuCoin, lastGetRewardAt, userID)
+	return err
+}
+
+func (r *mysqlRepositories) GetUserDevice(userID int64, platformID string) (*UserDevice, error) {
+	device := new(UserDevice)
+	query := "SELECT * FROM user_devices WHERE user_id=? AND platform_id=? AND deleted_at IS NULL"
+	if err := sqlx.Get(r.q, device, query, userID, platformID); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (r *mysqlRepositories) InsertUserDevice(device *UserDevice) error {
+	query := "INSERT INTO user_devices(id, user_id, platform_id, platform_type, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)"
+	_, err := r.q.Exec(query, device.ID, device.UserID, device.PlatformID, device.PlatformType, device.CreatedAt, device.UpdatedAt)
+	return err
+}
+
+func (r *mysqlRepositories) ListUserPlatformTypes(userID int64) ([]int, error) {
+	platformTypes := make([]int, 0)
+	query := "SELECT DISTINCT platform_type FROM user_devices WHERE user_id=? AND deleted_at IS NULL"
+	if err := sqlx.Select(r.q, &platformTypes, query, userID); err != nil {
+		return nil, err
+	}
+	return platformTypes, nil
+}
+
+func (r *mysqlRepositories) GetActiveUserBan(userID, requestAt int64) (*UserBan, error) {
+	ban := new(UserBan)
+	query := "SELECT * FROM user_bans WHERE user_id=? AND deleted_at IS NULL AND (expired_at IS NULL OR expired_at > ?) ORDER BY created_at DESC, id DESC LIMIT 1"
+	if err := sqlx.Get(r.q, ban, query, userID, requestAt); err != nil {
+		return nil, err
+	}
+	return ban, nil
+}
+
+func (r *mysqlRepositories) GetSession(sessionID string) (*Session, error) {
+	sess := new(Session)
+	query := "SELECT * FROM user_sessions WHERE session_id=? AND deleted_at IS NULL"
+	if err := sqlx.Get(r.q, sess, query, sessionID); err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+func (r *mysqlRepositories) InsertSession(sess *Session) error {
+	query := "INSERT INTO user_sessions(id, user_id, session_id, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?)"
+	_, err := r.q.Exec(query, sess.ID, sess.UserID, sess.SessionID, sess.CreatedAt, sess.UpdatedAt, sess.ExpiredAt)
+	return err
+}
+
+func (r *mysqlRepositories) DeleteSession(sessionID string, deletedAt int64) error {
+	_, err := r.q.Exec("UPDATE user_sessions SET deleted_at=? WHERE session_id=?", deletedAt, sessionID)
+	return err
+}
+
+func (r *mysqlRepositories) DeleteUserSessions(userID, deletedAt int64) error {
+	_, err := r.q.Exec("UPDATE user_sessions SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL", deletedAt, userID)
+	return err
+}
+
+func (r *mysqlRepositories) GetOneTimeToken(token string, tokenType int) (*UserOneTimeToken, error) {
+	tk := new(UserOneTimeToken)
+	query := "SELECT * FROM user_one_time_tokens WHERE token=? AND token_type=? AND deleted_at IS NULL"
+	if err := sqlx.Get(r.q, tk, query, token, tokenType); err != nil {
+		return nil, err
+	}
+	return tk, nil
+}
+
+func (r *mysqlRepositories) InsertOneTimeToken(token *UserOneTimeToken) error {
+	query := "INSERT INTO user_one_time_tokens(id, user_id, token, token_type, created_at, updated_at, expired_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err := r.q.Exec(query, token.ID, token.UserID, token.Token, token.TokenType, token.CreatedAt, token.UpdatedAt, token.ExpiredAt)
+	return err
+}
+
+func (r *mysqlRepositories) DeleteOneTimeToken(token string, deletedAt int64) error {
+	_, err := r.q.Exec("UPDATE user_one_time_tokens SET deleted_at=? WHERE token=?", deletedAt, token)
+	return err
+}
+
+func (r *mysqlRepositories) DeleteUserOneTimeTokens(userID, deletedAt int64) error {
+	_, err := r.q.Exec("UPDATE user_one_time_tokens SET deleted_at=? WHERE user_id=? AND deleted_at IS NULL", deletedAt, userID)
+	return err
+}
+
+func (r *mysqlRepositories) GetUserCard(userID, userCardID int64) (*UserCard, error) {
+	card := new(UserCard)
+	query := "SELECT * FROM user_cards WHERE id=? AND user_id=? AND deleted_at IS NULL"
+	if err := sqlx.Get(r.q, card, query, userCardID, userID); err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+func (r *mysqlRepositories) ListUserCards(userID int64) ([]*UserCard, error) {
+	cards := make([]*UserCard, 0)
+	query := "SELECT * FROM user_cards WHERE user_id=? AND deleted_at IS NULL"
+	if err := sqlx.Select(r.q, &cards, query, userID); err != nil {
+		return nil, err
+	}
+	return cards, nil
+}
+
+func (r *mysqlRepositories) ListUserCardsByIDs(userCardIDs []int64) ([]*UserCard, error) {
+	cards := make([]*UserCard, 0)
+	if len(userCardIDs) == 0 {
+		return cards, nil
+	}
+	query, params, err := sqlx.In("SELECT * FROM user_cards WHERE id IN (?) AND deleted_at IS NULL", userCardIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err = sqlx.Select(r.q, &cards, query, params...); err != nil {
+		return nil, err
+	}
+	return cards, nil
+}
+
+func (r *mysqlRepositories) InsertUserCard(card *UserCard) error {
+	query := "INSERT INTO user_cards(id, user_id, card_id, amount_per_sec, level, total_exp, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := r.q.Exec(query, card.ID, card.UserID, card.CardID, card.AmountPerSec, card.Level, card.TotalExp, card.CreatedAt, card.UpdatedAt)
+	return err
+}
+
+func (r *mysqlRepositories) UpdateUserCard(card *UserCard) error {
+	query := "UPDATE user_cards SET amount_per_sec=?, level=?, total_exp=?, updated_at=? WHERE id=?"
+	_, err := r.q.Exec(query, card.AmountPerSec, card.Level, card.TotalExp, card.UpdatedAt, card.ID)
+	return err
+}
+
+func (r *mysqlRepositories) GetUserDeck(userID int64) (*UserDeck, error) {
+	deck := new(UserDeck)
+	query := "SELECT * FROM user_decks WHERE user_id=? AND deleted_at IS NULL"
+	if err := sqlx.Get(r.q, deck, query, userID); err != nil {
+		return nil, err
+	}
+	return deck, nil
+}
+
+func (r *mysqlRepositories) InsertUserDeck(deck *UserDeck) error {
+	query := "INSERT INTO user_decks(id, user_id, user_card_id_1, user_card_id_2, user_card_id_3, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err := r.q.Exec(query, deck.ID, deck.UserID, deck.CardID1, deck.CardID2, deck.CardID3, deck.CreatedAt, deck.UpdatedAt)
+	return err
+}
+
+func (r *mysqlRepositories) DeleteUserDecks(userID, deletedAt int64) error {
+	_, err := r.q.Exec("UPDATE user_decks SET updated_at=?, deleted_at=? WHERE user_id=? AND deleted_at IS NULL", deletedAt, deletedAt, userID)
+	return err
+}
+
+func (r *mysqlRepositories) GetUserItem(userID, userItemID int64) (*UserItem, error) {
+	item := new(UserItem)
+	if err := sqlx.Get(r.q, item, "SELECT * FROM user_items WHERE id=? AND user_id=?", userItemID, userID); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (r *mysqlRepositories) GetUserItemByItemID(userID, itemID int64) (*UserItem, error) {
+	item := new(UserItem)
+	if err := sqlx.Get(r.q, item, "SELECT * FROM user_items WHERE user_id=? AND item_id=?", userID, itemID); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+func (r *mysqlRepositories) ListUserItems(userID int64) ([]*UserItem, error) {
+	items := make([]*UserItem, 0)
+	if err := sqlx.Select(r.q, &items, "SELECT * FROM user_items WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *mysqlRepositories) InsertUserItem(item *UserItem) error {
+	query := "INSERT INTO user_items(id, user_id, item_id, item_type, amount, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err := r.q.Exec(query, item.ID, item.UserID, item.ItemID, item.ItemType, item.Amount, item.CreatedAt, item.UpdatedAt)
+	return err
+}
+
+func (r *mysqlRepositories) UpdateUserItemAmount(userItemID int64, amount int, updatedAt int64) error {
+	_, err := r.q.Exec("UPDATE user_items SET amount=?, updated_at=? WHERE id=?", amount, updatedAt, userItemID)
+	return err
+}
+
+func (r *mysqlRepositories) GetUserLoginBonus(userID, loginBonusID int64) (*UserLoginBonus, error) {
+	bonus := new(UserLoginBonus)
+	query := "SELECT * FROM user_login_bonuses WHERE user_id=? AND login_bonus_id=?"
+	if err := sqlx.Get(r.q, bonus, query, userID, loginBonusID); err != nil {
+		return nil, err
+	}
+	return bonus, nil
+}
+
+func (r *mysqlRepositories) InsertUserLoginBonus(bonus *UserLoginBonus) error {
+	query := "INSERT INTO user_login_bonuses(id, user_id, login_bonus_id, last_reward_sequence, loop_count, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err := r.q.Exec(query, bonus.ID, bonus.UserID, bonus.LoginBonusID, bonus.LastRewardSequence, bonus.LoopCount, bonus.CreatedAt, bonus.UpdatedAt)
+	return err
+}
+
+func (r *mysqlRepositories) UpdateUserLoginBonus(bonus *UserLoginBonus) error {
+	query := "UPDATE user_login_bonuses SET last_reward_sequence=?, loop_count=?, updated_at=? WHERE id=?"
+	_, err := r.q.Exec(query, bonus.LastRewardSequence, bonus.LoopCount, bonus.UpdatedAt, bonus.ID)
+	return err
+}
+
+func (r *mysqlRepositories) ListUserPresents(userID int64, limit, offset int) ([]*UserPresent, error) {
+	presents := make([]*UserPresent, 0)
+	query := `
+	SELECT * FROM user_presents
+	WHERE user_id = ? AND deleted_at IS NULL
+	ORDER BY created_at DESC, id
+	LIMIT ? OFFSET ?`
+	if err := sqlx.Select(r.q, &presents, query, userID, limit, offset); err != nil {
+		return nil, err
+	}
+	return presents, nil
+}
+
+func (r *mysqlRepositories) CountUserPresents(userID int64) (int, error) {
+	var count int
+	if err := sqlx.Get(r.q, &count, "SELECT COUNT(*) FROM user_presents WHERE user_id = ? AND deleted_at IS NULL", userID); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (r *mysqlRepositories) ListUserPresentsByIDs(presentIDs []int64) ([]*UserPresent, error) {
+	presents := make([]*UserPresent, 0)
+	if len(presentIDs) == 0 {
+		return presents, nil
+	}
+	query, params, err := sqlx.In("SELECT * FROM user_presents WHERE id IN (?) AND deleted_at IS NULL", presentIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err = sqlx.Select(r.q, &presents, query, params...); err != nil {
+		return nil, err
+	}
+	return presents, nil
+}
+
+func (r *mysqlRepositories) InsertUserPresent(present *UserPresent) error {
+	query := "INSERT INTO user_presents(id, user_id, sent_at, item_type, item_id, amount, present_message, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := r.q.Exec(query, present.ID, present.UserID, present.SentAt, present.ItemType, present.ItemID, present.Amount, present.PresentMessage, present.CreatedAt, present.UpdatedAt)
+	return err
+}
+
+func (r *mysqlRepositories) DeleteUserPresent(presentID, deletedAt int64) error {
+	_, err := r.q.Exec("UPDATE user_presents SET deleted_at=?, updated_at=? WHERE id=?", deletedAt, deletedAt, presentID)
+	return err
+}
+
+func (r *mysqlRepositories) ExistsPresentAllReceivedHistory(userID, presentAllID int64) (bool, error) {
+	received := new(UserPresentAllReceivedHistory)
+	query := "SELECT * FROM user_present_all_received_history WHERE user_id=? AND present_all_id=?"
+	if err := sqlx.Get(r.q, received, query, userID, presentAllID); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *mysqlRepositories) InsertPresentAllReceivedHistory(history *UserPresentAllReceivedHistory) error {
+	query := "INSERT INTO user_present_all_received_history(id, user_id, present_all_id, received_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)"
+	_, err := r.q.Exec(query, history.ID, history.UserID, history.PresentAllID, history.ReceivedAt, history.CreatedAt, history.UpdatedAt)
+	return err
+}
+
+func (r *mysqlRepositories) ExistsPresentSegmentUser(segmentID, userID int64) (bool, error) {
+	var count int
+	query := "SELECT COUNT(*) FROM present_segment_users WHERE segment_id=? AND user_id=?"
+	if err := sqlx.Get(r.q, &count, query, segmentID, userID); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (r *mysqlRepositories) InsertStatsEvent(event *StatsEvent) error {
+	return recordStatsEvent(r.q, event)
+}
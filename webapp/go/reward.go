@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sort"
+)
+
+const (
+	RewardBaseMultiplier int64 = 100 // 倍率の基準値(百分率)
+)
+
+// rewardStartAt 報酬の蓄積上限を考慮した報酬計算の起点を返す
+func (h *Handler) rewardStartAt(lastGetRewardAt, requestAt int64) int64 {
+	if h.RewardMaxAccumulationSec > 0 && requestAt-lastGetRewardAt > h.RewardMaxAccumulationSec {
+		return requestAt - h.RewardMaxAccumulationSec
+	}
+	return lastGetRewardAt
+}
+
+// getRewardBoosts 期間内に開催されている報酬ブーストイベントを取得する
+func (h *Handler) getRewardBoosts(startAt, endAt int64) ([]*RewardBoostMaster, error) {
+	masters, err := h.masterData()
+	if err != nil {
+		return nil, err
+	}
+	return masters.RewardBoosts(startAt, endAt), nil
+}
+
+// calcRewardCoin 期間内の放置報酬を計算する
+// 期間をブーストの開始・終了時刻で区切り、区間ごとに最も高い倍率を適用する
+func calcRewardCoin(startAt, endAt int64, amountPerSec int64, boosts []*RewardBoostMaster) int64 {
+	if endAt <= startAt {
+		return 0
+	}
+
+	points := []int64{startAt, endAt}
+	for _, b := range boosts {
+		if startAt < b.StartAt && b.StartAt < endAt {
+			points = append(points, b.StartAt)
+		}
+		if startAt < b.EndAt && b.EndAt < endAt {
+			points = append(points, b.EndAt)
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+
+	var total int64
+	for i := 0; i < len(points)-1; i++ {
+		from, to := points[i], points[i+1]
+		if from == to {
+			continue
+		}
+		multiplier := RewardBaseMultiplier
+		for _, b := range boosts {
+			if b.StartAt <= from && from < b.EndAt && b.Multiplier > multiplier {
+				multiplier = b.Multiplier
+			}
+		}
+		total += (to - from) * amountPerSec * multiplier
+	}
+
+	return total / RewardBaseMultiplier
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRewardStartAt(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxAccumulation int64
+		lastGetRewardAt int64
+		want            int64
+	}{
+		{name: "上限なし", maxAccumulation: 0, lastGetRewardAt: testRequestAt - 86400*7, want: testRequestAt - 86400*7},
+		{name: "上限以内", maxAccumulation: 3600, lastGetRewardAt: testRequestAt - 1800, want: testRequestAt - 1800},
+		{name: "上限ちょうど", maxAccumulation: 3600, lastGetRewardAt: testRequestAt - 3600, want: testRequestAt - 3600},
+		{name: "上限超過", maxAccumulation: 3600, lastGetRewardAt: testRequestAt - 7200, want: testRequestAt - 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{RewardMaxAccumulationSec: tt.maxAccumulation}
+			if got := h.rewardStartAt(tt.lastGetRewardAt, testRequestAt); got != tt.want {
+				t.Errorf("rewardStartAt: want %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCalcRewardCoin(t *testing.T) {
+	tests := []struct {
+		name         string
+		startAt      int64
+		endAt        int64
+		amountPerSec int64
+		boosts       []*RewardBoostMaster
+		want         int64
+	}{
+		{name: "ブーストなし", startAt: 0, endAt: 100, amountPerSec: 3, want: 300},
+		{name: "期間なし", startAt: 100, endAt: 100, amountPerSec: 3, want: 0},
+		{name: "終了が開始より前", startAt: 100, endAt: 50, amountPerSec: 3, want: 0},
+		{
+			name: "期間の一部にブースト", startAt: 0, endAt: 100, amountPerSec: 1,
+			boosts: []*RewardBoostMaster{{ID: 1, Multiplier: 200, StartAt: 50, EndAt: 150}},
+			want:   150, // 50秒x1倍 + 50秒x2倍
+		},
+		{
+			name: "期間外のブーストは無視", startAt: 0, endAt: 100, amountPerSec: 1,
+			boosts: []*RewardBoostMaster{{ID: 1, Multiplier: 300, StartAt: 100, EndAt: 200}, {ID: 2, Multiplier: 300, StartAt: -100, EndAt: 0}},
+			want:   100,
+		},
+		{
+			name: "重なる区間は最も高い倍率", startAt: 0, endAt: 100, amountPerSec: 1,
+			boosts: []*RewardBoostMaster{{ID: 1, Multiplier: 150, StartAt: 0, EndAt: 60}, {ID: 2, Multiplier: 300, StartAt: 30, EndAt: 90}},
+			want:   235, // 30秒x1.5倍 + 60秒x3倍 + 10秒x1倍
+		},
+		{
+			name: "基準より低い倍率は適用しない", startAt: 0, endAt: 100, amountPerSec: 1,
+			boosts: []*RewardBoostMaster{{ID: 1, Multiplier: 50, StartAt: 0, EndAt: 100}},
+			want:   100,
+		},
+		{
+			name: "端数は合計してから切り捨てる", startAt: 0, endAt: 2, amountPerSec: 1,
+			boosts: []*RewardBoostMaster{{ID: 1, Multiplier: 150, StartAt: 0, EndAt: 1}, {ID: 2, Multiplier: 150, StartAt: 1, EndAt: 2}},
+			want:   3, // 区間ごとに切り捨てると2になる
+		},
+		{
+			name: "合計の端数は切り捨て", startAt: 0, endAt: 10, amountPerSec: 1,
+			boosts: []*RewardBoostMaster{{ID: 1, Multiplier: 125, StartAt: 0, EndAt: 3}},
+			want:   10, // 3秒x1.25倍 + 7秒x1倍 = 10.75
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := calcRewardCoin(tt.startAt, tt.endAt, tt.amountPerSec, tt.boosts); got != tt.want {
+				t.Errorf("calcRewardCoin: want %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
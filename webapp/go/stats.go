@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	StatsEventLogin    string = "login"    // ログイン処理(1日1回)
+	StatsEventRegister string = "register" // ユーザ登録
+	StatsEventReward   string = "reward"   // 放置報酬によるコインの獲得
+	StatsEventGacha    string = "gacha"    // ガチャによるコインの消費
+
+	StatsDateFormat      string = "2006-01-02"
+	StatsMAUDays         int    = 30  // MAUとして数える日数(当日を含む)
+	StatsDefaultDays     int    = 30  // 期間の指定がない場合に返す日数
+	StatsMaxDays         int    = 366 // 一度に取得できる最大の日数
+	StatsRollupBatchSize int    = 10000
+)
+
+// statsDate イベントを集計する日付。ログインボーナスと同じくサーバのタイムゾーンで区切る
+func statsDate(unixTime int64) string {
+	return time.Unix(unixTime, 0).In(time.Local).Format(StatsDateFormat)
+}
+
+// recordStatsEvent 集計用のイベントを追記する。集計はrunStatsRollupで行う
+func recordStatsEvent(db sqlx.Execer, event *StatsEvent) error {
+	event.EventDate = statsDate(event.CreatedAt)
+	query := "INSERT INTO stats_events(event_type, event_date, user_id, platform_type, gacha_id, draws, coins, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	_, err := db.Exec(query, event.EventType, event.EventDate, event.UserID, event.PlatformType, event.GachaID, event.Draws, event.Coins, event.CreatedAt)
+	return err
+}
+
+// runStatsRollup 未集計のイベントがある日付の日次集計を一定間隔で作り直す
+func (h *Handler) runStatsRollup(logger echo.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			n, err := h.rollupStatsEvents(h.Clock.Now().Unix())
+			if err != nil {
+				logger.Errorf("failed to roll up stats: %v", err)
+				break
+			}
+			if n < StatsRollupBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// rollupStatsEvents 未集計のイベントを最大StatsRollupBatchSize件取り出し、その日付の集計を作り直して集計済みにする
+// 集計は日付ごとにイベントから作り直すため、同じ日付を複数回集計しても結果は変わらない
+func (h *Handler) rollupStatsEvents(now int64) (int, error) {
+	events := make([]*StatsEvent, 0)
+	query := "SELECT id, DATE_FORMAT(event_date, '%Y-%m-%d') AS event_date FROM stats_events WHERE rolled_up=0 ORDER BY id LIMIT ?"
+	if err := h.DB.Select(&events, query, StatsRollupBatchSize); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	ids := make([]int64, 0, len(events))
+	dates := make(map[string]struct{})
+	for _, e := range events {
+		ids = append(ids, e.ID)
+		dates[e.EventDate] = struct{}{}
+	}
+
+	// ログインはその日から30日間のMAUに影響するため、集計済みの後続の日付も作り直す
+	dirty := make(map[string]struct{}, len(dates))
+	for date := range dates {
+		dirty[date] = struct{}{}
+		from, err := time.ParseInLocation(StatsDateFormat, date, time.Local)
+		if err != nil {
+			return 0, err
+		}
+		to := from.AddDate(0, 0, StatsMAUDays-1).Format(StatsDateFormat)
+		following := make([]time.Time, 0)
+		query = "SELECT stat_date FROM stats_daily WHERE stat_date>? AND stat_date<=?"
+		if err = h.DB.Select(&following, query, date, to); err != nil {
+			return 0, err
+		}
+		for _, v := range following {
+			dirty[v.Format(StatsDateFormat)] = struct{}{}
+		}
+	}
+
+	for date := range dirty {
+		if err := h.rollupStatsDate(date, now); err != nil {
+			return 0, fmt.Errorf("date=%s: %w", date, err)
+		}
+	}
+
+	query, args, err := sqlx.In("UPDATE stats_events SET rolled_up=1 WHERE id IN (?)", ids)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = h.DB.Exec(query, args...); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// rollupStatsDate 1日分の集計をイベントから作り直す
+// イベントの日付はリクエスト時刻から決まり過去の日付にも追加されうるため、集計済みのイベントも削除せずに残す
+func (h *Handler) rollupStatsDate(date string, now int64) error {
+	day, err := time.ParseInLocation(StatsDateFormat, date, time.Local)
+	if err != nil {
+		return err
+	}
+	mauFrom := day.AddDate(0, 0, -(StatsMAUDays - 1)).Format(StatsDateFormat)
+
+	tx, err := h.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	daily := &StatsDaily{StatDate: day, UpdatedAt: now}
+	query := "SELECT COUNT(DISTINCT user_id) FROM stats_events WHERE event_type=? AND event_date=?"
+	if err = tx.Get(&daily.DAU, query, StatsEventLogin, date); err != nil {
+		return err
+	}
+	query = "SELECT COUNT(DISTINCT user_id) FROM stats_events WHERE event_type=? AND event_date>=? AND event_date<=?"
+	if err = tx.Get(&daily.MAU, query, StatsEventLogin, mauFrom, date); err != nil {
+		return err
+	}
+	query = "SELECT COALESCE(SUM(coins), 0) FROM stats_events WHERE event_type=? AND event_date=?"
+	if err = tx.Get(&daily.CoinsRewarded, query, StatsEventReward, date); err != nil {
+		return err
+	}
+	if err = tx.Get(&daily.CoinsSpentGacha, query, StatsEventGacha, date); err != nil {
+		return err
+	}
+
+	query = "INSERT INTO stats_daily(stat_date, dau, mau, coins_rewarded, coins_spent_gacha, updated_at) VALUES (?, ?, ?, ?, ?, ?)" +
+		" ON DUPLICATE KEY UPDATE dau=VALUES(dau), mau=VALUES(mau), coins_rewarded=VALUES(coins_rewarded), coins_spent_gacha=VALUES(coins_spent_gacha), updated_at=VALUES(updated_at)"
+	if _, err = tx.Exec(query, date, daily.DAU, daily.MAU, daily.CoinsRewarded, daily.CoinsSpentGacha, daily.UpdatedAt); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("DELETE FROM stats_daily_registrations WHERE stat_date=?", date); err != nil {
+		return err
+	}
+	query = "INSERT INTO stats_daily_registrations(stat_date, platform_type, registrations)" +
+		" SELECT event_date, platform_type, COUNT(*) FROM stats_events WHERE event_type=? AND event_date=? GROUP BY event_date, platform_type"
+	if _, err = tx.Exec(query, StatsEventRegister, date); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("DELETE FROM stats_daily_gachas WHERE stat_date=?", date); err != nil {
+		return err
+	}
+	query = "INSERT INTO stats_daily_gachas(stat_date, gacha_id, draws, coins)" +
+		" SELECT event_date, gacha_id, SUM(draws), SUM(coins) FROM stats_events WHERE event_type=? AND event_date=? GROUP BY event_date, gacha_id"
+	if _, err = tx.Exec(query, StatsEventGacha, date); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// adminGetStats 日次集計の取得
+// GET /admin/stats
+func (h *Handler) adminGetStats(c echo.Context) error {
+	to := h.Clock.Now().In(time.Local)
+	if v := c.QueryParam("to"); v != "" {
+		t, err := time.ParseInLocation(StatsDateFormat, v, time.Local)
+		if err != nil {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid to: %s", v))
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -(StatsDefaultDays - 1))
+	if v := c.QueryParam("from"); v != "" {
+		t, err := time.ParseInLocation(StatsDateFormat, v, time.Local)
+		if err != nil {
+			return errorResponse(c, http.StatusBadRequest, fmt.Errorf("invalid from: %s", v))
+		}
+		from = t
+	}
+	fromDate, toDate := from.Format(StatsDateFormat), to.Format(StatsDateFormat)
+	if fromDate > toDate {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("from must not be after to"))
+	}
+	if from.AddDate(0, 0, StatsMaxDays).Format(StatsDateFormat) <= toDate {
+		return errorResponse(c, http.StatusBadRequest, fmt.Errorf("date range must be at most %d days", StatsMaxDays))
+	}
+
+	dailies := make([]*StatsDaily, 0)
+	query := "SELECT * FROM stats_daily WHERE stat_date>=? AND stat_date<=? ORDER BY stat_date"
+	if err := h.DB.Select(&dailies, query, fromDate, toDate); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	registrations := make([]*StatsDailyRegistration, 0)
+	query = "SELECT * FROM stats_daily_registrations WHERE stat_date>=? AND stat_date<=?"
+	if err := h.DB.Select(&registrations, query, fromDate, toDate); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	gachas := make([]*StatsDailyGacha, 0)
+	query = "SELECT * FROM stats_daily_gachas WHERE stat_date>=? AND stat_date<=?"
+	if err := h.DB.Select(&gachas, query, fromDate, toDate); err != nil {
+		return errorResponse(c, http.StatusInternalServerError, err)
+	}
+
+	res := &AdminGetStatsResponse{
+		From: fromDate,
+		To:   toDate,
+		Days: make([]*StatsDay, 0, len(dailies)),
+		Total: &StatsTotal{
+			Registrations: make(map[int]int64),
+			Gachas:        make([]*StatsGacha, 0),
+		},
+	}
+	days := make(map[string]*StatsDay, len(dailies))
+	for _, v := range dailies {
+		day := &StatsDay{
+			Date:            v.StatDate.Format(StatsDateFormat),
+			DAU:             v.DAU,
+			MAU:             v.MAU,
+			Registrations:   make(map[int]int64),
+			CoinsRewarded:   v.CoinsRewarded,
+			CoinsSpentGacha: v.CoinsSpentGacha,
+			Gachas:          make([]*StatsGacha, 0),
+		}
+		days[day.Date] = day
+		res.Days = append(res.Days, day)
+		res.Total.CoinsRewarded += v.CoinsRewarded
+		res.Total.CoinsSpentGacha += v.CoinsSpentGacha
+		if v.UpdatedAt > res.RolledUpAt {
+			res.RolledUpAt = v.UpdatedAt
+		}
+	}
+	for _, v := range registrations {
+		if day, ok := days[v.StatDate.Format(StatsDateFormat)]; ok {
+			day.Registrations[v.PlatformType] = v.Registrations
+		}
+		res.Total.Registrations[v.PlatformType] += v.Registrations
+	}
+	totalGachas := make(map[int64]*StatsGacha)
+	for _, v := range gachas {
+		if day, ok := days[v.StatDate.Format(StatsDateFormat)]; ok {
+			day.Gachas = append(day.Gachas, &StatsGacha{GachaID: v.GachaID, Draws: v.Draws, Coins: v.Coins})
+		}
+		total, ok := totalGachas[v.GachaID]
+		if !ok {
+			total = &StatsGacha{GachaID: v.GachaID}
+			totalGachas[v.GachaID] = total
+			res.Total.Gachas = append(res.Total.Gachas, total)
+		}
+		total.Draws += v.Draws
+		total.Coins += v.Coins
+	}
+	for _, day := range res.Days {
+		sort.Slice(day.Gachas, func(i, j int) bool { return day.Gachas[i].GachaID < day.Gachas[j].GachaID })
+	}
+	sort.Slice(res.Total.Gachas, func(i, j int) bool { return res.Total.Gachas[i].GachaID < res.Total.Gachas[j].GachaID })
+
+	return successResponse(c, res)
+}
+
+type AdminGetStatsResponse struct {
+	From       string      `json:"from"`
+	To         string      `json:"to"`
+	Days       []*StatsDay `json:"days"`
+	Total      *StatsTotal `json:"total"`
+	RolledUpAt int64       `json:"rolledUpAt"` // 期間内で最後に集計した日時
+}
+
+type StatsDay struct {
+	Date            string        `json:"date"`
+	DAU             int64         `json:"dau"`
+	MAU             int64         `json:"mau"`           // 当日までの30日間にログインしたユーザ数
+	Registrations   map[int]int64 `json:"registrations"` // platform_typeごとの新規登録数
+	CoinsRewarded   int64         `json:"coinsRewarded"`
+	CoinsSpentGacha int64         `json:"coinsSpentGacha"`
+	Gachas          []*StatsGacha `json:"gachas"`
+}
+
+type StatsTotal struct {
+	Registrations   map[int]int64 `json:"registrations"`
+	CoinsRewarded   int64         `json:"coinsRewarded"`
+	CoinsSpentGacha int64         `json:"coinsSpentGacha"`
+	Gachas          []*StatsGacha `json:"gachas"`
+}
+
+type StatsGacha struct {
+	GachaID int64 `json:"gachaId"`
+	Draws   int64 `json:"draws"`
+	Coins   int64 `json:"coins"`
+}
+
+type StatsEvent struct {
+	ID           int64  `db:"id"`
+	EventType    string `db:"event_type"`
+	EventDate    string `db:"event_date"`
+	UserID       int64  `db:"user_id"`
+	PlatformType *int   `db:"platform_type"`
+	GachaID      *int64 `db:"gacha_id"`
+	Draws        int64  `db:"draws"`
+	Coins        int64  `db:"coins"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type StatsDaily struct {
+	StatDate        time.Time `db:"stat_date"`
+	DAU             int64     `db:"dau"`
+	MAU             int64     `db:"mau"`
+	CoinsRewarded   int64     `db:"coins_rewarded"`
+	CoinsSpentGacha int64     `db:"coins_spent_gacha"`
+	UpdatedAt       int64     `db:"updated_at"`
+}
+
+type StatsDailyRegistration struct {
+	StatDate      time.Time `db:"stat_date"`
+	PlatformType  int       `db:"platform_type"`
+	Registrations int64     `db:"registrations"`
+}
+
+type StatsDailyGacha struct {
+	StatDate time.Time `db:"stat_date"`
+	GachaID  int64     `db:"gacha_id"`
+	Draws    int64     `db:"draws"`
+	Coins    int64     `db:"coins"`
+}
@@ -0,0 +1,252 @@
+/* 初期データ投入後に適用する拡張スキーマ */
+
+DROP TABLE IF EXISTS `user_idempotency_keys`;
+
+/* 冪等キーごとのレスポンス保存 */
+CREATE TABLE `user_idempotency_keys` (
+  `user_id` bigint NOT NULL comment 'ユーザID',
+  `idempotency_key` varchar(255) NOT NULL comment 'Idempotency-Keyヘッダの値',
+  `request_hash` varchar(64) NOT NULL comment 'メソッド、パス、ボディのSHA-256',
+  `status_code` int NOT NULL default 0 comment 'レスポンスのステータスコード。0は処理中、-1はレスポンスの保存に失敗',
+  `response_body` mediumblob comment 'レスポンスボディ',
+  `created_at` bigint NOT NULL,
+  `updated_at` bigint NOT NULL,
+  `expired_at` bigint NOT NULL,
+  PRIMARY KEY (`user_id`, `idempotency_key`),
+  INDEX expired_at_idx (`expired_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+DROP TABLE IF EXISTS `reward_boost_masters`;
+
+/* 放置報酬ブーストイベントマスタ */
+CREATE TABLE `reward_boost_masters` (
+  `id` bigint NOT NULL,
+  `name` varchar(255) NOT NULL comment 'イベント名',
+  `multiplier` int NOT NULL comment '報酬倍率。百分率で表示',
+  `start_at` bigint NOT NULL comment '開始日時',
+  `end_at` bigint NOT NULL comment '終了日時',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+DROP TABLE IF EXISTS `rate_limit_buckets`;
+
+/* レート制限のトークンバケット(ISUCON_RATE_LIMIT_BACKEND=mysqlの場合に利用) */
+CREATE TABLE `rate_limit_buckets` (
+  `bucket_key` varchar(255) NOT NULL comment 'ルートグループ、種別、識別子を連結したキー',
+  `tokens` double NOT NULL comment '残りトークン数',
+  `updated_at` bigint NOT NULL comment '最終更新日時(ミリ秒)',
+  `full_at` bigint NOT NULL comment 'トークンが満タンまで回復する日時(ミリ秒)',
+  PRIMARY KEY (`bucket_key`),
+  INDEX full_at_idx (`full_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+/* BANの履歴を残すためユーザごとに複数行を許可する */
+ALTER TABLE `user_bans`
+  DROP INDEX `uniq_user_id`,
+  ADD INDEX `userid_idx` (`user_id`),
+  ADD COLUMN `reason` varchar(255) NOT NULL default '' comment 'BAN理由' AFTER `user_id`,
+  ADD COLUMN `admin_id` bigint default NULL comment 'BANした管理者ID' AFTER `reason`,
+  ADD COLUMN `expired_at` bigint default NULL comment 'BAN期限。NULLの場合は無期限' AFTER `admin_id`;
+
+DROP TABLE IF EXISTS `admin_action_logs`;
+
+/* 管理者によるアイテム付与、没収の記録 */
+CREATE TABLE `admin_action_logs` (
+  `id` bigint NOT NULL,
+  `admin_id` bigint NOT NULL comment '操作した管理者ID',
+  `user_id` bigint NOT NULL comment '対象のユーザID',
+  `action` varchar(32) NOT NULL comment 'grant:付与、revoke:没収',
+  `item_type` int(1) NOT NULL comment 'アイテム種別',
+  `item_id` int NOT NULL comment 'アイテムID',
+  `user_card_id` bigint default NULL comment '没収したカードのuser_cards.id',
+  `amount` bigint NOT NULL comment '個数',
+  `reason` varchar(255) NOT NULL comment '操作理由',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX userid_idx (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+DROP TABLE IF EXISTS `master_snapshots`;
+
+/* マスタ更新ごとの全マスタのスナップショット */
+CREATE TABLE `master_snapshots` (
+  `id` bigint NOT NULL,
+  `version_id` bigint NOT NULL comment '保存時に有効だったversion_masters.id',
+  `master_version` varchar(128) NOT NULL comment '保存時に有効だったマスタバージョン',
+  `admin_id` bigint NOT NULL comment '更新した管理者ID',
+  `action` varchar(32) NOT NULL comment 'initial:最初の変更前の状態、update:マスタ更新、rollback:ロールバック、release:予約リリース',
+  `data` longblob NOT NULL comment 'マスタごとの全行(JSON)',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX version_id_idx (`version_id`, `created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+DROP TABLE IF EXISTS `master_releases`;
+
+/* 反映日時を指定したマスタの予約リリース */
+CREATE TABLE `master_releases` (
+  `id` bigint NOT NULL,
+  `admin_id` bigint NOT NULL comment '登録した管理者ID',
+  `table_names` varchar(255) NOT NULL comment '含まれるマスタのフォーム名(カンマ区切り)',
+  `data` longblob NOT NULL comment 'マスタごとの行(JSON)',
+  `activate_at` bigint NOT NULL comment '反映日時',
+  `status` varchar(16) NOT NULL comment 'pending:反映待ち、released:反映済み、canceled:取り消し、failed:反映失敗',
+  `message` varchar(255) NOT NULL default '' comment '反映に失敗した理由',
+  `released_at` bigint default NULL comment '反映日時',
+  `created_at` bigint NOT NULL,
+  `updated_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX status_activate_at_idx (`status`, `activate_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+/* 管理者のロール。既存の管理者はすべての操作ができるようsuperadminとする */
+ALTER TABLE `admin_users`
+  ADD COLUMN `role` varchar(32) NOT NULL default 'superadmin' comment 'ロール viewer、support、planner、superadmin' AFTER `password`;
+
+ALTER TABLE `admin_users`
+  ADD COLUMN `disabled_at` bigint default NULL comment '無効化日時' AFTER `last_activated_at`;
+
+DROP TABLE IF EXISTS `admin_audit_logs`;
+
+/* 管理者APIの呼び出しの監査ログ。追記のみで更新、削除はしない */
+CREATE TABLE `admin_audit_logs` (
+  `id` bigint NOT NULL,
+  `admin_id` bigint default NULL comment '操作した管理者ID。ログイン前の場合はリクエストされたID',
+  `action` varchar(255) NOT NULL comment 'メソッドとルートのパス、またはLOCKOUTなどの出来事',
+  `params` mediumtext NOT NULL comment 'パスパラメータ、クエリ、ボディ、アップロードされたファイルのハッシュ(JSON)',
+  `status_code` int NOT NULL comment 'レスポンスのステータスコード',
+  `ip` varchar(64) NOT NULL comment 'リクエスト元IP',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX admin_id_idx (`admin_id`, `created_at`),
+  INDEX action_idx (`action`, `created_at`),
+  INDEX created_at_idx (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+/* 管理者の2要素認証(TOTP) */
+ALTER TABLE `admin_users`
+  ADD COLUMN `totp_secret` varchar(64) default NULL comment 'TOTPの共有鍵(base32)' AFTER `disabled_at`,
+  ADD COLUMN `totp_enabled_at` bigint default NULL comment '2要素認証を有効にした日時。NULLの場合は無効' AFTER `totp_secret`,
+  ADD COLUMN `totp_last_step` bigint NOT NULL default 0 comment '最後に利用したTOTPのステップ(再利用防止)' AFTER `totp_enabled_at`;
+
+DROP TABLE IF EXISTS `admin_backup_codes`;
+
+/* 2要素認証のバックアップコード */
+CREATE TABLE `admin_backup_codes` (
+  `admin_id` bigint NOT NULL,
+  `code_hash` varchar(64) NOT NULL comment 'バックアップコードのSHA-256',
+  `created_at` bigint NOT NULL,
+  `used_at` bigint default NULL,
+  PRIMARY KEY (`admin_id`, `code_hash`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+DROP TABLE IF EXISTS `admin_login_challenges`;
+
+/* パスワード認証後、2要素認証を待っているログイン */
+CREATE TABLE `admin_login_challenges` (
+  `token` varchar(128) NOT NULL,
+  `admin_id` bigint NOT NULL,
+  `attempts` int NOT NULL default 0 comment 'コードの検証に失敗した回数',
+  `created_at` bigint NOT NULL,
+  `expired_at` bigint NOT NULL,
+  `used_at` bigint default NULL,
+  PRIMARY KEY (`token`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+/* 管理者ログインの失敗によるロック */
+ALTER TABLE `admin_users`
+  ADD COLUMN `locked_at` bigint default NULL comment 'ログインの連続失敗によりロックされた日時' AFTER `totp_last_step`;
+
+DROP TABLE IF EXISTS `admin_login_failures`;
+
+/* 管理者ログインの失敗回数。管理者IDごと、リクエスト元IPと管理者IDの組ごとに数える */
+CREATE TABLE `admin_login_failures` (
+  `login_key` varchar(255) NOT NULL comment 'admin:{管理者ID} または ip:{IP}:admin:{管理者ID}',
+  `failures` int NOT NULL comment '失敗回数',
+  `last_failed_at` bigint NOT NULL comment '最後に失敗した日時',
+  `blocked_until` bigint NOT NULL default 0 comment 'この日時まで次のログインを拒否する',
+  PRIMARY KEY (`login_key`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+DROP TABLE IF EXISTS `stats_events`;
+
+/* KPI集計用のイベント。ログイン、登録、放置報酬、ガチャの時点で追記し、runStatsRollupで日次集計に反映する */
+CREATE TABLE `stats_events` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `event_type` varchar(32) NOT NULL comment 'login, register, reward, gacha',
+  `event_date` date NOT NULL comment '集計する日付',
+  `user_id` bigint NOT NULL,
+  `platform_type` int default NULL comment 'registerの場合のみ',
+  `gacha_id` bigint default NULL comment 'gachaの場合のみ',
+  `draws` bigint NOT NULL default 0 comment 'ガチャを引いた回数',
+  `coins` bigint NOT NULL default 0 comment '獲得または消費したコイン',
+  `rolled_up` tinyint(1) NOT NULL default 0 comment '日次集計に反映済みか',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX event_date_idx (`event_type`, `event_date`, `user_id`),
+  INDEX rolled_up_idx (`rolled_up`, `id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+DROP TABLE IF EXISTS `stats_daily`;
+
+/* 日次集計 */
+CREATE TABLE `stats_daily` (
+  `stat_date` date NOT NULL,
+  `dau` bigint NOT NULL comment 'その日にログインしたユーザ数',
+  `mau` bigint NOT NULL comment 'その日までの30日間にログインしたユーザ数',
+  `coins_rewarded` bigint NOT NULL comment '放置報酬で獲得したコイン',
+  `coins_spent_gacha` bigint NOT NULL comment 'ガチャで消費したコイン',
+  `updated_at` bigint NOT NULL comment '集計した日時',
+  PRIMARY KEY (`stat_date`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+DROP TABLE IF EXISTS `stats_daily_registrations`;
+
+/* 日次のplatform_typeごとの新規登録数 */
+CREATE TABLE `stats_daily_registrations` (
+  `stat_date` date NOT NULL,
+  `platform_type` int NOT NULL,
+  `registrations` bigint NOT NULL,
+  PRIMARY KEY (`stat_date`, `platform_type`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+DROP TABLE IF EXISTS `stats_daily_gachas`;
+
+/* 日次のガチャごとの実行回数と消費コイン */
+CREATE TABLE `stats_daily_gachas` (
+  `stat_date` date NOT NULL,
+  `gacha_id` bigint NOT NULL,
+  `draws` bigint NOT NULL,
+  `coins` bigint NOT NULL,
+  PRIMARY KEY (`stat_date`, `gacha_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+/* 全員プレゼントの配布条件。NULLの条件は判定しない */
+ALTER TABLE `present_all_masters`
+  ADD COLUMN `target_platform_type` int default NULL comment '所持する端末のplatform_type',
+  ADD COLUMN `target_last_activated_from` bigint default NULL comment '前回ログイン日時の下限',
+  ADD COLUMN `target_last_activated_to` bigint default NULL comment '前回ログイン日時の上限',
+  ADD COLUMN `target_login_bonus_id` bigint default NULL comment '進捗を判定するログインボーナス',
+  ADD COLUMN `target_login_bonus_min_progress` int default NULL comment 'ログインボーナスの累計受け取り回数の下限',
+  ADD COLUMN `target_segment_id` bigint default NULL comment '配布対象のセグメント';
+
+DROP TABLE IF EXISTS `present_segments`;
+
+/* 全員プレゼントの配布対象とするユーザIDの一覧 */
+CREATE TABLE `present_segments` (
+  `id` bigint NOT NULL,
+  `name` varchar(255) NOT NULL,
+  `user_count` bigint NOT NULL,
+  `admin_id` bigint NOT NULL comment '登録した管理者',
+  `created_at` bigint NOT NULL,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;
+
+DROP TABLE IF EXISTS `present_segment_users`;
+
+CREATE TABLE `present_segment_users` (
+  `segment_id` bigint NOT NULL,
+  `user_id` bigint NOT NULL,
+  PRIMARY KEY (`segment_id`, `user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_bin;